@@ -4,12 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/botcrash"
+	"github.com/high-moctane/milbot/botlog"
 	"github.com/high-moctane/milbot/botplugin"
+	"github.com/high-moctane/milbot/libatnd"
 	"github.com/slack-go/slack"
 )
 
@@ -19,29 +24,59 @@ const envSlackClientSecret = "MILBOT_SLACK_CLIENT_SECRET"
 // pluginTimeout はプラグインが返事をするののタイムアウト時間です。
 var pluginTimeout = 120 * time.Second
 
+// closeClientTimeout は終了するときに送信待ちのメッセージを送り終わるのを待つ時間です。
+const closeClientTimeout = 10 * time.Second
+
 // Bot は milbot の bot 部分を扱います。
 // 終わるときは必ず Stop を呼んでください。
 type Bot struct {
 	plugins   []botplugin.Plugin
 	client    *slack.Client
+	out       *botclient.Client
 	rtm       *slack.RTM
 	isStarted bool
+
+	// milbot 自身のユーザ ID です。auth で取得します。
+	selfID string
+
+	// コマンドとプラグインの対応です。
+	router *commandRouter
+
+	// Bot を起動した時間です。
+	startTime time.Time
+
+	// RTM の接続状況です。
+	muConn          *sync.RWMutex
+	connected       bool
+	connectionCount int
 }
 
 // NewBot は新しい Bot インスタンスを返します。
-func NewBot(plugins []botplugin.Plugin) *Bot {
-	return &Bot{
-		plugins: append(plugins, NewHelpPlugin(plugins)),
+func NewBot(plugins []botplugin.Plugin, atnd *libatnd.Atnd) *Bot {
+	b := &Bot{
+		startTime: time.Now(),
+		muConn:    new(sync.RWMutex),
 	}
+	plugins = append(plugins, NewStatusPlugin(b, atnd))
+	b.plugins = append(plugins, NewHelpPlugin(plugins))
+	return b
 }
 
 // Serve は Bot プラグインを起動します。err は 必ず not-nil です。
 func (b *Bot) Serve(ctx context.Context) error {
+	router, err := newCommandRouter(b.plugins)
+	if err != nil {
+		return fmt.Errorf("bot run failed: %w", err)
+	}
+	b.router = router
+
 	client, err := b.launchSlack()
 	if err != nil {
 		return fmt.Errorf("bot run failed: %w", err)
 	}
 	b.client = client
+	b.out = botclient.New(client)
+	botlog.SetSlackClient(b.out)
 
 	if err := b.auth(); err != nil {
 		return fmt.Errorf("bot run failed: %w", err)
@@ -60,7 +95,7 @@ func (b *Bot) Serve(ctx context.Context) error {
 func (b *Bot) auth() error {
 	var wait time.Duration = 1
 	for wait > 0 {
-		_, err := b.client.AuthTest()
+		resp, err := b.client.AuthTest()
 		var urlErr *url.Error
 		if errors.As(err, &urlErr) {
 			time.Sleep(wait * time.Second)
@@ -69,6 +104,7 @@ func (b *Bot) auth() error {
 		} else if err != nil {
 			return fmt.Errorf("auth error: %w", err)
 		}
+		b.selfID = resp.UserID
 		return nil
 	}
 	return errors.New("auth timeout")
@@ -100,7 +136,7 @@ func (b *Bot) newSlackClient() (*slack.Client, error) {
 // startPlugin で plugins の起動処理をします。
 func (b *Bot) startPlugins() error {
 	for _, plg := range b.plugins {
-		if err := plg.Start(b.client); err != nil {
+		if err := plg.Start(b.out); err != nil {
 			return fmt.Errorf("plugin start failed: %w", err)
 		}
 	}
@@ -113,8 +149,19 @@ func (b *Bot) servePlugins(ctx context.Context) error {
 		if err := b.detectUncontinuableRTMEvent(&event); err != nil {
 			return fmt.Errorf("serve plugins error, %w", err)
 		}
+		b.updateConnection(&event)
+
+		kind := b.classifyEvent(&event)
+		if kind == botplugin.MessageNormal {
+			if b.dispatchCommand(ctx, event, kind) {
+				continue
+			}
+		}
 
 		for _, plg := range b.plugins {
+			if !botplugin.SubscriptionOf(plg).Accepts(event, kind) {
+				continue
+			}
 			go b.sendEventToPlugin(ctx, plg, event)
 		}
 	}
@@ -131,12 +178,114 @@ func (*Bot) detectUncontinuableRTMEvent(event *slack.RTMEvent) error {
 	return nil
 }
 
+// dispatchCommand は event がコマンドであればそれを持つプラグインだけに渡します。
+// コマンドを持つプラグインがなければ候補を返信します。
+// event がコマンドだった場合は true を返します。
+func (b *Bot) dispatchCommand(ctx context.Context, event slack.RTMEvent, kind botplugin.MessageKind) bool {
+	ev := event.Data.(*slack.MessageEvent)
+	plg, isCommand := b.router.route(ev.Text)
+	if !isCommand {
+		return false
+	}
+
+	if plg == nil {
+		go b.replyUnknownCommand(ctx, ev)
+	} else if botplugin.SubscriptionOf(plg).Accepts(event, kind) {
+		go b.sendEventToPlugin(ctx, plg, event)
+	}
+	return true
+}
+
+// replyUnknownCommand は存在しないコマンドに対して近いコマンドを提案します。
+func (b *Bot) replyUnknownCommand(ctx context.Context, ev *slack.MessageEvent) {
+	defer botcrash.Recover()
+
+	newCtx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+
+	_, _, _, err := b.out.SendMessageContext(
+		newCtx,
+		ev.Channel,
+		slack.MsgOptionText(b.unknownCommandMessage(ev.Text), true),
+	)
+	if err != nil {
+		botlog.Warn("reply unknown command failed", "error", err)
+	}
+}
+
+// unknownCommandMessage は存在しないコマンドへの返事を構築します。
+func (b *Bot) unknownCommandMessage(text string) string {
+	msg := new(strings.Builder)
+	msg.WriteString("そのコマンドはありません (´･ω･｀)\n")
+
+	suggestions := b.router.suggest(text)
+	if len(suggestions) == 0 {
+		msg.WriteString("`milbot help` で使い方を確認してください。")
+		return msg.String()
+	}
+
+	quoted := []string{}
+	for _, cmd := range suggestions {
+		quoted = append(quoted, "`"+botplugin.CommandPrefix+" "+cmd+"`")
+	}
+	msg.WriteString("もしかして " + strings.Join(quoted, " か ") + " ですか？")
+	return msg.String()
+}
+
+// classifyEvent は event がメッセージのときにその種類を返します。
+func (b *Bot) classifyEvent(event *slack.RTMEvent) botplugin.MessageKind {
+	ev, ok := event.Data.(*slack.MessageEvent)
+	if !ok {
+		return botplugin.MessageOther
+	}
+	return botplugin.ClassifyMessage(ev, b.selfID)
+}
+
+// updateConnection は event から RTM の接続状況を更新します。
+func (b *Bot) updateConnection(event *slack.RTMEvent) {
+	b.muConn.Lock()
+	defer b.muConn.Unlock()
+
+	switch ev := event.Data.(type) {
+	case *slack.ConnectedEvent:
+		b.connected = true
+		b.connectionCount = ev.ConnectionCount
+	case *slack.DisconnectedEvent:
+		b.connected = false
+	}
+}
+
+// Connection は RTM に接続中かどうかと再接続した回数を返します。
+func (b *Bot) Connection() (connected bool, reconnects int) {
+	b.muConn.RLock()
+	defer b.muConn.RUnlock()
+
+	// slack-go の ConnectionCount は最初につながったときが 0 なので，そのまま再接続の回数です。
+	return b.connected, b.connectionCount
+}
+
+// Uptime は Bot を起動してからの時間を返します。
+func (b *Bot) Uptime() time.Duration {
+	return time.Since(b.startTime)
+}
+
+// PluginNames は有効になっているプラグインの名前のリストを返します。
+func (b *Bot) PluginNames() []string {
+	names := []string{}
+	for _, plg := range b.plugins {
+		names = append(names, plg.Name())
+	}
+	return names
+}
+
 // sendEventToPlugin は plugin に event を渡します。
 func (*Bot) sendEventToPlugin(ctx context.Context, plg botplugin.Plugin, event slack.RTMEvent) {
+	defer botcrash.Recover()
+
 	newCtx, cancel := context.WithTimeout(ctx, pluginTimeout)
 	defer cancel()
 	if err := plg.Serve(newCtx, event); err != nil {
-		log.Print(err)
+		botlog.Error("plugin serve failed", "plugin", plg.Name(), "error", err)
 	}
 }
 
@@ -152,8 +301,11 @@ func (*Bot) getSlackClientSecret() (string, error) {
 // Stop は Bot の終了処理をします。必ず呼んでください。
 func (b *Bot) Stop() []error {
 	var errs []error
-	if err := b.rtm.Disconnect(); err != nil {
-		errs = append(errs, err)
+	// Slack につなぐ前に Serve が失敗したときは rtm がありません。
+	if b.rtm != nil {
+		if err := b.rtm.Disconnect(); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
 	if b.isStarted {
@@ -163,5 +315,14 @@ func (b *Bot) Stop() []error {
 			}
 		}
 	}
+
+	// プラグインが最後に送ったメッセージも送り終えてから止めます。
+	if b.out != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closeClientTimeout)
+		defer cancel()
+		if err := b.out.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	return errs
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/high-moctane/milbot/botplugin"
+	"github.com/slack-go/slack"
+)
+
+func TestStopBeforeConnect(t *testing.T) {
+	// コマンドがぶつかると Slack につなぐ前に Serve が失敗します。
+	a := &commandPlugin{name: "a", commands: []string{"foo"}}
+	b := &commandPlugin{name: "b", commands: []string{"foo"}}
+	bot := NewBot([]botplugin.Plugin{a, b}, nil)
+
+	if err := bot.Serve(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if errs := bot.Stop(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestConnection(t *testing.T) {
+	bot := NewBot(nil, nil)
+
+	tests := []struct {
+		data       interface{}
+		connected  bool
+		reconnects int
+	}{
+		{nil, false, 0},
+		{&slack.ConnectedEvent{ConnectionCount: 0}, true, 0},
+		{&slack.DisconnectedEvent{}, false, 0},
+		{&slack.ConnectedEvent{ConnectionCount: 1}, true, 1},
+		{&slack.ConnectedEvent{ConnectionCount: 2}, true, 2},
+	}
+
+	for idx, test := range tests {
+		if test.data != nil {
+			bot.updateConnection(&slack.RTMEvent{Data: test.data})
+		}
+		connected, reconnects := bot.Connection()
+		if connected != test.connected || reconnects != test.reconnects {
+			t.Errorf("[%d] expected (%v, %d), got (%v, %d)",
+				idx, test.connected, test.reconnects, connected, reconnects)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package botaudit は特権的なコマンドやメンバー情報を変えるコマンドの監査ログを扱います。
+// 監査ログはデータディレクトリに JSON Lines 形式で追記されます。
+package botaudit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/high-moctane/milbot/botlog"
+	"github.com/slack-go/slack"
+)
+
+// auditFileName は監査ログのファイルの名前です。
+const auditFileName = "audit.jsonl"
+
+// auditPerm は監査ログのファイルのパーミッションです。
+const auditPerm = 0600
+
+// envMilbotAuditRetentionDays は監査ログを残しておく日数の環境変数です。
+const envMilbotAuditRetentionDays = "MILBOT_AUDIT_RETENTION_DAYS"
+
+// defaultRetentionDays は監査ログを残しておくデフォルトの日数です。
+const defaultRetentionDays = 365
+
+// compactInterval は古い監査ログを消す間隔です。
+const compactInterval = 24 * time.Hour
+
+// 監査ログの結果です。
+const (
+	OutcomeOK      = "ok"      // 成功しました。
+	OutcomeDenied  = "denied"  // 権限がありませんでした。
+	OutcomeInvalid = "invalid" // コマンドの引数が不正でした。
+)
+
+// OutcomeError はエラーで失敗したときの結果です。
+func OutcomeError(err error) string {
+	return "error: " + err.Error()
+}
+
+// Entry は監査ログのひとつのエントリです。
+type Entry struct {
+	Time     time.Time `json:"time"`
+	UserID   string    `json:"user_id"`
+	UserName string    `json:"user_name"`
+	Channel  string    `json:"channel"`
+	Command  string    `json:"command"`
+	Outcome  string    `json:"outcome"`
+}
+
+// Filter は Query で取り出すエントリの条件です。ゼロ値の項目は無視されます。
+type Filter struct {
+	User  string    // ユーザ ID かユーザ名です。
+	Since time.Time // これより後のエントリだけを取り出します。
+}
+
+// match は e が f の条件を満たすかどうかを返します。
+func (f Filter) match(e *Entry) bool {
+	if f.User != "" && f.User != e.UserID && f.User != e.UserName {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// mu は監査ログのファイルを守ります。
+var mu sync.Mutex
+
+// lastCompact は最後に古い監査ログを消した時間です。
+var lastCompact time.Time
+
+// Record は監査ログにエントリを追記します。e.Time がゼロ値のときは現在時刻を使います。
+func Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("record audit failed: %w", err)
+	}
+
+	path, err := botdata.Path(auditFileName)
+	if err != nil {
+		return fmt.Errorf("record audit failed: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if time.Since(lastCompact) >= compactInterval {
+		if err := compact(path, e.Time); err != nil {
+			return fmt.Errorf("record audit failed: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, auditPerm)
+	if err != nil {
+		return fmt.Errorf("record audit failed: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("record audit failed: %w", err)
+	}
+	return nil
+}
+
+// RecordEvent は ev を送ったユーザが command を実行した結果を監査ログに追記します。
+// ユーザ名が取得できなかった場合はユーザ ID だけを記録します。
+func RecordEvent(ctx context.Context, client *slack.Client, ev *slack.MessageEvent, command, outcome string) error {
+	e := Entry{
+		UserID:  ev.User,
+		Channel: ev.Channel,
+		Command: command,
+		Outcome: outcome,
+	}
+	if user, err := client.GetUserInfoContext(ctx, ev.User); err == nil {
+		e.UserName = user.Name
+	}
+	return Record(e)
+}
+
+// Query は f の条件を満たすエントリを古い順に返します。
+func Query(f Filter) ([]*Entry, error) {
+	path, err := botdata.Path(auditFileName)
+	if err != nil {
+		return nil, fmt.Errorf("query audit failed: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	entries, err := readEntries(path)
+	if err != nil {
+		return nil, fmt.Errorf("query audit failed: %w", err)
+	}
+
+	res := []*Entry{}
+	for _, e := range entries {
+		if f.match(e) {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+// compact は保存期間を過ぎたエントリを監査ログから消します。
+// 読めない行は消さずに残して警告します。書いている途中で電源が切れても監査ログが消えないように，
+// 一時ファイルに書いてから置き換えます。
+func compact(path string, now time.Time) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		lastCompact = now
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("compact audit failed: %w", err)
+	}
+
+	limit := now.AddDate(0, 0, -retentionDays())
+	buf := new(bytes.Buffer)
+	removed, broken := 0, 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		e := new(Entry)
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil {
+			broken++
+		} else if e.Time.Before(limit) {
+			removed++
+			continue
+		}
+		buf.Write(sc.Bytes())
+		buf.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("compact audit failed: %w", err)
+	}
+
+	if broken > 0 {
+		botlog.Warn("audit log has broken lines", "path", path, "lines", broken)
+	}
+	if removed > 0 {
+		if err := botdata.WriteFileAtomic(path, buf.Bytes(), auditPerm); err != nil {
+			return fmt.Errorf("compact audit failed: %w", err)
+		}
+	}
+
+	lastCompact = now
+	return nil
+}
+
+// readEntries は監査ログのエントリをすべて読みます。ファイルが無い場合は空です。
+// 壊れた行は読み飛ばします。
+func readEntries(path string) ([]*Entry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []*Entry{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read audit entries failed: %w", err)
+	}
+	defer f.Close()
+
+	res := []*Entry{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		e := new(Entry)
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil {
+			continue
+		}
+		res = append(res, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read audit entries failed: %w", err)
+	}
+
+	return res, nil
+}
+
+// retentionDays は監査ログを残しておく日数を環境変数から取得します。
+func retentionDays() int {
+	days, err := strconv.Atoi(os.Getenv(envMilbotAuditRetentionDays))
+	if err != nil || days <= 0 {
+		return defaultRetentionDays
+	}
+	return days
+}
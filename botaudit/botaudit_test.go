@@ -0,0 +1,86 @@
+package botaudit
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("MILBOT_DATA_DIR", dir)
+	defer os.Unsetenv("MILBOT_DATA_DIR")
+
+	now := time.Now()
+	entries := []Entry{
+		{Time: now.Add(-2 * time.Hour), UserID: "U1", UserName: "alice", Command: "exit", Outcome: OutcomeOK},
+		{Time: now.Add(-1 * time.Hour), UserID: "U2", UserName: "bob", Command: "atnd set bob", Outcome: OutcomeOK},
+		{Time: now, UserID: "U1", UserName: "alice", Command: "atnd delete bob", Outcome: OutcomeInvalid},
+	}
+	for _, e := range entries {
+		if err := Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter Filter
+		n      int
+	}{
+		{Filter{}, 3},
+		{Filter{User: "U1"}, 2},
+		{Filter{User: "bob"}, 1},
+		{Filter{Since: now.Add(-90 * time.Minute)}, 2},
+		{Filter{User: "alice", Since: now.Add(-90 * time.Minute)}, 1},
+		{Filter{User: "carol"}, 0},
+	}
+
+	for idx, test := range tests {
+		res, err := Query(test.filter)
+		if err != nil {
+			t.Fatalf("[%d] %v", idx, err)
+		}
+		if len(res) != test.n {
+			t.Errorf("[%d] expected %d entries, got %d", idx, test.n, len(res))
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	f, err := ioutil.TempFile("", "botaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2000-01-01T00:00:00Z","command":"old"}` + "\n")
+	f.WriteString("broken line\n")
+	f.WriteString(`{"time":"2100-01-01T00:00:00Z","command":"new"}` + "\n")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := compact(f.Name(), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readEntries(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Command != "new" {
+		t.Errorf("unexpected entries after compact: %v", entries)
+	}
+
+	// 読めない行は消しません。
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "broken line\n") {
+		t.Errorf("broken line removed by compact: %q", data)
+	}
+}
@@ -0,0 +1,315 @@
+// Package botclient は Slack へのメッセージ送信をまとめて扱うクライアントです。
+// チャンネルごとにキューを持って送信の順番を守り，レートリミットや一時的な
+// ネットワークのエラーのときは呼び出し元の context の期限内でリトライします。
+package botclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// maxRetries は context に期限がないときにリトライする最大の回数です。
+const maxRetries = 5
+
+// initialBackoff は一時的なエラーのときに最初に待つ時間です。
+var initialBackoff = 1 * time.Second
+
+// maxBackoff は一時的なエラーのときに待つ最大の時間です。
+var maxBackoff = 30 * time.Second
+
+// queueSize はチャンネルごとのキューの長さです。
+const queueSize = 64
+
+// permanentErrors はリトライしても成功しない Slack API のエラーです。
+var permanentErrors = map[string]bool{
+	"channel_not_found":       true,
+	"not_in_channel":          true,
+	"is_archived":             true,
+	"msg_too_long":            true,
+	"no_text":                 true,
+	"invalid_blocks":          true,
+	"restricted_action":       true,
+	"invalid_auth":            true,
+	"not_authed":              true,
+	"account_inactive":        true,
+	"token_revoked":           true,
+	"missing_scope":           true,
+	"cannot_reply_to_message": true,
+}
+
+// PermanentError はリトライしても成功しない送信のエラーです。
+type PermanentError struct {
+	Channel string
+	Err     error
+}
+
+// Error です。
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("permanent failure sending to %s: %v", e.Channel, e.Err)
+}
+
+// Unwrap です。
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// ErrClosed は Close したあとの Client で送信しようとしたことを表すエラーです。
+var ErrClosed = errors.New("botclient is closed")
+
+// IsPermanent は err が PermanentError を含むかどうかを返します。
+func IsPermanent(err error) bool {
+	var permErr *PermanentError
+	return errors.As(err, &permErr)
+}
+
+// sendFunc はメッセージを実際に送信する関数です。
+type sendFunc func(ctx context.Context, channelID string, options ...slack.MsgOption) (string, string, string, error)
+
+// Client は *slack.Client のメッセージ送信をキューとリトライ付きにしたものです。
+// SendMessage と SendMessageContext 以外は *slack.Client のものをそのまま使えます。
+type Client struct {
+	*slack.Client
+
+	send sendFunc
+
+	muQueues *sync.Mutex
+	queues   map[string]chan *job
+
+	// Close の状態です。キューに入れている間は muClose を RLock します。
+	// closing は Close が始まったら閉じて，キューが空くのを待っている送信をやめさせます。
+	// stop はすべての送信がキューに入り終わってから閉じて，worker にキューを空にして止まらせます。
+	muClose   *sync.RWMutex
+	closed    bool
+	closeOnce *sync.Once
+	closing   chan struct{}
+	stop      chan struct{}
+	workers   *sync.WaitGroup
+}
+
+// New は client を使って送信する Client を返します。
+func New(client *slack.Client) *Client {
+	return newClient(client, client.SendMessageContext)
+}
+
+// newClient は send で送信する Client を返します。
+func newClient(client *slack.Client, send sendFunc) *Client {
+	return &Client{
+		Client:    client,
+		send:      send,
+		muQueues:  new(sync.Mutex),
+		queues:    map[string]chan *job{},
+		muClose:   new(sync.RWMutex),
+		closeOnce: new(sync.Once),
+		closing:   make(chan struct{}),
+		stop:      make(chan struct{}),
+		workers:   new(sync.WaitGroup),
+	}
+}
+
+// job は送信待ちのメッセージです。
+type job struct {
+	ctx     context.Context
+	options []slack.MsgOption
+	result  chan result
+}
+
+// result は送信の結果です。
+type result struct {
+	channel, timestamp, text string
+	err                      error
+}
+
+// SendMessage は channelID にメッセージを送信します。
+func (c *Client) SendMessage(channelID string, options ...slack.MsgOption) (string, string, string, error) {
+	return c.SendMessageContext(context.Background(), channelID, options...)
+}
+
+// SendMessageContext は channelID にメッセージを送信します。
+// 同じチャンネルへのメッセージは呼び出した順に送信されます。
+// 失敗したときはリトライしますが，ctx が終わるとあきらめます。
+func (c *Client) SendMessageContext(ctx context.Context, channelID string, options ...slack.MsgOption) (string, string, string, error) {
+	j := &job{ctx: ctx, options: options, result: make(chan result, 1)}
+	if err := c.enqueue(ctx, channelID, j); err != nil {
+		return "", "", "", fmt.Errorf("send message failed: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", "", "", fmt.Errorf("send message failed: %w", ctx.Err())
+	case res := <-j.result:
+		return res.channel, res.timestamp, res.text, res.err
+	}
+}
+
+// enqueue は j を channelID のキューに入れます。
+func (c *Client) enqueue(ctx context.Context, channelID string, j *job) error {
+	c.muClose.RLock()
+	defer c.muClose.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closing:
+		return ErrClosed
+	case c.queue(channelID) <- j:
+		return nil
+	}
+}
+
+// queue は channelID のキューを返します。なければ作って送信を始めます。
+// 呼び出し側で muClose を RLock してください。
+func (c *Client) queue(channelID string) chan *job {
+	c.muQueues.Lock()
+	defer c.muQueues.Unlock()
+
+	q, ok := c.queues[channelID]
+	if !ok {
+		q = make(chan *job, queueSize)
+		c.queues[channelID] = q
+		c.workers.Add(1)
+		go c.serveQueue(channelID, q)
+	}
+	return q
+}
+
+// serveQueue は q のメッセージを順に送信します。stop が閉じたらキューを空にして止まります。
+func (c *Client) serveQueue(channelID string, q chan *job) {
+	defer c.workers.Done()
+
+	for {
+		select {
+		case j := <-q:
+			c.serveJob(channelID, j)
+		case <-c.stop:
+			for {
+				select {
+				case j := <-q:
+					c.serveJob(channelID, j)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// serveJob は j のメッセージを送信して結果を返します。
+func (c *Client) serveJob(channelID string, j *job) {
+	if err := j.ctx.Err(); err != nil {
+		j.result <- result{err: fmt.Errorf("send message failed: %w", err)}
+		return
+	}
+
+	res := result{}
+	res.channel, res.timestamp, res.text, res.err = c.sendWithRetry(j.ctx, channelID, j.options)
+	j.result <- res
+}
+
+// Close は新しいメッセージの受け付けをやめて，キューに残っているメッセージを送り終わるまで待ちます。
+// ctx が終わったら送り終わるのを待たずに返ります。
+func (c *Client) Close(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+
+		// キューに入れている途中の送信が終わるのを待ってから worker を止めます。
+		c.muClose.Lock()
+		c.closed = true
+		c.muClose.Unlock()
+
+		close(c.stop)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("close client failed: %w", ctx.Err())
+	}
+}
+
+// sendWithRetry は必要に応じてリトライしながらメッセージを送信します。
+func (c *Client) sendWithRetry(ctx context.Context, channelID string, options []slack.MsgOption) (string, string, string, error) {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		respChannel, respTimestamp, respText, err := c.send(ctx, channelID, options...)
+		if err == nil {
+			return respChannel, respTimestamp, respText, nil
+		}
+
+		var wait time.Duration
+		var rateErr *slack.RateLimitedError
+		if errors.As(err, &rateErr) {
+			wait = rateErr.RetryAfter
+		} else if isTransient(err) {
+			wait = backoff
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		} else if isPermanent(err) {
+			return "", "", "", &PermanentError{Channel: channelID, Err: err}
+		} else {
+			return "", "", "", fmt.Errorf("send message failed: %w", err)
+		}
+
+		if !canRetry(ctx, attempt, wait) {
+			return "", "", "", fmt.Errorf("send message failed after %d attempts: %w", attempt+1, err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", "", "", fmt.Errorf("send message failed: %w", ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// canRetry は wait だけ待ってからリトライできるかどうかを返します。
+// ctx に期限があればその期限内で，なければ maxRetries 回までリトライします。
+func canRetry(ctx context.Context, attempt int, wait time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Now().Add(wait).Before(deadline)
+	}
+	return attempt < maxRetries
+}
+
+// isPermanent は err が permanentErrors の Slack API のエラーかどうかを返します。
+func isPermanent(err error) bool {
+	var respErr slack.SlackErrorResponse
+	return errors.As(err, &respErr) && permanentErrors[respErr.Err]
+}
+
+// isTransient は err がリトライすれば成功するかもしれないエラーかどうかを返します。
+func isTransient(err error) bool {
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
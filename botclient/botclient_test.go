@@ -0,0 +1,184 @@
+package botclient
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// fakeSender は送信のかわりに結果を順に返します。
+type fakeSender struct {
+	mu    sync.Mutex
+	errs  []error
+	calls int
+	sent  []string
+}
+
+func (f *fakeSender) send(_ context.Context, channelID string, _ ...slack.MsgOption) (string, string, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+	f.sent = append(f.sent, channelID)
+	return channelID, "ts", "", nil
+}
+
+func init() {
+	initialBackoff = time.Millisecond
+	maxBackoff = 10 * time.Millisecond
+}
+
+func TestSendMessageRetry(t *testing.T) {
+	tests := []struct {
+		errs      []error
+		calls     int
+		ok        bool
+		permanent bool
+	}{
+		{nil, 1, true, false},
+		{[]error{&slack.RateLimitedError{RetryAfter: time.Millisecond}}, 2, true, false},
+		{[]error{&url.Error{Op: "Post", Err: errors.New("connection refused")}, &url.Error{Op: "Post", Err: errors.New("connection refused")}}, 3, true, false},
+		{[]error{slack.SlackErrorResponse{Err: "channel_not_found"}}, 1, false, true},
+		{[]error{slack.SlackErrorResponse{Err: "something_strange"}}, 1, false, false},
+		{[]error{errors.New("channel_not_found")}, 1, false, false},
+	}
+
+	for idx, test := range tests {
+		f := &fakeSender{errs: test.errs}
+		c := newClient(nil, f.send)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, _, _, err := c.SendMessageContext(ctx, "C1")
+		cancel()
+
+		if (err == nil) != test.ok {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+		}
+		if IsPermanent(err) != test.permanent {
+			t.Errorf("[%d] expected permanent %v, got %v", idx, test.permanent, IsPermanent(err))
+		}
+		if f.calls != test.calls {
+			t.Errorf("[%d] expected %d calls, got %d", idx, test.calls, f.calls)
+		}
+	}
+}
+
+func TestSendMessageRetryAfterDeadline(t *testing.T) {
+	f := &fakeSender{errs: []error{&slack.RateLimitedError{RetryAfter: time.Minute}}}
+	c := newClient(nil, f.send)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, _, err := c.SendMessageContext(ctx, "C1"); err == nil {
+		t.Error("expected error")
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("should give up without waiting beyond the deadline")
+	}
+}
+
+func TestSendMessageCanceled(t *testing.T) {
+	f := &fakeSender{errs: []error{&slack.RateLimitedError{RetryAfter: time.Minute}}}
+	c := newClient(nil, f.send)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	// 待っている間に ctx が終わったら，最後の送信のエラーではなく ctx のエラーを返します。
+	_, _, _, err := c.SendMessageContext(ctx, "C1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	f := &fakeSender{errs: []error{&slack.RateLimitedError{RetryAfter: 20 * time.Millisecond}}}
+	c := newClient(nil, f.send)
+
+	wg := new(sync.WaitGroup)
+	for _, channel := range []string{"C1", "C1", "C2"} {
+		wg.Add(1)
+		go func(channel string) {
+			defer wg.Done()
+			if _, _, _, err := c.SendMessageContext(context.Background(), channel); err != nil {
+				t.Error(err)
+			}
+		}(channel)
+	}
+	// すべてキューに入るのを待ちます。
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// キューに残っていたメッセージは送り終えてから止まります。
+	if len(f.sent) != 3 {
+		t.Errorf("expected 3 messages sent, got %v", f.sent)
+	}
+	if _, _, _, err := c.SendMessageContext(ctx, "C1"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Errorf("second close failed: %v", err)
+	}
+}
+
+// orderKey はテストでメッセージを区別するための context のキーです。
+type orderKey struct{}
+
+func TestSendMessageOrder(t *testing.T) {
+	mu := new(sync.Mutex)
+	order := []int{}
+	first := true
+	send := func(ctx context.Context, channelID string, _ ...slack.MsgOption) (string, string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if first {
+			first = false
+			return "", "", "", &slack.RateLimitedError{RetryAfter: 20 * time.Millisecond}
+		}
+		order = append(order, ctx.Value(orderKey{}).(int))
+		return channelID, "ts", "", nil
+	}
+	c := newClient(nil, send)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		ctx := context.WithValue(context.Background(), orderKey{}, i)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := c.SendMessageContext(ctx, "C1"); err != nil {
+				t.Error(err)
+			}
+		}()
+		// 送信の順番を決めるためにキューに入るのを待ちます。
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+
+	for i, n := range order {
+		if i != n {
+			t.Fatalf("messages sent out of order: %v", order)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Package botcrash は milbot が異常終了したときにクラッシュレポートを残して，
+// 次に起動したときに #milbot_log に報告します。
+//
+// 最近のログは Start してからの標準 log パッケージの出力をメモリにためておきます。
+// 起動中はデータディレクトリに実行中マーカーを置いておき，
+// 次に起動したときにマーカーが残っていれば予期しない終了として報告します。
+package botcrash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/high-moctane/milbot/botlog"
+	"github.com/high-moctane/milbot/botversion"
+)
+
+// reportFileName はクラッシュレポートのファイルの名前です。
+const reportFileName = "crash_report.json"
+
+// markerFileName は実行中マーカーのファイルの名前です。
+const markerFileName = "milbot.running"
+
+// filePerm はクラッシュレポートと実行中マーカーのパーミッションです。
+const filePerm = 0600
+
+// recentLines はクラッシュレポートに残す最近のログの行数です。
+const recentLines = 100
+
+// maxReportStack は Slack に送るスタックトレースの最大の長さです。
+const maxReportStack = 3000
+
+// maxReportLogs は Slack に送る最近のログの行数です。
+const maxReportLogs = 30
+
+// recent は最近のログです。
+var recent = newRing(recentLines)
+
+// Report はクラッシュレポートです。
+type Report struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Stack   string    `json:"stack,omitempty"`
+	Logs    []string  `json:"logs,omitempty"`
+	Version string    `json:"version"`
+	PID     int       `json:"pid"`
+}
+
+// newReport は今の状態から reason のクラッシュレポートを作ります。
+func newReport(reason string, stack []byte) *Report {
+	return &Report{
+		Time:    time.Now(),
+		Reason:  reason,
+		Stack:   string(stack),
+		Logs:    recent.lines(),
+		Version: botversion.String(),
+		PID:     os.Getpid(),
+	}
+}
+
+// marker は実行中マーカーの中身です。
+type marker struct {
+	Start   time.Time `json:"start"`
+	Version string    `json:"version"`
+	PID     int       `json:"pid"`
+}
+
+// Write は reason のクラッシュレポートをデータディレクトリに書きます。
+// 異常終了する直前に呼んでください。
+func Write(reason string) error {
+	return writeReport(newReport(reason, nil))
+}
+
+// Fatal は log.Fatal のかわりに使います。クラッシュレポートを書いてから終了します。
+func Fatal(v ...interface{}) {
+	reason := fmt.Sprint(v...)
+	log.Print(reason)
+	if err := writeReport(newReport(reason, debug.Stack())); err != nil {
+		log.Print(err)
+	}
+	os.Exit(1)
+}
+
+// Recover は panic したときにクラッシュレポートを書いてからもう一度 panic します。
+// panic するかもしれない goroutine の最初で defer してください。
+func Recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if err := writeReport(newReport(fmt.Sprintf("panic: %v", r), debug.Stack())); err != nil {
+		log.Print(err)
+	}
+	panic(r)
+}
+
+// writeReport は r をデータディレクトリに書いて，実行中マーカーを消します。
+func writeReport(r *Report) error {
+	path, err := botdata.Path(reportFileName)
+	if err != nil {
+		return fmt.Errorf("write crash report failed: %w", err)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("write crash report failed: %w", err)
+	}
+	if err := botdata.WriteFileAtomic(path, data, filePerm); err != nil {
+		return fmt.Errorf("write crash report failed: %w", err)
+	}
+
+	if err := Finish(); err != nil {
+		return fmt.Errorf("write crash report failed: %w", err)
+	}
+	return nil
+}
+
+// Start は標準 log パッケージの出力をクラッシュレポートのためにためはじめ，
+// 前回のクラッシュレポートや予期しない終了を #milbot_log に報告して，
+// 実行中マーカーを置きます。起動したときに一度だけ呼んでください。
+func Start(ctx context.Context) error {
+	log.SetOutput(io.MultiWriter(os.Stderr, recent))
+
+	reportPath, err := botdata.Path(reportFileName)
+	if err != nil {
+		return fmt.Errorf("start crash reporter failed: %w", err)
+	}
+	markerPath, err := botdata.Path(markerFileName)
+	if err != nil {
+		return fmt.Errorf("start crash reporter failed: %w", err)
+	}
+
+	if r, err := loadReport(reportPath); err != nil {
+		botlog.Warn("load crash report failed", "error", err)
+	} else if r != nil {
+		botlog.SendPayload(ctx, botlog.LevelError, r.payload())
+	}
+	if err := os.Remove(reportPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("start crash reporter failed: %w", err)
+	}
+
+	if m, err := loadMarker(markerPath); err != nil {
+		botlog.Warn("load run marker failed", "error", err)
+	} else if m != nil {
+		botlog.Error("previous milbot exited unexpectedly",
+			"start", m.Start.Format("2006-01-02 15:04:05"),
+			"version", m.Version,
+			"pid", m.PID)
+	}
+
+	data, err := json.Marshal(marker{Start: time.Now(), Version: botversion.String(), PID: os.Getpid()})
+	if err != nil {
+		return fmt.Errorf("start crash reporter failed: %w", err)
+	}
+	if err := botdata.WriteFileAtomic(markerPath, data, filePerm); err != nil {
+		return fmt.Errorf("start crash reporter failed: %w", err)
+	}
+	return nil
+}
+
+// Finish は実行中マーカーを消します。意図して終了するときに呼んでください。
+func Finish() error {
+	path, err := botdata.Path(markerFileName)
+	if err != nil {
+		return fmt.Errorf("finish crash reporter failed: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("finish crash reporter failed: %w", err)
+	}
+	return nil
+}
+
+// loadReport は path のクラッシュレポートを読みます。無ければ nil を返します。
+func loadReport(path string) (*Report, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load crash report failed: %w", err)
+	}
+
+	r := new(Report)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("load crash report failed: %w", err)
+	}
+	return r, nil
+}
+
+// loadMarker は path の実行中マーカーを読みます。無ければ nil を返します。
+// 壊れていても残っていれば予期しない終了なので，わかる範囲で返します。
+func loadMarker(path string) (*marker, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load run marker failed: %w", err)
+	}
+
+	m := new(marker)
+	if err := json.Unmarshal(data, m); err != nil {
+		m.Version = "unknown"
+	}
+	return m, nil
+}
+
+// payload は r を #milbot_log に送る Payload にします。
+func (r *Report) payload() *botlog.Payload {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, ":boom: 前回の milbot がクラッシュしました (´･ω･｀)\n")
+	fmt.Fprintf(b, "*時刻* %s\n", r.Time.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(b, "*バージョン* %s\n", botlog.Escape(r.Version))
+	fmt.Fprintf(b, "*理由* %s", botlog.Escape(r.Reason))
+
+	if r.Stack != "" {
+		stack := truncate(r.Stack, maxReportStack)
+		fmt.Fprintf(b, "\n*スタックトレース*\n%s", botlog.CodeFence(botlog.Escape(stack)))
+	}
+
+	if len(r.Logs) > 0 {
+		logs := r.Logs
+		if len(logs) > maxReportLogs {
+			logs = logs[len(logs)-maxReportLogs:]
+		}
+		fmt.Fprintf(b, "\n*最近のログ*\n%s", botlog.CodeFence(botlog.Escape(strings.Join(logs, "\n"))))
+	}
+
+	return &botlog.Payload{Text: b.String()}
+}
+
+// truncate は s が max バイトより長ければ，max バイトまでの最後の行で切って ... をつけます。
+// 1 行目から長すぎるときは文字の途中で切らないようにします。
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	cut := strings.LastIndexByte(s[:max], '\n')
+	if cut <= 0 {
+		cut = max
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+	}
+	return s[:cut] + "\n..."
+}
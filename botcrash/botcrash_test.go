@@ -0,0 +1,94 @@
+package botcrash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		writes []string
+		lines  []string
+	}{
+		{[]string{}, []string{}},
+		{[]string{"a\n", "b\n"}, []string{"a", "b"}},
+		{[]string{"a\nb", "c\nd\n"}, []string{"a", "bc", "d"}},
+		{[]string{"a\nb\nc\nd\n"}, []string{"b", "c", "d"}},
+		{[]string{"a\nb\nc\nd\ne"}, []string{"b", "c", "d", "e"}},
+	}
+
+	for idx, test := range tests {
+		r := newRing(3)
+		for _, w := range test.writes {
+			if _, err := r.Write([]byte(w)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if lines := r.lines(); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("[%d] expected %q, got %q", idx, test.lines, lines)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botcrash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("MILBOT_DATA_DIR", dir)
+	defer os.Unsetenv("MILBOT_DATA_DIR")
+
+	markerPath := filepath.Join(dir, markerFileName)
+	if err := ioutil.WriteFile(markerPath, []byte("{}"), filePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	recent.Write([]byte("something <wrong>\n"))
+	if err := Write("run failed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(markerPath); !os.IsNotExist(err) {
+		t.Errorf("run marker remains: %v", err)
+	}
+
+	r, err := loadReport(filepath.Join(dir, reportFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Reason != "run failed" {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+
+	text := r.payload().Text
+	for _, want := range []string{"run failed", "something &lt;wrong&gt;"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %q in %q", want, text)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s        string
+		max      int
+		expected string
+	}{
+		{"abc", 3, "abc"},
+		{"ab\ncd\nef", 7, "ab\ncd\n..."},
+		{"ab\ncd\nef", 4, "ab\n..."},
+		{"あいう", 7, "あい\n..."},
+		{"あいう", 5, "あ\n..."},
+	}
+
+	for idx, test := range tests {
+		if res := truncate(test.s, test.max); res != test.expected {
+			t.Errorf("[%d] expected %q, got %q", idx, test.expected, res)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package botcrash
+
+import (
+	"bytes"
+	"sync"
+)
+
+// ring は最近書かれた行を max 行まで覚えておく io.Writer です。
+type ring struct {
+	max int
+
+	mu      *sync.Mutex
+	buf     []string
+	next    int
+	partial []byte
+}
+
+// newRing は max 行を覚えておく ring を作ります。
+func newRing(max int) *ring {
+	return &ring{max: max, mu: new(sync.Mutex)}
+}
+
+// Write は p を行に分けて覚えます。改行で終わらない部分は次の Write までとっておきます。
+func (r *ring) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		r.push(string(data[:i]))
+		data = data[i+1:]
+	}
+	r.partial = append([]byte{}, data...)
+
+	return len(p), nil
+}
+
+// push は line を覚えます。max 行を超えたら一番古い行を忘れます。
+func (r *ring) push(line string) {
+	if len(r.buf) < r.max {
+		r.buf = append(r.buf, line)
+		return
+	}
+	r.buf[r.next] = line
+	r.next = (r.next + 1) % r.max
+}
+
+// lines は覚えている行を古い順に返します。
+func (r *ring) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := append([]string{}, r.buf[r.next:]...)
+	res = append(res, r.buf[:r.next]...)
+	if len(r.partial) > 0 {
+		res = append(res, string(r.partial))
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package botdata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic は path に data を書きます。書いている途中で電源が切れても，
+// path には前の中身か新しい中身のどちらかが残ります。
+//
+// 同じディレクトリの一時ファイルに書いて fsync してから path に rename し，
+// rename を確実に残すためにディレクトリも fsync します。
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("write file atomic failed: %w", err)
+	}
+	// rename できたあとは消すファイルがないので何もしません。
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write file atomic failed: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write file atomic failed: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write file atomic failed: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write file atomic failed: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write file atomic failed: %w", err)
+	}
+
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("write file atomic failed: %w", err)
+	}
+	return nil
+}
+
+// syncDir はディレクトリ dir を fsync します。
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,56 @@
+// Package botdata は milbot がファイルを置くデータディレクトリを扱います。
+package botdata
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// envMilbotDataDir はデータディレクトリを指定する環境変数です。
+// 指定されていない場合は実行ファイルのあるディレクトリを使います。
+const envMilbotDataDir = "MILBOT_DATA_DIR"
+
+// dirPerm はデータディレクトリを作るときのパーミッションです。
+const dirPerm = 0700
+
+// Dir はデータディレクトリのパスを返します。ディレクトリが無ければ作ります。
+func Dir() (string, error) {
+	dir, ok := os.LookupEnv(envMilbotDataDir)
+	if !ok || dir == "" {
+		realExec, err := realExecPath()
+		if err != nil {
+			return "", fmt.Errorf("cannot get data dir: %w", err)
+		}
+		dir = filepath.Dir(realExec)
+	}
+
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return "", fmt.Errorf("cannot get data dir: %w", err)
+	}
+	return dir, nil
+}
+
+// Path はデータディレクトリにある name のパスを返します。
+func Path(name string) (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// realExecPath は実行ファイルの実体のパスを返します。
+func realExecPath() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("cannot get real executable path: %w", err)
+	}
+
+	realExec, err := filepath.EvalSymlinks(executable)
+	if err != nil {
+		return "", fmt.Errorf("cannot get real executable path: %w", err)
+	}
+
+	return realExec, nil
+}
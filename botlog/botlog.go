@@ -2,86 +2,162 @@ package botlog
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
+	"strconv"
 	"strings"
-)
+	"time"
 
-// envMilbotLogWebhookURL は #milbot_log に送信するための Webhook URL の
-// 環境変数です。
-const envMilbotLogWebhookURL = "MILBOT_LOG_WEBHOOK_URL"
+	"github.com/slack-go/slack"
+)
 
-// Send は #milbot_log にログを吐きます。
+// Send は #milbot_log にログを吐きます。Level は LevelInfo です。
 func Send(v ...interface{}) {
 	SendContext(context.Background(), v...)
 }
 
 // SendContext は #milbot_log にログを吐きます。context.Context が
-// 使えます。
+// 使えます。Level は LevelInfo です。
 func SendContext(ctx context.Context, v ...interface{}) {
-	if err := postMilbotLogWebhookContext(ctx, fmt.Sprint(v...)); err != nil {
-		log.Printf("can't send msg to #milbot_log: %v", err)
-	}
+	LogContext(ctx, LevelInfo, fmt.Sprint(v...))
 }
 
 // Sendf は #milbot_log にログを吐きます。Sprintf みたいな感じに
-// 使います。
+// 使います。Level は LevelInfo です。
 func Sendf(format string, v ...interface{}) {
 	SendfContext(context.Background(), format, v...)
 }
 
 // SendfContext は #milbot_log にログを吐きます。Sprintf みたいな感じに
-// 使います。context.Context が使えます。
+// 使います。context.Context が使えます。Level は LevelInfo です。
 func SendfContext(ctx context.Context, format string, v ...interface{}) {
-	if err := postMilbotLogWebhookContext(ctx, fmt.Sprintf(format, v...)); err != nil {
-		log.Printf("can't send msg to #milbot_log: %v", err)
-	}
+	LogContext(ctx, LevelInfo, fmt.Sprintf(format, v...))
 }
 
-// postMilbotLogWebhook は msg を #milbot_log に送信します。
-func postMilbotLogWebhookContext(ctx context.Context, msg string) error {
-	url, err := milbotLogWebhookURL()
-	if err != nil {
-		return err
-	}
+// Debug は LevelDebug のログを吐きます。keyvals にはキーと値を交互に並べます。
+func Debug(msg string, keyvals ...interface{}) {
+	LogContext(context.Background(), LevelDebug, msg, keyvals...)
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, makeWebhookRequestBody(msg))
-	if err != nil {
-		return fmt.Errorf("post to #milbot_log failed: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("post to #milbot_log failed: %w", err)
+// Info は LevelInfo のログを吐きます。keyvals にはキーと値を交互に並べます。
+func Info(msg string, keyvals ...interface{}) {
+	LogContext(context.Background(), LevelInfo, msg, keyvals...)
+}
+
+// Warn は LevelWarn のログを吐きます。keyvals にはキーと値を交互に並べます。
+func Warn(msg string, keyvals ...interface{}) {
+	LogContext(context.Background(), LevelWarn, msg, keyvals...)
+}
+
+// Error は LevelError のログを吐きます。keyvals にはキーと値を交互に並べます。
+func Error(msg string, keyvals ...interface{}) {
+	LogContext(context.Background(), LevelError, msg, keyvals...)
+}
+
+// LogContext は level のログを吐きます。ログは MILBOT_LOG_SINKS で Level ごとに
+// 設定された出力先に出ます。Slack への送信はバックグラウンドでまとめて行われるので，
+// 終了する前に Flush を呼んでください。keyvals にはキーと値を交互に並べます。
+func LogContext(_ context.Context, level Level, msg string, keyvals ...interface{}) {
+	dispatch(NewEntry(time.Now(), level, msg, keyvals...))
+}
+
+// Field はログにつけるキーと値の組です。
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Entry はひとつのログです。
+type Entry struct {
+	Time   time.Time
+	Level  Level
+	Msg    string
+	Fields []Field
+
+	// rich は SendPayload で送られたときの Payload です。
+	rich *Payload
+}
+
+// NewEntry は keyvals をキーと値の組に分けて Entry を作ります。
+func NewEntry(t time.Time, level Level, msg string, keyvals ...interface{}) *Entry {
+	e := &Entry{Time: t, Level: level, Msg: msg}
+	for i := 0; i < len(keyvals); i += 2 {
+		f := Field{Key: fmt.Sprint(keyvals[i]), Value: "(MISSING)"}
+		if i+1 < len(keyvals) {
+			f.Value = fmt.Sprint(keyvals[i+1])
+		}
+		e.Fields = append(e.Fields, f)
 	}
-	defer resp.Body.Close()
-	defer io.Copy(ioutil.Discard, resp.Body)
+	return e
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("post to #milbot_log failed %s", resp.Status)
+// String はファイルや標準エラー出力に出すための 1 行の文字列を返します。
+func (e *Entry) String() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "[%s] %s", e.Level, e.Msg)
+	for _, f := range e.Fields {
+		fmt.Fprintf(b, " %s=%q", f.Key, f.Value)
 	}
+	return b.String()
+}
 
-	return nil
+// Payload は #milbot_log に送信するメッセージです。Blocks や Attachments を使うと
+// リッチなメッセージを送信できます。文字列はそのまま送信されるので，
+// 必要であれば Escape してください。
+type Payload struct {
+	Text        string             `json:"text,omitempty"`
+	Blocks      []slack.Block      `json:"blocks,omitempty"`
+	Attachments []slack.Attachment `json:"attachments,omitempty"`
 }
 
-// makeWebhookRequestBody は Webhook に送信する POST リクエストの body を
-// 作ります。
-func makeWebhookRequestBody(msg string) *strings.Reader {
-	return strings.NewReader(`{"text": "` + msg + `"}`)
+// SendPayload は p を level のログとして出力します。Slack にはそのまま送信され，
+// ファイルや標準エラー出力には p.Text が出ます。
+func SendPayload(_ context.Context, level Level, p *Payload) {
+	e := NewEntry(time.Now(), level, p.Text)
+	e.rich = p
+	dispatch(e)
 }
 
-// milbotLogWebhookURL は #milbot_log に送信できる Webhook の URL を環境変数から
-// 取得します。取得できなかった場合は boterrors.NewErrInvalidEnv を返します。
-func milbotLogWebhookURL() (url string, err error) {
-	url, ok := os.LookupEnv(envMilbotLogWebhookURL)
-	if !ok {
-		err = errors.New(envMilbotLogWebhookURL + " not found")
-		return
+// slackEscaper は Slack で特別な意味を持つ文字をエスケープします。
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Escape は s を Slack のメッセージにそのまま表示されるようにエスケープします。
+func Escape(s string) string {
+	return slackEscaper.Replace(s)
+}
+
+// CodeFence は s を Slack のコードブロックにします。s の中の ``` はコードブロックが
+// 途中で終わらないように崩します。
+func CodeFence(s string) string {
+	s = strings.ReplaceAll(s, "```", "`\u200b``")
+	return "```\n" + strings.TrimRight(s, "\n") + "\n```"
+}
+
+// Payload は e を Slack に送信する Payload に変換します。
+// Level ごとに色と絵文字をつけ，複数行の値はコードブロックにします。
+func (e *Entry) Payload() *Payload {
+	if e.rich != nil {
+		return e.rich
 	}
-	return
+
+	att := slack.Attachment{
+		Color:      e.Level.color(),
+		Fallback:   Escape(e.String()),
+		Text:       e.Level.emoji() + " " + Escape(e.Msg),
+		MarkdownIn: []string{"text"},
+		Ts:         json.Number(strconv.FormatInt(e.Time.Unix(), 10)),
+	}
+	for _, f := range e.Fields {
+		if strings.Contains(f.Value, "\n") {
+			att.Text += "\n*" + Escape(f.Key) + "*\n" + CodeFence(Escape(f.Value))
+			continue
+		}
+		att.Fields = append(att.Fields, slack.AttachmentField{
+			Title: Escape(f.Key),
+			Value: Escape(f.Value),
+			Short: len(f.Value) < 40,
+		})
+	}
+
+	return &Payload{Attachments: []slack.Attachment{att}}
 }
@@ -0,0 +1,127 @@
+package botlog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// weirdStrings は JSON や Slack で壊れやすい文字列です。
+var weirdStrings = []string{
+	`plain`,
+	`with "double quotes"`,
+	`back\slash and \n literal`,
+	"new\nline and\ttab\r\n",
+	`<@U12345> <!channel> <https://example.com|link>`,
+	`a & b && c`,
+	"control \x00\x01\x1f chars",
+	"invalid utf-8 \xff\xfe",
+	"```code fence```",
+	`{"text": "injected"}`,
+	"日本語 (｀･ω･´)",
+}
+
+func TestMakeWebhookRequestBody(t *testing.T) {
+	for idx, s := range weirdStrings {
+		e := NewEntry(time.Now(), LevelError, s, "error", errors.New(s))
+
+		body, err := makeWebhookRequestBody(e.Payload())
+		if err != nil {
+			t.Fatalf("[%d] %v", idx, err)
+		}
+		raw, _ := ioutil.ReadAll(body)
+		if !json.Valid(raw) {
+			t.Fatalf("[%d] invalid json: %s", idx, raw)
+		}
+
+		var p struct {
+			Attachments []slack.Attachment `json:"attachments"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			t.Fatalf("[%d] %v", idx, err)
+		}
+		if len(p.Attachments) != 1 {
+			t.Fatalf("[%d] expected 1 attachment, got %d", idx, len(p.Attachments))
+		}
+
+		text := p.Attachments[0].Text
+		if strings.ContainsAny(text, "<>") {
+			t.Errorf("[%d] unescaped control characters: %q", idx, text)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain", "plain"},
+		{"a & b", "a &amp; b"},
+		{"<@U123>", "&lt;@U123&gt;"},
+		{"&lt;", "&amp;lt;"},
+	}
+
+	for idx, test := range tests {
+		if out := Escape(test.in); out != test.out {
+			t.Errorf("[%d] expected %q, got %q", idx, test.out, out)
+		}
+	}
+}
+
+func TestPayloadCodeFence(t *testing.T) {
+	stack := "goroutine 1 [running]:\nmain.main()\n\t/app/main.go:10 +0x20\n"
+	e := NewEntry(time.Now(), LevelError, "panic", "stack", stack, "user", "alice")
+	att := e.Payload().Attachments[0]
+
+	if !strings.Contains(att.Text, "```\ngoroutine 1 [running]:") {
+		t.Errorf("stack trace is not code fenced: %q", att.Text)
+	}
+	if len(att.Fields) != 1 || att.Fields[0].Title != "user" {
+		t.Errorf("unexpected fields: %v", att.Fields)
+	}
+}
+
+func TestLogContextPostsValidJSON(t *testing.T) {
+	bodies := make(chan []byte, len(weirdStrings))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !json.Valid(body) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		bodies <- body
+	}))
+	defer ts.Close()
+
+	setRoutes([]route{{sink: NewWebhookSink(ts.URL), min: LevelDebug}})
+	defer setRoutes(nil)
+
+	for _, s := range weirdStrings {
+		Error(s, "error", s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(bodies)
+
+	n := 0
+	for body := range bodies {
+		var p Payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Fatalf("invalid json: %s", body)
+		}
+		n += len(p.Attachments)
+	}
+	if n != len(weirdStrings) {
+		t.Errorf("expected %d attachments, got %d", len(weirdStrings), n)
+	}
+}
@@ -0,0 +1,220 @@
+package botlog
+
+import (
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envMilbotLogDigestInterval は同じログをまとめて報告する間隔の環境変数です。
+const envMilbotLogDigestInterval = "MILBOT_LOG_DIGEST_INTERVAL"
+
+// envMilbotLogResolveAfter は同じログがこの時間出なければ解決したとみなす時間の環境変数です。
+const envMilbotLogResolveAfter = "MILBOT_LOG_RESOLVE_AFTER"
+
+// defaultDigestInterval は同じログをまとめて報告する間隔のデフォルト値です。
+const defaultDigestInterval = 1 * time.Hour
+
+// defaultResolveAfter は解決したとみなすまでの時間のデフォルト値です。
+const defaultResolveAfter = 30 * time.Minute
+
+// dedupTickInterval はまとめや解決を確認する間隔です。
+const dedupTickInterval = 1 * time.Minute
+
+// regexpDigits はフィンガープリントを作るときに無視する数字の並びです。
+var regexpDigits = regexp.MustCompile(`[0-9]+`)
+
+// DedupSink は LevelWarn 以上の同じログを何度も出さないようにする Sink です。
+// 最初のログはすぐに出して，そのあとの繰り返しは interval ごとに回数だけを出します。
+// resolveAfter の間出なくなったら解決したことを出します。
+type DedupSink struct {
+	inner        Sink
+	interval     time.Duration
+	resolveAfter time.Duration
+	now          func() time.Time
+
+	startOnce *sync.Once
+
+	mu     *sync.Mutex
+	states map[string]*dedupState
+}
+
+// dedupState はひとつのフィンガープリントのログの状態です。
+type dedupState struct {
+	entry      *Entry    // 最初に出たログです。
+	first      time.Time // 最初に出た時間です。
+	last       time.Time // 最後に出た時間です。
+	lastDigest time.Time // 最後にまとめを出した時間です。
+	pending    int       // まだ出していない繰り返しの回数です。
+	total      int       // 出た回数の合計です。
+}
+
+// NewDedupSink は inner に出すログの繰り返しをまとめる DedupSink を作ります。
+func NewDedupSink(inner Sink, interval, resolveAfter time.Duration) *DedupSink {
+	return &DedupSink{
+		inner:        inner,
+		interval:     interval,
+		resolveAfter: resolveAfter,
+		now:          time.Now,
+		startOnce:    new(sync.Once),
+		mu:           new(sync.Mutex),
+		states:       map[string]*dedupState{},
+	}
+}
+
+// Write は e が初めてのログなら inner に出し，繰り返しなら回数を数えます。
+func (s *DedupSink) Write(e *Entry) error {
+	if e.Level < LevelWarn {
+		return s.inner.Write(e)
+	}
+	s.startOnce.Do(func() { go s.run() })
+
+	fp := fingerprint(e)
+	now := s.now()
+
+	s.mu.Lock()
+	st, ok := s.states[fp]
+	if ok {
+		st.last = now
+		st.pending++
+		st.total++
+		s.mu.Unlock()
+		return nil
+	}
+	s.states[fp] = &dedupState{entry: e, first: now, last: now, lastDigest: now, total: 1}
+	s.mu.Unlock()
+
+	return s.inner.Write(e)
+}
+
+// Flush はまだ出していない繰り返しの回数を出してから inner を Flush します。
+func (s *DedupSink) Flush(ctx context.Context) error {
+	now := s.now()
+
+	s.mu.Lock()
+	digests := []*Entry{}
+	for _, st := range s.states {
+		if st.pending > 0 {
+			digests = append(digests, s.digestEntry(st, now))
+			st.pending, st.lastDigest = 0, now
+		}
+	}
+	s.mu.Unlock()
+
+	s.writeAll(digests)
+	return s.inner.Flush(ctx)
+}
+
+// run は定期的に tick を呼びます。
+func (s *DedupSink) run() {
+	ticker := time.NewTicker(dedupTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.tick()
+	}
+}
+
+// tick は interval が過ぎた繰り返しのまとめと，解決したログを出します。
+func (s *DedupSink) tick() {
+	now := s.now()
+	entries := []*Entry{}
+
+	s.mu.Lock()
+	for fp, st := range s.states {
+		resolved := now.Sub(st.last) >= s.resolveAfter
+		if st.pending > 0 && (resolved || now.Sub(st.lastDigest) >= s.interval) {
+			entries = append(entries, s.digestEntry(st, now))
+			st.pending, st.lastDigest = 0, now
+		}
+		if resolved {
+			// 一度きりのログは解決したことを出すまでもありません。
+			if st.total > 1 {
+				entries = append(entries, s.resolvedEntry(st, now))
+			}
+			delete(s.states, fp)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	s.writeAll(entries)
+}
+
+// digestEntry は st の繰り返しの回数のログを作ります。
+func (s *DedupSink) digestEntry(st *dedupState, now time.Time) *Entry {
+	return &Entry{
+		Time:   now,
+		Level:  st.entry.Level,
+		Msg:    "repeated x" + strconv.Itoa(st.pending) + " in last " + formatDuration(now.Sub(st.lastDigest)) + ": " + st.entry.Msg,
+		Fields: append([]Field{}, st.entry.Fields...),
+	}
+}
+
+// resolvedEntry は st が解決したことを示すログを作ります。
+func (s *DedupSink) resolvedEntry(st *dedupState, now time.Time) *Entry {
+	return &Entry{
+		Time:  now,
+		Level: LevelInfo,
+		Msg:   "resolved after " + formatDuration(st.last.Sub(st.first)) + ": " + st.entry.Msg,
+		Fields: []Field{
+			{Key: "occurrences", Value: strconv.Itoa(st.total)},
+			{Key: "first_seen", Value: st.first.Format(time.RFC3339)},
+			{Key: "last_seen", Value: st.last.Format(time.RFC3339)},
+		},
+	}
+}
+
+// writeAll は entries を inner に出します。
+func (s *DedupSink) writeAll(entries []*Entry) {
+	for _, e := range entries {
+		if err := s.inner.Write(e); err != nil {
+			log.Printf("can't write log: %v", err)
+		}
+	}
+}
+
+// fingerprint は e の Level とメッセージとフィールドから数字を除いたものです。
+func fingerprint(e *Entry) string {
+	b := new(strings.Builder)
+	b.WriteString(e.Level.String())
+	b.WriteString("\x00")
+	b.WriteString(regexpDigits.ReplaceAllString(e.Msg, "#"))
+	for _, f := range e.Fields {
+		b.WriteString("\x00")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		b.WriteString(regexpDigits.ReplaceAllString(f.Value, "#"))
+	}
+	return b.String()
+}
+
+// formatDuration は d を分単位に丸めて文字列にします。1 分未満は秒単位です。
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
+
+// newDedupSinkFromEnv は環境変数の設定で inner の繰り返しをまとめる DedupSink を作ります。
+func newDedupSinkFromEnv(inner Sink) *DedupSink {
+	return NewDedupSink(inner,
+		durationFromEnv(envMilbotLogDigestInterval, defaultDigestInterval),
+		durationFromEnv(envMilbotLogResolveAfter, defaultResolveAfter))
+}
+
+// durationFromEnv は環境変数 key の時間を返します。なかったりおかしかったりしたら def を返します。
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
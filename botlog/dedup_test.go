@@ -0,0 +1,124 @@
+package botlog
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// recordSink は受け取ったログを覚えておく Sink です。
+type recordSink struct {
+	entries []*Entry
+}
+
+func (s *recordSink) Write(e *Entry) error {
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *recordSink) Flush(_ context.Context) error {
+	return nil
+}
+
+func TestDedupSink(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type step struct {
+		at   time.Duration // base からの時間です。
+		log  *Entry        // nil なら tick します。
+		msgs []string      // この step で出るログのメッセージです。
+	}
+
+	tests := []struct {
+		steps []step
+	}{
+		{
+			// 繰り返しは interval ごとにまとめて，静かになったら解決したことを出します。
+			[]step{
+				{0, NewEntry(base, LevelError, "search failed", "error", "exit status 1"), []string{"search failed"}},
+				{20 * time.Minute, NewEntry(base, LevelError, "search failed", "error", "exit status 2"), nil},
+				{30 * time.Minute, nil, nil},
+				{40 * time.Minute, NewEntry(base, LevelError, "search failed", "error", "exit status 3"), nil},
+				{60 * time.Minute, nil, []string{"repeated x2 in last 1h0m: search failed"}},
+				{70 * time.Minute, NewEntry(base, LevelError, "search failed", "error", "exit status 4"), nil},
+				{80 * time.Minute, nil, nil},
+				{100 * time.Minute, nil, []string{"repeated x1 in last 40m: search failed", "resolved after 1h10m: search failed"}},
+				{110 * time.Minute, NewEntry(base, LevelError, "search failed", "error", "exit status 5"), []string{"search failed"}},
+			},
+		},
+		{
+			// 一度きりのログは解決したことを出しません。
+			[]step{
+				{0, NewEntry(base, LevelError, "plugin serve failed"), []string{"plugin serve failed"}},
+				{30 * time.Minute, nil, nil},
+				{40 * time.Minute, NewEntry(base, LevelError, "plugin serve failed"), []string{"plugin serve failed"}},
+			},
+		},
+		{
+			// LevelWarn 未満と違うログはまとめません。
+			[]step{
+				{0, NewEntry(base, LevelInfo, "hello"), []string{"hello"}},
+				{1 * time.Minute, NewEntry(base, LevelInfo, "hello"), []string{"hello"}},
+				{2 * time.Minute, NewEntry(base, LevelWarn, "a"), []string{"a"}},
+				{3 * time.Minute, NewEntry(base, LevelWarn, "b"), []string{"b"}},
+				{4 * time.Minute, NewEntry(base, LevelError, "a"), []string{"a"}},
+			},
+		},
+	}
+
+	for idx, test := range tests {
+		rec := new(recordSink)
+		s := NewDedupSink(rec, time.Hour, 30*time.Minute)
+		s.startOnce.Do(func() {})
+
+		for i, st := range test.steps {
+			now := base.Add(st.at)
+			s.now = func() time.Time { return now }
+
+			rec.entries = nil
+			if st.log != nil {
+				if err := s.Write(st.log); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				s.tick()
+			}
+
+			msgs := []string{}
+			for _, e := range rec.entries {
+				msgs = append(msgs, e.Msg)
+			}
+			if len(msgs) != len(st.msgs) {
+				t.Errorf("[%d][%d] expected %q, got %q", idx, i, st.msgs, msgs)
+				continue
+			}
+			for j := range msgs {
+				if msgs[j] != st.msgs[j] {
+					t.Errorf("[%d][%d] expected %q, got %q", idx, i, st.msgs, msgs)
+				}
+			}
+		}
+	}
+}
+
+func TestDedupSinkFlush(t *testing.T) {
+	rec := new(recordSink)
+	s := NewDedupSink(rec, time.Hour, 30*time.Minute)
+	s.startOnce.Do(func() {})
+
+	for i := 0; i < 5; i++ {
+		if err := s.Write(NewEntry(time.Now(), LevelWarn, "bluetooth down")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(rec.entries))
+	}
+	if msg := rec.entries[1].Msg; msg != "repeated x4 in last 0s: bluetooth down" {
+		t.Errorf("unexpected digest: %q", msg)
+	}
+}
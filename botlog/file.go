@@ -0,0 +1,129 @@
+package botlog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// envMilbotLogFile はログを書き出すファイルのパスの環境変数です。
+// 指定されていない場合はデータディレクトリの defaultLogFileName に書き出します。
+const envMilbotLogFile = "MILBOT_LOG_FILE"
+
+// defaultLogFileName はログを書き出すファイルの名前のデフォルト値です。
+const defaultLogFileName = "milbot.log"
+
+// logFilePerm はログファイルのパーミッションです。
+const logFilePerm = 0600
+
+// defaultMaxFileBytes はログファイルをローテートする大きさのデフォルト値です。
+const defaultMaxFileBytes = 5 * 1024 * 1024
+
+// defaultFileBackups はローテートしたログファイルを残しておく数のデフォルト値です。
+const defaultFileBackups = 3
+
+// FileSink はファイルにログを書き出す Sink です。
+// ファイルが maxBytes を超えると path.1, path.2, ... にローテートします。
+type FileSink struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   *sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewFileSink は path に書き出す FileSink を作ります。
+func NewFileSink(path string, maxBytes int64, backups int) *FileSink {
+	return &FileSink{
+		path:     path,
+		maxBytes: maxBytes,
+		backups:  backups,
+		mu:       new(sync.Mutex),
+	}
+}
+
+// Write は e をファイルに 1 行で書き出します。
+func (s *FileSink) Write(e *Entry) error {
+	line := e.Time.Format(time.RFC3339) + " " + e.String() + "\n"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return fmt.Errorf("write log file failed: %w", err)
+	}
+	if s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("write log file failed: %w", err)
+		}
+	}
+
+	n, err := s.f.WriteString(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write log file failed: %w", err)
+	}
+	return nil
+}
+
+// Flush はファイルをディスクに書き出します。
+func (s *FileSink) Flush(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("flush log file failed: %w", err)
+	}
+	return nil
+}
+
+// open は必要であればファイルを開きます。
+func (s *FileSink) open() error {
+	if s.f != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, logFilePerm)
+	if err != nil {
+		return fmt.Errorf("open log file failed: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open log file failed: %w", err)
+	}
+
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+// rotate は今のファイルを path.1 にして，新しいファイルを開きます。
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return fmt.Errorf("rotate log file failed: %w", err)
+	}
+	s.f = nil
+
+	for i := s.backups - 1; i >= 1; i-- {
+		from, to := fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate log file failed: %w", err)
+		}
+	}
+	if s.backups > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("rotate log file failed: %w", err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("rotate log file failed: %w", err)
+	}
+
+	return s.open()
+}
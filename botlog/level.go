@@ -0,0 +1,79 @@
+package botlog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level はログの重要度です。
+type Level int
+
+const (
+	// LevelDebug はデバッグ用の細かいログです。
+	LevelDebug Level = iota
+
+	// LevelInfo は起動や終了などの普段のログです。
+	LevelInfo
+
+	// LevelWarn は気にしておいたほうがいいログです。
+	LevelWarn
+
+	// LevelError はエラーのログです。
+	LevelError
+)
+
+// String です。
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// emoji は #milbot_log に投稿するときに先頭につける絵文字です。
+func (l Level) emoji() string {
+	switch l {
+	case LevelDebug:
+		return ":mag:"
+	case LevelInfo:
+		return ":information_source:"
+	case LevelWarn:
+		return ":warning:"
+	}
+	return ":rotating_light:"
+}
+
+// color は #milbot_log に投稿するときの attachment の色です。
+func (l Level) color() string {
+	switch l {
+	case LevelDebug:
+		return "#a0a0a0"
+	case LevelInfo:
+		return "good"
+	case LevelWarn:
+		return "warning"
+	}
+	return "danger"
+}
+
+// ParseLevel は "debug", "info", "warn", "error" を Level に変換します。
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("invalid log level: %q", s)
+}
@@ -0,0 +1,252 @@
+package botlog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// batchWindow はログをまとめて送信するために待つ時間です。
+const batchWindow = 500 * time.Millisecond
+
+// maxQueue は送信待ちにしておけるログの最大数です。
+// これを超えると古いものから捨てます。
+const maxQueue = 256
+
+// maxBatch は一度の送信にまとめるログの最大数です。
+const maxBatch = 20
+
+// postTimeout は一度の送信のタイムアウト時間です。
+const postTimeout = 10 * time.Second
+
+// spoolRetryInterval はスプールにログがあるときに送信を試みる間隔です。
+const spoolRetryInterval = 1 * time.Minute
+
+// postFunc は Payload を送信する関数です。
+type postFunc func(ctx context.Context, p *Payload) error
+
+// sender はバックグラウンドでログをまとめて送信します。
+type sender struct {
+	window   time.Duration
+	maxQueue int
+	post     postFunc
+
+	startOnce *sync.Once
+
+	// spool は送信に失敗したログをためておく場所です。nil のときは捨てます。
+	spool *spool
+
+	mu      *sync.Mutex
+	queue   []*queued
+	dropped int
+
+	wake     chan struct{}
+	flushReq chan chan struct{}
+}
+
+// newSender は post で送信する sender を作ります。
+func newSender(window time.Duration, maxQueue int, post postFunc) *sender {
+	return &sender{
+		window:    window,
+		maxQueue:  maxQueue,
+		post:      post,
+		startOnce: new(sync.Once),
+		mu:        new(sync.Mutex),
+		wake:      make(chan struct{}, 1),
+		flushReq:  make(chan chan struct{}),
+	}
+}
+
+// queued は送信待ちのログです。
+type queued struct {
+	time    time.Time
+	payload *Payload
+}
+
+// enqueue は p を送信待ちにします。キューがいっぱいのときは一番古いものを捨てます。
+func (s *sender) enqueue(p *Payload) {
+	s.startOnce.Do(func() { go s.run() })
+
+	s.mu.Lock()
+	if len(s.queue) >= s.maxQueue {
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.queue = append(s.queue, &queued{time: time.Now(), payload: p})
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run はログが来るのを待って送信します。ログが来てから window だけ待って，
+// その間に来たログをまとめて送信します。スプールがあれば定期的に送信し直します。
+func (s *sender) run() {
+	var retry <-chan time.Time
+	if s.spool != nil {
+		ticker := time.NewTicker(spoolRetryInterval)
+		defer ticker.Stop()
+		retry = ticker.C
+	}
+
+	for {
+		var done chan struct{}
+
+		select {
+		case <-retry:
+		case <-s.wake:
+			timer := time.NewTimer(s.window)
+			select {
+			case <-timer.C:
+			case done = <-s.flushReq:
+				timer.Stop()
+			}
+		case done = <-s.flushReq:
+		}
+
+		s.sendAll()
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+// sendAll は送信待ちのログをすべて送信します。スプールにログがあれば先に送信して，
+// それに失敗したときは順番を守るために新しいログもスプールにためます。
+func (s *sender) sendAll() {
+	online := s.replaySpool()
+
+	for {
+		batch, dropped := s.take()
+		if len(batch) == 0 && dropped == 0 {
+			return
+		}
+
+		payloads := []*Payload{}
+		for _, q := range batch {
+			payloads = append(payloads, q.payload)
+		}
+		p := mergePayloads(payloads, dropped)
+
+		t := time.Now()
+		if len(batch) > 0 {
+			t = batch[0].time
+		}
+
+		if !online {
+			s.pushSpool(t, p)
+			continue
+		}
+		if err := s.postWithTimeout(p); err != nil {
+			log.Printf("can't send log: %v", err)
+			s.pushSpool(t, p)
+			online = false
+		}
+	}
+}
+
+// postWithTimeout は postTimeout の期限つきで p を送信します。
+func (s *sender) postWithTimeout(p *Payload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postTimeout)
+	defer cancel()
+	return s.post(ctx, p)
+}
+
+// replaySpool はスプールのログを遅れて送信したことがわかるようにして送信します。
+// スプールが空になったら true を返します。
+func (s *sender) replaySpool() bool {
+	if s.spool == nil || s.spool.empty() {
+		return true
+	}
+
+	err := s.spool.replay(func(r *spoolRecord) error {
+		return s.postWithTimeout(r.delayedPayload())
+	})
+	if err != nil {
+		log.Printf("can't send spooled log: %v", err)
+		return false
+	}
+	return true
+}
+
+// pushSpool は t に出たログ p をスプールにためます。スプールがなければ捨てます。
+func (s *sender) pushSpool(t time.Time, p *Payload) {
+	if s.spool == nil {
+		return
+	}
+	if err := s.spool.push(newSpoolRecord(t, p)); err != nil {
+		log.Printf("can't spool log: %v", err)
+	}
+}
+
+// take は送信待ちのログを最大 maxBatch 個と，捨てたログの数を取り出します。
+func (s *sender) take() (batch []*queued, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.queue)
+	if n > maxBatch {
+		n = maxBatch
+	}
+	batch = s.queue[:n]
+	s.queue = s.queue[n:]
+
+	dropped = s.dropped
+	s.dropped = 0
+	return
+}
+
+// flush は送信待ちのログをすぐに送信して，終わるまで待ちます。
+func (s *sender) flush(ctx context.Context) error {
+	done := make(chan struct{})
+
+	s.startOnce.Do(func() { go s.run() })
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("flush failed: %w", ctx.Err())
+	case s.flushReq <- done:
+	}
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("flush failed: %w", ctx.Err())
+	case <-done:
+		return nil
+	}
+}
+
+// mergePayloads は batch をひとつの Payload にまとめます。dropped が 0 でなければ
+// ログを捨てたことを先頭に書きます。
+func mergePayloads(batch []*Payload, dropped int) *Payload {
+	res := new(Payload)
+	texts := []string{}
+
+	if dropped > 0 {
+		texts = append(texts, fmt.Sprintf("%s 送信が追いつかなかったので %d 件のログを捨てました",
+			LevelWarn.emoji(), dropped))
+	}
+
+	for _, p := range batch {
+		if p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+		res.Blocks = append(res.Blocks, p.Blocks...)
+		res.Attachments = append(res.Attachments, p.Attachments...)
+	}
+
+	res.Text = strings.Join(texts, "\n")
+
+	// Blocks があると Text は通知にしか使われないので，Text もブロックにします。
+	if len(res.Blocks) > 0 && res.Text != "" {
+		section := slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, res.Text, false, false), nil, nil)
+		res.Blocks = append([]slack.Block{section}, res.Blocks...)
+	}
+	return res
+}
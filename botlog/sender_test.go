@@ -0,0 +1,87 @@
+package botlog
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder は送信された Payload を記録します。
+type recorder struct {
+	mu       sync.Mutex
+	payloads []*Payload
+	block    chan struct{}
+}
+
+func (r *recorder) post(_ context.Context, p *Payload) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payloads = append(r.payloads, p)
+	return nil
+}
+
+func TestSenderCoalesce(t *testing.T) {
+	r := new(recorder)
+	s := newSender(50*time.Millisecond, 100, r.post)
+
+	for i := 0; i < 5; i++ {
+		s.enqueue(&Payload{Text: "msg"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.payloads) != 1 {
+		t.Fatalf("expected 1 post, got %d", len(r.payloads))
+	}
+	if n := strings.Count(r.payloads[0].Text, "msg"); n != 5 {
+		t.Errorf("expected 5 messages in one post, got %d", n)
+	}
+}
+
+func TestSenderDropOldest(t *testing.T) {
+	r := new(recorder)
+	s := newSender(time.Hour, 3, r.post)
+
+	for _, text := range []string{"a", "b", "c", "d", "e"} {
+		s.enqueue(&Payload{Text: text})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.payloads) != 1 {
+		t.Fatalf("expected 1 post, got %d", len(r.payloads))
+	}
+	lines := strings.Split(r.payloads[0].Text, "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], "2 件のログを捨てました") {
+		t.Fatalf("unexpected text: %q", r.payloads[0].Text)
+	}
+	if strings.Join(lines[1:], ",") != "c,d,e" {
+		t.Errorf("oldest messages should be dropped: %q", lines[1:])
+	}
+}
+
+func TestSenderFlushTimeout(t *testing.T) {
+	r := &recorder{block: make(chan struct{})}
+	defer close(r.block)
+	s := newSender(time.Millisecond, 10, r.post)
+	s.enqueue(&Payload{Text: "stuck"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.flush(ctx); err == nil {
+		t.Error("expected timeout error")
+	}
+}
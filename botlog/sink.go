@@ -0,0 +1,242 @@
+package botlog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/high-moctane/milbot/botdata"
+)
+
+// envMilbotLogSinks はログの出力先と，それぞれに出力する最低の Level の環境変数です。
+// "stderr=debug,file=debug,webhook=info,slack=warn" のように指定します。
+// 指定されていない場合は標準エラー出力とファイルにすべてのログを出し，
+// MILBOT_LOG_WEBHOOK_URL があれば MILBOT_LOG_LEVEL 以上のログを Webhook に送信します。
+const envMilbotLogSinks = "MILBOT_LOG_SINKS"
+
+// envMilbotLogLevel は Webhook に送信するログの最低の Level の環境変数です。
+// MILBOT_LOG_SINKS が指定されていないときだけ使われます。
+const envMilbotLogLevel = "MILBOT_LOG_LEVEL"
+
+// envMilbotLogFileMaxBytes はログファイルをローテートする大きさの環境変数です。
+const envMilbotLogFileMaxBytes = "MILBOT_LOG_FILE_MAX_BYTES"
+
+// defaultWebhookLevel は Webhook に送信するログの最低の Level のデフォルト値です。
+const defaultWebhookLevel = LevelInfo
+
+// Sink はログの出力先です。
+// Write はすぐに返ってください。時間のかかる出力はバックグラウンドで行い，
+// Flush で終わるのを待てるようにしてください。
+type Sink interface {
+	Write(e *Entry) error
+	Flush(ctx context.Context) error
+}
+
+// StderrSink は標準エラー出力にログを出す Sink です。
+type StderrSink struct{}
+
+// Write は e を標準エラー出力に 1 行で出します。
+func (StderrSink) Write(e *Entry) error {
+	log.Print(e.String())
+	return nil
+}
+
+// Flush はとくに何もしません。
+func (StderrSink) Flush(_ context.Context) error {
+	return nil
+}
+
+// route は Sink とそれに出力する最低の Level の組です。
+type route struct {
+	sink Sink
+	min  Level
+}
+
+// muRoutes は routes を守ります。
+var muRoutes = new(sync.RWMutex)
+
+// routes はログの出力先です。nil のときは最初のログで環境変数から設定します。
+var routes []route
+
+// AddSink は sink を min 以上のログの出力先に加えます。
+func AddSink(sink Sink, min Level) {
+	muRoutes.Lock()
+	defer muRoutes.Unlock()
+
+	if routes == nil {
+		routes = routesFromEnv()
+	}
+	// 読んでいる側と配列を共有しないように作りなおします。
+	rs := make([]route, 0, len(routes)+1)
+	rs = append(rs, routes...)
+	routes = append(rs, route{sink: sink, min: min})
+}
+
+// setRoutes は出力先を rs に置き換えます。
+func setRoutes(rs []route) {
+	muRoutes.Lock()
+	defer muRoutes.Unlock()
+
+	routes = rs
+}
+
+// currentRoutes は今の出力先を返します。まだ設定されていなければ環境変数から設定します。
+func currentRoutes() []route {
+	muRoutes.RLock()
+	rs := routes
+	muRoutes.RUnlock()
+	if rs != nil {
+		return rs
+	}
+
+	muRoutes.Lock()
+	defer muRoutes.Unlock()
+
+	if routes == nil {
+		routes = routesFromEnv()
+	}
+	return routes
+}
+
+// dispatch は e をその Level を受け取る出力先すべてに出します。
+func dispatch(e *Entry) {
+	for _, r := range currentRoutes() {
+		if e.Level < r.min {
+			continue
+		}
+		if err := r.sink.Write(e); err != nil {
+			log.Printf("can't write log: %v", err)
+		}
+	}
+}
+
+// Flush は出力待ちのログをすべて出力し終わるまで待ちます。終了する前に呼んでください。
+func Flush(ctx context.Context) error {
+	errs := []string{}
+	for _, r := range currentRoutes() {
+		if err := r.sink.Flush(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("flush log failed: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// routesFromEnv は環境変数から出力先を作ります。設定のおかしなところは
+// 標準エラー出力に出して無視します。
+func routesFromEnv() []route {
+	spec, ok := os.LookupEnv(envMilbotLogSinks)
+	if !ok {
+		spec = defaultSinkSpec()
+	}
+
+	rs := []route{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, levelName := item, "debug"
+		if i := strings.Index(item, "="); i >= 0 {
+			name, levelName = item[:i], item[i+1:]
+		}
+		min, err := ParseLevel(levelName)
+		if err != nil {
+			log.Printf("invalid %s: %v", envMilbotLogSinks, err)
+			continue
+		}
+
+		sink, err := newSinkFromEnv(strings.TrimSpace(name))
+		if err != nil {
+			log.Printf("invalid %s: %v", envMilbotLogSinks, err)
+			continue
+		}
+		rs = append(rs, route{sink: sink, min: min})
+	}
+
+	return rs
+}
+
+// defaultSinkSpec は MILBOT_LOG_SINKS が指定されていないときの設定です。
+func defaultSinkSpec() string {
+	spec := "stderr=debug,file=debug"
+
+	if _, ok := os.LookupEnv(envMilbotLogWebhookURL); ok {
+		level := defaultWebhookLevel
+		if s, ok := os.LookupEnv(envMilbotLogLevel); ok {
+			if l, err := ParseLevel(s); err == nil {
+				level = l
+			}
+		}
+		spec += ",webhook=" + strings.ToLower(level.String())
+	}
+
+	return spec
+}
+
+// newSinkFromEnv は name の Sink を環境変数の設定で作ります。
+func newSinkFromEnv(name string) (Sink, error) {
+	switch name {
+	case "stderr":
+		return StderrSink{}, nil
+
+	case "file":
+		path, ok := os.LookupEnv(envMilbotLogFile)
+		if !ok {
+			var err error
+			path, err = botdata.Path(defaultLogFileName)
+			if err != nil {
+				return nil, fmt.Errorf("cannot create file sink: %w", err)
+			}
+		}
+		maxBytes, err := strconv.ParseInt(os.Getenv(envMilbotLogFileMaxBytes), 10, 64)
+		if err != nil || maxBytes <= 0 {
+			maxBytes = defaultMaxFileBytes
+		}
+		return NewFileSink(path, maxBytes, defaultFileBackups), nil
+
+	case "webhook":
+		url, ok := os.LookupEnv(envMilbotLogWebhookURL)
+		if !ok {
+			return nil, fmt.Errorf("cannot create webhook sink: %s not found", envMilbotLogWebhookURL)
+		}
+		sink := NewWebhookSink(url)
+		enableSpoolFromEnv(sink, name)
+		return newDedupSinkFromEnv(sink), nil
+
+	case "slack":
+		channel, ok := os.LookupEnv(envMilbotLogChannel)
+		if !ok {
+			channel = defaultLogChannel
+		}
+		sink := NewSlackSink(channel)
+		enableSpoolFromEnv(sink, name)
+		return newDedupSinkFromEnv(sink), nil
+	}
+
+	return nil, fmt.Errorf("unknown sink: %q", name)
+}
+
+// spooler はスプールを使える Sink です。
+type spooler interface {
+	EnableSpool(path string)
+}
+
+// enableSpoolFromEnv はデータディレクトリに name のスプールを作って sink で使います。
+// データディレクトリが使えないときはスプールを使いません。
+func enableSpoolFromEnv(sink spooler, name string) {
+	path, err := botdata.Path("botlog_spool_" + name + ".jsonl")
+	if err != nil {
+		log.Printf("can't enable log spool: %v", err)
+		return
+	}
+	sink.EnableSpool(path)
+}
@@ -0,0 +1,116 @@
+package botlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "milbot.log")
+	s := NewFileSink(path, 100, 2)
+	for i := 0; i < 10; i++ {
+		if err := s.Write(NewEntry(time.Now(), LevelInfo, "a line long enough to rotate")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 100 {
+			t.Errorf("%s is too large: %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("too many backups: %v", err)
+	}
+}
+
+func TestRoutesFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv(envMilbotLogFile, filepath.Join(dir, "milbot.log"))
+	defer os.Unsetenv(envMilbotLogFile)
+	os.Unsetenv(envMilbotLogWebhookURL)
+
+	tests := []struct {
+		spec  string
+		sinks []string
+		mins  []Level
+	}{
+		{"stderr=debug,file=warn", []string{"StderrSink", "FileSink"}, []Level{LevelDebug, LevelWarn}},
+		{"stderr, slack=error", []string{"StderrSink", "SlackSink"}, []Level{LevelDebug, LevelError}},
+		{"webhook=info,stderr=info", []string{"StderrSink"}, []Level{LevelInfo}},
+		{"unknown=info,file=bogus", []string{}, []Level{}},
+	}
+
+	for idx, test := range tests {
+		os.Setenv(envMilbotLogSinks, test.spec)
+		rs := routesFromEnv()
+
+		if len(rs) != len(test.sinks) {
+			t.Errorf("[%d] expected %d sinks, got %d", idx, len(test.sinks), len(rs))
+			continue
+		}
+		for i, r := range rs {
+			if name := sinkTypeName(r.sink); name != test.sinks[i] || r.min != test.mins[i] {
+				t.Errorf("[%d] expected %s>=%s, got %s>=%s", idx, test.sinks[i], test.mins[i], name, r.min)
+			}
+		}
+	}
+	os.Unsetenv(envMilbotLogSinks)
+}
+
+// sinkTypeName は Sink の型の名前を返します。
+func sinkTypeName(s Sink) string {
+	if d, ok := s.(*DedupSink); ok {
+		s = d.inner
+	}
+	switch s.(type) {
+	case StderrSink:
+		return "StderrSink"
+	case *FileSink:
+		return "FileSink"
+	case *WebhookSink:
+		return "WebhookSink"
+	case *SlackSink:
+		return "SlackSink"
+	}
+	return "unknown"
+}
+
+func TestAddSinkConcurrent(t *testing.T) {
+	setRoutes([]route{})
+	defer setRoutes(nil)
+
+	const n = 50
+	wg := new(sync.WaitGroup)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			AddSink(StderrSink{}, LevelError)
+		}()
+	}
+	wg.Wait()
+
+	if rs := currentRoutes(); len(rs) != n {
+		t.Errorf("expected %d routes, got %d", n, len(rs))
+	}
+}
@@ -0,0 +1,90 @@
+package botlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/slack-go/slack"
+)
+
+// envMilbotLogChannel は bot 自身のクライアントでログを送信するチャンネルの環境変数です。
+const envMilbotLogChannel = "MILBOT_LOG_CHANNEL"
+
+// defaultLogChannel はログを送信するチャンネルのデフォルト値です。
+const defaultLogChannel = "#milbot_log"
+
+// errSlackClientNotReady はまだ bot のクライアントがないことを示すエラーです。
+var errSlackClientNotReady = errors.New("slack client not ready")
+
+// muSlackClient は slackClient を守ります。
+var muSlackClient = new(sync.RWMutex)
+
+// slackClient は SlackSink が使う bot のクライアントです。
+var slackClient *botclient.Client
+
+// SetSlackClient は SlackSink が送信に使う bot のクライアントを設定します。
+// 設定されるまでの SlackSink のログは送信に失敗します。
+func SetSlackClient(client *botclient.Client) {
+	muSlackClient.Lock()
+	defer muSlackClient.Unlock()
+
+	slackClient = client
+}
+
+// SlackSink は bot 自身のクライアントでチャンネルにログを送信する Sink です。
+// 送信はバックグラウンドでまとめて行われます。
+type SlackSink struct {
+	channel string
+	sender  *sender
+}
+
+// NewSlackSink は channel に送信する SlackSink を作ります。
+func NewSlackSink(channel string) *SlackSink {
+	s := &SlackSink{channel: channel}
+	s.sender = newSender(batchWindow, maxQueue, s.post)
+	return s
+}
+
+// EnableSpool は送信に失敗したログを path にためて，送信できるようになったら
+// 送信し直すようにします。最初の Write の前に呼んでください。
+func (s *SlackSink) EnableSpool(path string) {
+	s.sender.spool = newSpool(path, maxSpool)
+}
+
+// Write は e を送信待ちにします。
+func (s *SlackSink) Write(e *Entry) error {
+	s.sender.enqueue(e.Payload())
+	return nil
+}
+
+// Flush は送信待ちのログを送信し終わるまで待ちます。
+func (s *SlackSink) Flush(ctx context.Context) error {
+	return s.sender.flush(ctx)
+}
+
+// post は p を s.channel に送信します。
+func (s *SlackSink) post(ctx context.Context, p *Payload) error {
+	muSlackClient.RLock()
+	client := slackClient
+	muSlackClient.RUnlock()
+
+	if client == nil {
+		return fmt.Errorf("post to %s failed: %w", s.channel, errSlackClientNotReady)
+	}
+
+	opts := []slack.MsgOption{slack.MsgOptionText(p.Text, false)}
+	if len(p.Blocks) > 0 {
+		opts = append(opts, slack.MsgOptionBlocks(p.Blocks...))
+	}
+	if len(p.Attachments) > 0 {
+		opts = append(opts, slack.MsgOptionAttachments(p.Attachments...))
+	}
+
+	if _, _, _, err := client.SendMessageContext(ctx, s.channel, opts...); err != nil {
+		return fmt.Errorf("post to %s failed: %w", s.channel, err)
+	}
+	return nil
+}
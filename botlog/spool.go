@@ -0,0 +1,178 @@
+package botlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/slack-go/slack"
+)
+
+// spoolPerm はスプールのファイルのパーミッションです。
+const spoolPerm = 0600
+
+// maxSpool はスプールにためておけるログの最大数です。
+// これを超えると古いものから捨てます。
+const maxSpool = 500
+
+// spoolRecord は送信に失敗してスプールにためたログです。
+type spoolRecord struct {
+	Time        time.Time          `json:"time"`
+	Text        string             `json:"text,omitempty"`
+	Blocks      slack.Blocks       `json:"blocks"`
+	Attachments []slack.Attachment `json:"attachments,omitempty"`
+}
+
+// newSpoolRecord は t に出たログ p の spoolRecord を作ります。
+func newSpoolRecord(t time.Time, p *Payload) *spoolRecord {
+	return &spoolRecord{
+		Time:        t,
+		Text:        p.Text,
+		Blocks:      slack.Blocks{BlockSet: p.Blocks},
+		Attachments: p.Attachments,
+	}
+}
+
+// delayedPayload は r を遅れて送信したことがわかる Payload にします。
+// attachment の時刻はもとのままです。
+func (r *spoolRecord) delayedPayload() *Payload {
+	note := fmt.Sprintf(":hourglass: 送信できなかったログです (元の時刻 %s)",
+		r.Time.Format("2006-01-02 15:04:05"))
+
+	p := &Payload{
+		Text:        note,
+		Blocks:      r.Blocks.BlockSet,
+		Attachments: r.Attachments,
+	}
+	if r.Text != "" {
+		p.Text += "\n" + r.Text
+	}
+	if len(p.Blocks) > 0 {
+		section := slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, p.Text, false, false), nil, nil)
+		p.Blocks = append([]slack.Block{section}, p.Blocks...)
+	}
+	return p
+}
+
+// spool は送信に失敗したログをためておくファイルです。
+type spool struct {
+	path string
+	max  int
+	mu   *sync.Mutex
+}
+
+// newSpool は path にログをためる spool を作ります。
+func newSpool(path string, max int) *spool {
+	return &spool{path: path, max: max, mu: new(sync.Mutex)}
+}
+
+// push は r をスプールの最後に加えます。max を超えたら古いものを捨てます。
+func (s *spool) push(r *spoolRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return fmt.Errorf("push spool failed: %w", err)
+	}
+
+	records = append(records, r)
+	if len(records) > s.max {
+		records = records[len(records)-s.max:]
+	}
+
+	if err := s.write(records); err != nil {
+		return fmt.Errorf("push spool failed: %w", err)
+	}
+	return nil
+}
+
+// replay はスプールのログを古い順に send します。send が失敗したらそこでやめて，
+// 送信できなかったログをスプールに残します。
+func (s *spool) replay(send func(r *spoolRecord) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return fmt.Errorf("replay spool failed: %w", err)
+	}
+
+	for i, r := range records {
+		if err := send(r); err != nil {
+			if werr := s.write(records[i:]); werr != nil {
+				return fmt.Errorf("replay spool failed: %w", werr)
+			}
+			return fmt.Errorf("replay spool failed: %w", err)
+		}
+	}
+
+	if err := s.write(nil); err != nil {
+		return fmt.Errorf("replay spool failed: %w", err)
+	}
+	return nil
+}
+
+// empty はスプールが空かどうかを返します。
+func (s *spool) empty() bool {
+	info, err := os.Stat(s.path)
+	return err != nil || info.Size() == 0
+}
+
+// load はスプールのログをすべて読みます。壊れた行は読み飛ばします。
+func (s *spool) load() ([]*spoolRecord, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return []*spoolRecord{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load spool failed: %w", err)
+	}
+
+	res := []*spoolRecord{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		r := new(spoolRecord)
+		if err := json.Unmarshal(sc.Bytes(), r); err != nil {
+			continue
+		}
+		res = append(res, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("load spool failed: %w", err)
+	}
+
+	return res, nil
+}
+
+// write はスプールを records で置き換えます。空ならファイルを消します。
+// 書いている途中で電源が切れても前のスプールが残るように，一時ファイルに書いてから置き換えます。
+func (s *spool) write(records []*spoolRecord) error {
+	if len(records) == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("write spool failed: %w", err)
+		}
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("write spool failed: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if err := botdata.WriteFileAtomic(s.path, buf.Bytes(), spoolPerm); err != nil {
+		return fmt.Errorf("write spool failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package botlog
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyPoster は online が false の間は送信に失敗します。
+type flakyPoster struct {
+	mu     sync.Mutex
+	online bool
+	texts  []string
+}
+
+func (f *flakyPoster) post(_ context.Context, p *Payload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.online {
+		return errors.New("network is unreachable")
+	}
+	f.texts = append(f.texts, p.Text)
+	return nil
+}
+
+func TestSenderSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := new(flakyPoster)
+	s := newSender(time.Millisecond, 100, f.post)
+	s.spool = newSpool(filepath.Join(dir, "spool.jsonl"), 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s.enqueue(&Payload{Text: "milbot launch"})
+	if err := s.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.enqueue(&Payload{Text: "early error"})
+	if err := s.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.spool.empty() {
+		t.Fatal("failed logs should be spooled")
+	}
+
+	f.online = true
+	s.enqueue(&Payload{Text: "back online"})
+	if err := s.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.texts) != 3 {
+		t.Fatalf("expected 3 posts, got %q", f.texts)
+	}
+	for i, want := range []string{"milbot launch", "early error"} {
+		if !strings.Contains(f.texts[i], "送信できなかったログです") || !strings.HasSuffix(f.texts[i], want) {
+			t.Errorf("[%d] expected delayed %q, got %q", i, want, f.texts[i])
+		}
+	}
+	if f.texts[2] != "back online" {
+		t.Errorf("expected new log after spooled ones, got %q", f.texts[2])
+	}
+	if !s.spool.empty() {
+		t.Error("spool should be empty after replay")
+	}
+}
+
+func TestSpoolCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp := newSpool(filepath.Join(dir, "spool.jsonl"), 3)
+	for _, text := range []string{"a", "b", "c", "d", "e"} {
+		if err := sp.push(newSpoolRecord(time.Now(), &Payload{Text: text})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := sp.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{}
+	for _, r := range records {
+		texts = append(texts, r.Text)
+	}
+	if strings.Join(texts, ",") != "c,d,e" {
+		t.Errorf("expected the newest 3 records, got %v", texts)
+	}
+}
+
+func TestSpoolRecordTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	orig := time.Date(2020, 4, 1, 9, 30, 0, 0, time.Local)
+	sp := newSpool(filepath.Join(dir, "spool.jsonl"), 10)
+	e := NewEntry(orig, LevelError, "boom", "error", "no route to host")
+	if err := sp.push(newSpoolRecord(orig, e.Payload())); err != nil {
+		t.Fatal(err)
+	}
+
+	err = sp.replay(func(r *spoolRecord) error {
+		p := r.delayedPayload()
+		if !strings.Contains(p.Text, "2020-04-01 09:30:00") {
+			t.Errorf("original time is missing: %q", p.Text)
+		}
+		if len(p.Attachments) != 1 || p.Attachments[0].Ts.String() != strconv.FormatInt(orig.Unix(), 10) {
+			t.Errorf("attachment is not restored: %v", p.Attachments)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
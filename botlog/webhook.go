@@ -0,0 +1,85 @@
+package botlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// envMilbotLogWebhookURL は #milbot_log に送信するための Webhook URL の
+// 環境変数です。
+const envMilbotLogWebhookURL = "MILBOT_LOG_WEBHOOK_URL"
+
+// httpClient は Webhook に送信するための HTTP クライアントです。
+var httpClient = &http.Client{Timeout: postTimeout}
+
+// WebhookSink は Slack の Incoming Webhook にログを送信する Sink です。
+// 送信はバックグラウンドでまとめて行われます。
+type WebhookSink struct {
+	url    string
+	sender *sender
+}
+
+// NewWebhookSink は url の Webhook に送信する WebhookSink を作ります。
+func NewWebhookSink(url string) *WebhookSink {
+	s := &WebhookSink{url: url}
+	s.sender = newSender(batchWindow, maxQueue, s.post)
+	return s
+}
+
+// EnableSpool は送信に失敗したログを path にためて，送信できるようになったら
+// 送信し直すようにします。最初の Write の前に呼んでください。
+func (s *WebhookSink) EnableSpool(path string) {
+	s.sender.spool = newSpool(path, maxSpool)
+}
+
+// Write は e を送信待ちにします。
+func (s *WebhookSink) Write(e *Entry) error {
+	s.sender.enqueue(e.Payload())
+	return nil
+}
+
+// Flush は送信待ちのログを送信し終わるまで待ちます。
+func (s *WebhookSink) Flush(ctx context.Context) error {
+	return s.sender.flush(ctx)
+}
+
+// post は p を Webhook に送信します。
+func (s *WebhookSink) post(ctx context.Context, p *Payload) error {
+	body, err := makeWebhookRequestBody(p)
+	if err != nil {
+		return fmt.Errorf("post to webhook failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, body)
+	if err != nil {
+		return fmt.Errorf("post to webhook failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post to webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+	defer io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("post to webhook failed %s", resp.Status)
+	}
+
+	return nil
+}
+
+// makeWebhookRequestBody は Webhook に送信する POST リクエストの body を
+// 作ります。
+func makeWebhookRequestBody(p *Payload) (*bytes.Reader, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("make webhook request body failed: %w", err)
+	}
+	return bytes.NewReader(body), nil
+}
@@ -0,0 +1,29 @@
+package botplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// envMilbotAdminUsers は管理者とする Slack ユーザ ID をカンマ区切りで並べた
+// 環境変数です。ワークスペースの管理者とオーナーは指定しなくても管理者です。
+const envMilbotAdminUsers = "MILBOT_ADMIN_USERS"
+
+// IsAdmin は userID のユーザが milbot の管理者かどうかを返します。
+func IsAdmin(ctx context.Context, client *slack.Client, userID string) (bool, error) {
+	for _, id := range strings.Split(os.Getenv(envMilbotAdminUsers), ",") {
+		if id = strings.TrimSpace(id); id != "" && id == userID {
+			return true, nil
+		}
+	}
+
+	user, err := client.GetUserInfoContext(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("is admin failed: %w", err)
+	}
+	return user.IsAdmin || user.IsOwner, nil
+}
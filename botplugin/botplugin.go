@@ -3,18 +3,33 @@ package botplugin
 import (
 	"context"
 
+	"github.com/high-moctane/milbot/botclient"
 	"github.com/slack-go/slack"
 )
 
 // Plugin はプラグインが満たすべきインターフェースです。
 // Name はプラグインの名前です。
-// Start で起動処理をします。必要であれば *slack.Client を保存してください。
+// Start で起動処理をします。必要であれば *botclient.Client を保存してください。
+// メッセージの送信は *botclient.Client を通してください。
 // Serve で *slack.RTMEvent を受け取って返事をするなりします。
 // Stop で終了処理をします。
 // Help で使い方を説明したメッセージを返します。
 type Plugin interface {
-	Start(*slack.Client) error
+	Name() string
+	Start(*botclient.Client) error
 	Serve(context.Context, slack.RTMEvent) error
 	Stop() error
 	Help() string
 }
+
+// CommandPrefix はコマンドの先頭につける言葉です。
+const CommandPrefix = "milbot"
+
+// Commander はコマンドを受け付けるプラグインが満たすインターフェースです。
+// Commands は CommandPrefix に続くコマンド ("atnd", "atnd set" など) のリストを
+// 返します。ひとつのコマンドを持てるのはひとつのプラグインだけです。
+// CommandPrefix で始まるメッセージは，一番長く一致するコマンドを持つプラグインにだけ
+// 届きます。
+type Commander interface {
+	Commands() []string
+}
@@ -0,0 +1,136 @@
+package botplugin
+
+import (
+	"github.com/slack-go/slack"
+)
+
+// EventTypeMessage はメッセージの RTMEvent の Type です。
+const EventTypeMessage = "message"
+
+// MessageKind はメッセージイベントの種類です。
+type MessageKind int
+
+const (
+	// MessageNormal は人間の普通の投稿です。
+	MessageNormal MessageKind = iota
+
+	// MessageEdited は編集されたメッセージ (message_changed) です。
+	MessageEdited
+
+	// MessageDeleted は削除されたメッセージ (message_deleted) です。
+	MessageDeleted
+
+	// MessageJoin はチャンネルへの参加や退出のメッセージです。
+	MessageJoin
+
+	// MessageBot は bot の投稿です。
+	MessageBot
+
+	// MessageSelf は milbot 自身の投稿です。
+	MessageSelf
+
+	// MessageOther はそれ以外の subtype のメッセージです。
+	MessageOther
+)
+
+// String です。
+func (k MessageKind) String() string {
+	switch k {
+	case MessageNormal:
+		return "normal"
+	case MessageEdited:
+		return "edited"
+	case MessageDeleted:
+		return "deleted"
+	case MessageJoin:
+		return "join"
+	case MessageBot:
+		return "bot"
+	case MessageSelf:
+		return "self"
+	}
+	return "other"
+}
+
+// ClassifyMessage は ev の種類を返します。selfID には milbot 自身のユーザ ID を与えます。
+func ClassifyMessage(ev *slack.MessageEvent, selfID string) MessageKind {
+	switch ev.SubType {
+	case "message_changed":
+		return MessageEdited
+	case "message_deleted":
+		return MessageDeleted
+	}
+
+	if selfID != "" && ev.User == selfID {
+		return MessageSelf
+	}
+	if ev.BotID != "" || ev.SubType == "bot_message" {
+		return MessageBot
+	}
+
+	switch ev.SubType {
+	case "", "thread_broadcast", "file_share":
+		return MessageNormal
+	case "channel_join", "channel_leave", "group_join", "group_leave":
+		return MessageJoin
+	}
+	return MessageOther
+}
+
+// Subscription はプラグインが受け取りたいイベントを表します。
+type Subscription struct {
+	// EventTypes は受け取る RTMEvent の Type ("message", "reaction_added" など) です。
+	EventTypes []string
+
+	// MessageKinds は受け取るメッセージの種類です。
+	// EventTypes に "message" が含まれるときだけ使われます。
+	MessageKinds []MessageKind
+}
+
+// DefaultSubscription は Subscriber を実装していないプラグインの Subscription です。
+// 人間の普通の投稿だけを受け取ります。
+var DefaultSubscription = Subscription{
+	EventTypes:   []string{EventTypeMessage},
+	MessageKinds: []MessageKind{MessageNormal},
+}
+
+// Subscriber は受け取るイベントを自分で決めたいプラグインが満たすインターフェースです。
+type Subscriber interface {
+	Subscription() Subscription
+}
+
+// SubscriptionOf は plg が受け取りたいイベントを返します。
+func SubscriptionOf(plg Plugin) Subscription {
+	if sub, ok := plg.(Subscriber); ok {
+		return sub.Subscription()
+	}
+	return DefaultSubscription
+}
+
+// Accepts は event を受け取るべきかどうかを返します。kind は event がメッセージの
+// ときの種類です。
+func (s Subscription) Accepts(event slack.RTMEvent, kind MessageKind) bool {
+	if !s.acceptsType(event.Type) {
+		return false
+	}
+	if _, ok := event.Data.(*slack.MessageEvent); !ok {
+		return true
+	}
+
+	for _, k := range s.MessageKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsType は typ の RTMEvent を受け取るかどうかを返します。
+func (s Subscription) acceptsType(typ string) bool {
+	for _, t := range s.EventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package botplugin
+
+import (
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestClassifyMessage(t *testing.T) {
+	const selfID = "UMILBOT"
+
+	tests := []struct {
+		msg  slack.Msg
+		kind MessageKind
+	}{
+		{slack.Msg{User: "U1", Text: "milbot ping"}, MessageNormal},
+		{slack.Msg{User: "U1", SubType: "thread_broadcast"}, MessageNormal},
+		{slack.Msg{SubType: "message_changed"}, MessageEdited},
+		{slack.Msg{SubType: "message_deleted"}, MessageDeleted},
+		{slack.Msg{User: "U1", SubType: "channel_join"}, MessageJoin},
+		{slack.Msg{BotID: "B1", SubType: "bot_message"}, MessageBot},
+		{slack.Msg{User: "U1", BotID: "B1"}, MessageBot},
+		{slack.Msg{User: selfID, Text: "milbot exit"}, MessageSelf},
+		{slack.Msg{User: "U1", SubType: "pinned_item"}, MessageOther},
+	}
+
+	for idx, test := range tests {
+		ev := &slack.MessageEvent{Msg: test.msg}
+		if kind := ClassifyMessage(ev, selfID); kind != test.kind {
+			t.Errorf("[%d] expected %v, got %v", idx, test.kind, kind)
+		}
+	}
+}
+
+func TestSubscriptionAccepts(t *testing.T) {
+	message := slack.RTMEvent{Type: EventTypeMessage, Data: &slack.MessageEvent{}}
+	reaction := slack.RTMEvent{Type: "reaction_added", Data: &slack.ReactionAddedEvent{}}
+
+	tests := []struct {
+		sub   Subscription
+		event slack.RTMEvent
+		kind  MessageKind
+		ok    bool
+	}{
+		{DefaultSubscription, message, MessageNormal, true},
+		{DefaultSubscription, message, MessageEdited, false},
+		{DefaultSubscription, message, MessageSelf, false},
+		{DefaultSubscription, reaction, MessageNormal, false},
+		{Subscription{EventTypes: []string{"reaction_added"}}, reaction, MessageNormal, true},
+		{Subscription{}, message, MessageNormal, false},
+	}
+
+	for idx, test := range tests {
+		if ok := test.sub.Accepts(test.event, test.kind); ok != test.ok {
+			t.Errorf("[%d] expected %v, got %v", idx, test.ok, ok)
+		}
+	}
+}
@@ -5,34 +5,50 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/high-moctane/milbot/botaudit"
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/botlog"
 	"github.com/high-moctane/milbot/libatnd"
 	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackutilsx"
 )
 
 // 反応する regexp たちです。
 var regexpAtndSet = regexp.MustCompile(`(?i)^milbot atnd set`)
+var regexpAtndWiFi = regexp.MustCompile(`(?i)^milbot atnd wifi`)
 var regexpAtndDelete = regexp.MustCompile(`(?i)^milbot atnd delete`)
 var regexpAtndList = regexp.MustCompile(`(?i)^milbot atnd list`)
 var regexpAtnd = regexp.MustCompile(`(?i)^milbot atnd`)
 
 // Plugin は 在室状況を確認するプラグインです。
 type Plugin struct {
-	client *slack.Client
+	client *botclient.Client
 	atnd   *libatnd.Atnd
 }
 
-// New でプラグインを生成します。
-func New() *Plugin {
-	return new(Plugin)
+// New でプラグインを生成します。a に在室管理に使う Atnd を与えます。
+func New(a *libatnd.Atnd) *Plugin {
+	return &Plugin{atnd: a}
+}
+
+// Name はプラグインの名前を返します。
+func (*Plugin) Name() string {
+	return "atnd"
+}
+
+// Commands はプラグインが受け付けるコマンドを返します。
+func (*Plugin) Commands() []string {
+	return []string{"atnd", "atnd set", "atnd wifi", "atnd delete", "atnd list",
+		"atnd device add", "atnd device remove", "atnd device list", "atnd rotate-key", "atnd accept-key", "atnd owner"}
 }
 
 // Start でプラグインを有効化します。
-func (p *Plugin) Start(client *slack.Client) error {
+func (p *Plugin) Start(client *botclient.Client) error {
 	p.client = client
-	p.atnd = libatnd.Instance()
 	return nil
 }
 
@@ -43,18 +59,34 @@ func (p *Plugin) Serve(ctx context.Context, event slack.RTMEvent) error {
 		return nil
 	}
 
-	if ev.BotID != "" {
-		return nil
-	}
-
 	if p.isAtndSetQuery(ev) {
 		if err := p.serveAtndSet(ctx, ev); err != nil {
 			return fmt.Errorf("atnd serve error: %w", err)
 		}
+	} else if p.isAtndWiFiQuery(ev) {
+		if err := p.serveAtndWiFi(ctx, ev); err != nil {
+			return fmt.Errorf("atnd serve error: %w", err)
+		}
 	} else if p.isAtndDeleteQuery(ev) {
 		if err := p.serveAtndDelete(ctx, ev); err != nil {
 			return fmt.Errorf("atnd serve error: %w", err)
 		}
+	} else if p.isAtndDeviceQuery(ev) {
+		if err := p.serveAtndDevice(ctx, ev); err != nil {
+			return fmt.Errorf("atnd serve error: %w", err)
+		}
+	} else if p.isAtndRotateKeyQuery(ev) {
+		if err := p.serveAtndRotateKey(ctx, ev); err != nil {
+			return fmt.Errorf("atnd serve error: %w", err)
+		}
+	} else if p.isAtndAcceptKeyQuery(ev) {
+		if err := p.serveAtndAcceptKey(ctx, ev); err != nil {
+			return fmt.Errorf("atnd serve error: %w", err)
+		}
+	} else if p.isAtndOwnerQuery(ev) {
+		if err := p.serveAtndOwner(ctx, ev); err != nil {
+			return fmt.Errorf("atnd serve error: %w", err)
+		}
 	} else if p.isAtndListQuery(ev) {
 		if err := p.serveAtndList(ctx, ev); err != nil {
 			return fmt.Errorf("atnd serve error: %w", err)
@@ -73,8 +105,19 @@ func (*Plugin) isAtndSetQuery(ev *slack.MessageEvent) bool {
 }
 
 func (p *Plugin) serveAtndSet(ctx context.Context, event *slack.MessageEvent) error {
-	elems := strings.Split(event.Text, " ")
-	if len(elems) != 5 {
+	// 名前を省いたら自分のメンバーを変更します。
+	elems := strings.Fields(event.Text)
+	var name, addr string
+	switch len(elems) {
+	case 4:
+		own, ok, err := p.ownName(ctx, event)
+		if !ok {
+			return err
+		}
+		name, addr = own, elems[3]
+	case 5:
+		name, addr = elems[3], elems[4]
+	default:
 		_, _, _, err := p.client.SendMessageContext(
 			ctx,
 			event.Channel,
@@ -86,8 +129,19 @@ func (p *Plugin) serveAtndSet(ctx context.Context, event *slack.MessageEvent) er
 		return nil
 	}
 
-	name, addr := elems[3], elems[4]
-	err := p.atnd.SetMember(name, addr)
+	g, err := p.authorize(ctx, event, name)
+	if err != nil {
+		return fmt.Errorf("serve atnd set error: %w", err)
+	} else if g == grantDenied {
+		return p.deny(ctx, event, "atnd set "+name, name)
+	}
+
+	if g == grantNew {
+		err = p.atnd.CreateMember(name, event.User, libatnd.BluetoothDevice(addr))
+	} else {
+		err = p.atnd.SetMember(name, addr)
+	}
+	p.recordAudit(ctx, event, "atnd set "+name, err)
 	var macErr libatnd.InvalidMACAddressError
 	var nameErr libatnd.InvalidNameError
 	if errors.As(err, &macErr) {
@@ -110,6 +164,10 @@ func (p *Plugin) serveAtndSet(ctx context.Context, event *slack.MessageEvent) er
 			return fmt.Errorf("serve atnd set error: %w", err)
 		}
 		return nil
+	} else if text, ok := conflictText(err); ok {
+		return p.sendText(ctx, event.Channel, text)
+	} else if errors.Is(err, libatnd.ErrKeyMismatch) {
+		return p.sendText(ctx, event.Channel, keyMismatchMessage)
 	} else if err != nil {
 		return fmt.Errorf("serve atnd set error: %w", err)
 	}
@@ -126,13 +184,108 @@ func (p *Plugin) serveAtndSet(ctx context.Context, event *slack.MessageEvent) er
 	return nil
 }
 
+func (*Plugin) isAtndWiFiQuery(ev *slack.MessageEvent) bool {
+	return regexpAtndWiFi.MatchString(ev.Text)
+}
+
+func (p *Plugin) serveAtndWiFi(ctx context.Context, event *slack.MessageEvent) error {
+	// 名前を省いたら自分のメンバーを変更します。
+	elems := strings.Fields(event.Text)
+	var name, addr string
+	switch len(elems) {
+	case 4:
+		own, ok, err := p.ownName(ctx, event)
+		if !ok {
+			return err
+		}
+		name, addr = own, elems[3]
+	case 5:
+		name, addr = elems[3], elems[4]
+	default:
+		_, _, _, err := p.client.SendMessageContext(
+			ctx,
+			event.Channel,
+			slack.MsgOptionText("フォーマットが違います。`milbot help` をご覧ください (´･ω･｀)", true),
+		)
+		if err != nil {
+			return fmt.Errorf("serve atnd wifi error: %w", err)
+		}
+		return nil
+	}
+
+	g, err := p.authorize(ctx, event, name)
+	if err != nil {
+		return fmt.Errorf("serve atnd wifi error: %w", err)
+	} else if g == grantDenied {
+		return p.deny(ctx, event, "atnd wifi "+name, name)
+	}
+
+	if g == grantNew {
+		err = p.atnd.CreateMember(name, event.User, libatnd.WiFiDevice(addr))
+	} else {
+		err = p.atnd.SetMemberWiFi(name, addr)
+	}
+	p.recordAudit(ctx, event, "atnd wifi "+name, err)
+	var macErr libatnd.InvalidMACAddressError
+	var nameErr libatnd.InvalidNameError
+	if errors.As(err, &macErr) {
+		_, _, _, err := p.client.SendMessageContext(
+			ctx,
+			event.Channel,
+			slack.MsgOptionText("変な MAC アドレスです (´･ω･｀)", true),
+		)
+		if err != nil {
+			return fmt.Errorf("serve atnd wifi error: %w", err)
+		}
+		return nil
+	} else if errors.As(err, &nameErr) {
+		_, _, _, err := p.client.SendMessageContext(
+			ctx,
+			event.Channel,
+			slack.MsgOptionText("その名前は使えません (´･ω･｀)", true),
+		)
+		if err != nil {
+			return fmt.Errorf("serve atnd wifi error: %w", err)
+		}
+		return nil
+	} else if text, ok := conflictText(err); ok {
+		return p.sendText(ctx, event.Channel, text)
+	} else if errors.Is(err, libatnd.ErrKeyMismatch) {
+		return p.sendText(ctx, event.Channel, keyMismatchMessage)
+	} else if err != nil {
+		return fmt.Errorf("serve atnd wifi error: %w", err)
+	}
+
+	_, _, _, err = p.client.SendMessageContext(
+		ctx,
+		event.Channel,
+		slack.MsgOptionText("Wi-Fi の MAC アドレスを登録しました (｀･ω･´)", true),
+	)
+	if err != nil {
+		return fmt.Errorf("serve atnd wifi error: %w", err)
+	}
+
+	return nil
+}
+
 func (p *Plugin) isAtndDeleteQuery(ev *slack.MessageEvent) bool {
 	return regexpAtndDelete.MatchString(ev.Text)
 }
 
 func (p *Plugin) serveAtndDelete(ctx context.Context, event *slack.MessageEvent) error {
-	elems := strings.Split(event.Text, " ")
-	if len(elems) != 4 {
+	// 名前を省いたら自分のメンバーを削除します。
+	elems := strings.Fields(event.Text)
+	var name string
+	switch len(elems) {
+	case 3:
+		own, ok, err := p.ownName(ctx, event)
+		if !ok {
+			return err
+		}
+		name = own
+	case 4:
+		name = elems[3]
+	default:
 		_, _, _, err := p.client.SendMessageContext(
 			ctx,
 			event.Channel,
@@ -144,8 +297,15 @@ func (p *Plugin) serveAtndDelete(ctx context.Context, event *slack.MessageEvent)
 		return nil
 	}
 
-	name := elems[3]
-	err := p.atnd.DeleteMember(name)
+	g, err := p.authorize(ctx, event, name)
+	if err != nil {
+		return fmt.Errorf("serve atnd delete error: %w", err)
+	} else if g == grantDenied {
+		return p.deny(ctx, event, "atnd delete "+name, name)
+	}
+
+	err = p.atnd.DeleteMember(name)
+	p.recordAudit(ctx, event, "atnd delete "+name, err)
 	var notExistErr libatnd.MemberNotExistError
 	if errors.As(err, &notExistErr) {
 		_, _, _, err := p.client.SendMessageContext(
@@ -173,6 +333,30 @@ func (p *Plugin) serveAtndDelete(ctx context.Context, event *slack.MessageEvent)
 	return nil
 }
 
+// recordAudit はメンバー情報を変えるコマンドの結果を監査ログに記録します。
+func (p *Plugin) recordAudit(ctx context.Context, event *slack.MessageEvent, command string, err error) {
+	outcome := botaudit.OutcomeOK
+	var macErr libatnd.InvalidMACAddressError
+	var nameErr libatnd.InvalidNameError
+	var notExistErr libatnd.MemberNotExistError
+	var deviceExistErr libatnd.DeviceExistError
+	var deviceNotExistErr libatnd.DeviceNotExistError
+	var detectorErr libatnd.UnknownDetectorError
+	var ownerExistErr libatnd.OwnerExistError
+	var memberExistErr libatnd.MemberExistError
+	if errors.As(err, &macErr) || errors.As(err, &nameErr) || errors.As(err, &notExistErr) ||
+		errors.As(err, &deviceExistErr) || errors.As(err, &deviceNotExistErr) || errors.As(err, &detectorErr) ||
+		errors.As(err, &ownerExistErr) || errors.As(err, &memberExistErr) {
+		outcome = botaudit.OutcomeInvalid
+	} else if err != nil {
+		outcome = botaudit.OutcomeError(err)
+	}
+
+	if err := botaudit.RecordEvent(ctx, p.client.Client, event, command, outcome); err != nil {
+		botlog.Error("record audit failed", "error", err)
+	}
+}
+
 func (p *Plugin) isAtndListQuery(ev *slack.MessageEvent) bool {
 	return regexpAtndList.MatchString(ev.Text)
 }
@@ -222,11 +406,11 @@ func (p *Plugin) serveAtnd(ctx context.Context, event *slack.MessageEvent) error
 
 // sendHistoryMessage でこれまでの在室履歴を送信します。
 func (p *Plugin) sendHistoryMessage(ctx context.Context, channel string) error {
-	history := p.atnd.Status()
+	presences := p.atnd.Presences()
 	_, _, _, err := p.client.SendMessageContext(
 		ctx,
 		channel,
-		slack.MsgOptionText(p.historyMessage(history), true),
+		slack.MsgOptionText(p.historyMessage(presences), true),
 	)
 	if err != nil {
 		return fmt.Errorf("send history message failed: %w", err)
@@ -234,23 +418,53 @@ func (p *Plugin) sendHistoryMessage(ctx context.Context, channel string) error {
 	return nil
 }
 
-// historyMessage は在室履歴のメッセージを構築します。
-func (p *Plugin) historyMessage(history []*libatnd.Attendance) string {
+// historyMessage は在室履歴のメッセージを構築します。最後に見つかった時間の近い順に並べます。
+func (p *Plugin) historyMessage(presences []*libatnd.Presence) string {
+	history := []*libatnd.Presence{}
+	for _, pr := range presences {
+		if !pr.LastSeen.IsZero() {
+			history = append(history, pr)
+		}
+	}
 	if len(history) == 0 {
-		return "Bot を起動してから誰も在室していないようです (´･ω･｀)"
+		return "記録されている在室履歴はありません (´･ω･｀)"
 	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].LastSeen.After(history[j].LastSeen)
+	})
 
 	msg := new(strings.Builder)
 	msg.WriteString("これまでの在室履歴は\n")
 	now := time.Now()
-	for _, mem := range history {
-		msg.WriteString(fmt.Sprintf("%s: %s\n", mem.Name, p.timeDiffFormat(now, mem.Time)))
+	for _, pr := range history {
+		msg.WriteString(fmt.Sprintf("%s: %s\n", pr.Name, p.presenceFormat(now, pr)))
 	}
 	msg.WriteString("です (｀･ω･´)")
 
 	return msg.String()
 }
 
+// presenceFormat は pr の在室状態をわかりやすいフォーマットに変換します。
+func (p *Plugin) presenceFormat(now time.Time, pr *libatnd.Presence) string {
+	switch {
+	case pr.State.InLab():
+		return fmt.Sprintf("%s から在室 (%s に確認)", p.clockFormat(now, pr.Arrived), p.timeDiffFormat(now, pr.LastSeen))
+	case pr.State == libatnd.StateAbsent && !pr.Departed.IsZero():
+		return fmt.Sprintf("%s に退室", p.clockFormat(now, pr.Departed))
+	}
+	return p.timeDiffFormat(now, pr.LastSeen)
+}
+
+// clockFormat は t を時刻で表します。今日でなければ日付もつけます。
+func (*Plugin) clockFormat(now, t time.Time) string {
+	y1, m1, d1 := now.Date()
+	y2, m2, d2 := t.Date()
+	if y1 == y2 && m1 == m2 && d1 == d2 {
+		return t.Format("15:04")
+	}
+	return t.Format("1/2 15:04")
+}
+
 // timeDiffFormat はt と now の差をわかりやすいフォーマットに変換します。
 func (*Plugin) timeDiffFormat(now, t time.Time) string {
 	duration := now.Sub(t)
@@ -276,7 +490,7 @@ func (p *Plugin) sendAttendanceMessage(ctx context.Context, channel string) erro
 		return fmt.Errorf("send attendance message failed: %w", err)
 	}
 
-	attendance, err := p.atnd.SearchContext(ctx)
+	res, err := p.atnd.ScanContext(ctx)
 	if errors.Is(err, libatnd.ErrBluetoothNotAvailable) {
 		_, _, _, err := p.client.SendMessageContext(
 			ctx,
@@ -294,7 +508,7 @@ func (p *Plugin) sendAttendanceMessage(ctx context.Context, channel string) erro
 	_, _, _, err = p.client.SendMessageContext(
 		ctx,
 		channel,
-		slack.MsgOptionText(p.attendanceMessage(attendance), true),
+		slack.MsgOptionText(p.attendanceMessage(res), false),
 	)
 	if err != nil {
 		return fmt.Errorf("send attendance message failed: %w", err)
@@ -304,18 +518,40 @@ func (p *Plugin) sendAttendanceMessage(ctx context.Context, channel string) erro
 }
 
 // attendanceMessage は出席している人のメッセージを返します。
-func (*Plugin) attendanceMessage(attendance []*libatnd.Attendance) string {
-	if len(attendance) == 0 {
-		return "現在研究室には誰もいません (´･ω･｀)"
+// 判定できなかったメンバーがいればそれも書きます。
+// 登録した Slack のユーザが分かるメンバーはメンションするので，エスケープせずに送ってください。
+func (*Plugin) attendanceMessage(res *libatnd.ScanResult) string {
+	msg := new(strings.Builder)
+
+	if len(res.Attendance) == 0 {
+		msg.WriteString("現在研究室には誰もいません (´･ω･｀)")
+	} else {
+		msg.WriteString("現在研究室には\n")
+		for _, mem := range res.Attendance {
+			msg.WriteString(mention(mem.Name, mem.UserID))
+			msg.WriteString("\n")
+		}
+		msg.WriteString("が在室しています (｀･ω･´)")
 	}
 
-	msg := new(strings.Builder)
-	msg.WriteString("現在研究室には\n")
-	for _, mem := range attendance {
-		msg.WriteString(mem.Name)
+	if len(res.Unscanned) > 0 {
+		msg.WriteString("\nただし ")
+		msg.WriteString(slackutilsx.EscapeMessage(strings.Join(res.Unscanned, ", ")))
+		msg.WriteString(" は確認できませんでした (´･ω･｀)")
+	}
+
+	undecryptable := []string{}
+	for _, name := range res.Unscanned {
+		var decryptErr libatnd.DecryptError
+		if errors.As(res.Errors[name], &decryptErr) {
+			undecryptable = append(undecryptable, name)
+		}
+	}
+	if len(undecryptable) > 0 {
 		msg.WriteString("\n")
+		msg.WriteString(slackutilsx.EscapeMessage(strings.Join(undecryptable, ", ")))
+		msg.WriteString(" の機器は暗号化キーが合わないので読めません。登録しなおしてください (´･ω･｀)")
 	}
-	msg.WriteString("が在室しています (｀･ω･´)")
 
 	return msg.String()
 }
@@ -336,13 +572,43 @@ func (p *Plugin) Help() string {
 		"`milbot atnd set <name> <bluetooth address>`\n" +
 		"メンバー登録または変更をします。\n" +
 		"`<name>` に自分の名前，`<bluetooth address>` に自分のスマートフォンの Bluetooth アドレスを入力してください。\n" +
+		"登録したメンバーはあなたの Slack アカウントと結びつき，在室確認ではメンションされます。\n" +
+		"一度登録したら `<name>` を省いて `milbot atnd set <bluetooth address>` で変更できます。\n" +
+		"ほかの人のメンバーと，持ち主のいない以前からのメンバーは管理者しか変更や削除できません。\n" +
 		"例: `milbot atnd set 俺様 12:34:56:78:90:ab`\n" +
 		"\n" +
-		"`milbot atnd delete <name>`\n" +
+		"`milbot atnd wifi <name> <wifi mac address>`\n" +
+		"Wi-Fi の MAC アドレスを登録または変更をします。Bluetooth を切っている人向けです。\n" +
+		"スマートフォンのプライベートアドレス機能は研究室の Wi-Fi ではオフにしてください。\n" +
+		"一度登録したら `<name>` を省いて `milbot atnd wifi <wifi mac address>` で変更できます。\n" +
+		"例: `milbot atnd wifi 俺様 12:34:56:78:90:ac`\n" +
+		"\n" +
+		"`milbot atnd device add <name> <label> <detector> <address>`\n" +
+		"機器を追加します。スマートフォンとノート PC のように複数の機器を登録できて，どれかが見つかれば在室です。\n" +
+		"`<detector>` は l2ping (Bluetooth)，ble (BLE のアドバタイズ)，lan (研究室の Wi-Fi) のどれかです。\n" +
+		"例: `milbot atnd device add 俺様 laptop lan 12:34:56:78:90:ad`\n" +
+		"\n" +
+		"`milbot atnd device remove <name> <label>`\n" +
+		"機器を削除します。\n" +
+		"\n" +
+		"`milbot atnd device list <name>`\n" +
+		"登録されている機器を表示します。\n" +
+		"\n" +
+		"`milbot atnd delete [<name>]`\n" +
 		"メンバーを削除します。\n" +
-		"<name> に自分の名前をいれてください。\n" +
+		"<name> を省くと自分のメンバーを削除します。\n" +
+		"例: `milbot atnd delete 俺様`\n" +
 		"\n" +
-		"例: `milbot atnd delete 俺様`" +
 		"`milbot atnd list`\n" +
-		"登録されているメンバーの名前を表示します。"
+		"登録されているメンバーの名前を表示します。\n" +
+		"\n" +
+		"`milbot atnd rotate-key`\n" +
+		"管理者用です。暗号化キーを新しくして，登録されているアドレスをすべて暗号化しなおします。\n" +
+		"\n" +
+		"`milbot atnd accept-key`\n" +
+		"管理者用です。設定ファイルと違う暗号化キーで起動したときに，今のキーを使うことにします。" +
+		"読めない機器は登録しなおしてください。\n" +
+		"\n" +
+		"`milbot atnd owner <name> <@user>`\n" +
+		"管理者用です。メンバーの持ち主を決めます。持ち主のいない以前からのメンバーを誰かのものにするときに使います。"
 }
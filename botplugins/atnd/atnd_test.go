@@ -0,0 +1,76 @@
+package atnd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestServeOwnMember(t *testing.T) {
+	p, a, texts := newTestPlugin(t)
+
+	hasWiFi := func() bool {
+		devices, err := a.Devices("alice")
+		if err != nil {
+			return false
+		}
+		for _, d := range devices {
+			if d.Detector == "lan" {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		user  string
+		text  string
+		reply string
+		check func() bool
+	}{
+		// 空白が続いても区切りはひとつとみなします。
+		{"UALICE", "milbot atnd set  alice   01:23:45:67:89:ab", "登録しました",
+			func() bool { name, ok := a.MemberOf("UALICE"); return ok && name == "alice" }},
+		// wifi も名前を省くと自分のメンバーを変更します。
+		{"UALICE", "milbot atnd wifi 01:23:45:67:89:ac ", "Wi-Fi の MAC アドレスを登録しました", hasWiFi},
+		{"UBOB", "milbot atnd wifi 01:23:45:67:89:ad", "まだ登録されていません",
+			func() bool { _, ok := a.MemberOf("UBOB"); return !ok }},
+		{"UALICE", "milbot atnd wifi alice", "変な MAC アドレスです", hasWiFi},
+		{"UALICE", "milbot atnd delete  ", "削除しました",
+			func() bool { _, ok := a.MemberOf("UALICE"); return !ok }},
+	}
+
+	for idx, test := range tests {
+		ev := &slack.MessageEvent{Msg: slack.Msg{User: test.user, Channel: "C1", Text: test.text}}
+		if err := p.Serve(context.Background(), slack.RTMEvent{Data: ev}); err != nil {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		posted := texts()
+		if len(posted) != idx+1 {
+			t.Fatalf("[%d] expected %d replies, got %v", idx, idx+1, posted)
+		}
+		if reply := posted[idx]; !strings.Contains(reply, test.reply) {
+			t.Errorf("[%d] expected reply containing %q, got %q", idx, test.reply, reply)
+		}
+		if !test.check() {
+			t.Errorf("[%d] unexpected members after %q", idx, test.text)
+		}
+	}
+}
+
+func TestHelp(t *testing.T) {
+	// コマンドの説明は空行で区切ります。前の説明の終わりにつながっていないか確かめます。
+	help := new(Plugin).Help()
+	for idx, line := range strings.Split(help, "\n") {
+		if i := strings.Index(line, "`milbot"); i > 0 && strings.HasSuffix(line[:i], "`") {
+			t.Errorf("[%d] command runs into previous line: %q", idx, line)
+		}
+	}
+	for _, cmd := range []string{"milbot atnd list", "milbot atnd delete", "milbot atnd owner"} {
+		if !strings.Contains(help, "\n\n`"+cmd) {
+			t.Errorf("%q not separated by a blank line", cmd)
+		}
+	}
+}
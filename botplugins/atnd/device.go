@@ -0,0 +1,169 @@
+package atnd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/high-moctane/milbot/libatnd"
+	"github.com/slack-go/slack"
+)
+
+// 機器のコマンドに反応する regexp たちです。
+var regexpAtndDeviceAdd = regexp.MustCompile(`(?i)^milbot atnd device add`)
+var regexpAtndDeviceRemove = regexp.MustCompile(`(?i)^milbot atnd device remove`)
+var regexpAtndDeviceList = regexp.MustCompile(`(?i)^milbot atnd device list`)
+var regexpAtndDevice = regexp.MustCompile(`(?i)^milbot atnd device`)
+
+func (*Plugin) isAtndDeviceQuery(ev *slack.MessageEvent) bool {
+	return regexpAtndDevice.MatchString(ev.Text)
+}
+
+// serveAtndDevice は `milbot atnd device` のサブコマンドを振り分けます。
+func (p *Plugin) serveAtndDevice(ctx context.Context, event *slack.MessageEvent) error {
+	var err error
+	switch {
+	case regexpAtndDeviceAdd.MatchString(event.Text):
+		err = p.serveAtndDeviceAdd(ctx, event)
+	case regexpAtndDeviceRemove.MatchString(event.Text):
+		err = p.serveAtndDeviceRemove(ctx, event)
+	case regexpAtndDeviceList.MatchString(event.Text):
+		err = p.serveAtndDeviceList(ctx, event)
+	default:
+		err = p.sendText(ctx, event.Channel, "フォーマットが違います。`milbot help` をご覧ください (´･ω･｀)")
+	}
+	if err != nil {
+		return fmt.Errorf("serve atnd device error: %w", err)
+	}
+	return nil
+}
+
+// serveAtndDeviceAdd は `milbot atnd device add <name> <label> <detector> <address>` に答えます。
+func (p *Plugin) serveAtndDeviceAdd(ctx context.Context, event *slack.MessageEvent) error {
+	elems := strings.Fields(event.Text)
+	if len(elems) != 8 {
+		return p.sendText(ctx, event.Channel, "フォーマットが違います。`milbot help` をご覧ください (´･ω･｀)")
+	}
+
+	name := elems[4]
+	dev := libatnd.Device{Label: elems[5], Detector: elems[6], Address: elems[7]}
+	g, err := p.authorize(ctx, event, name)
+	if err != nil {
+		return fmt.Errorf("serve atnd device add error: %w", err)
+	} else if g == grantDenied {
+		return p.deny(ctx, event, "atnd device add "+name+" "+dev.Label, name)
+	}
+
+	if g == grantNew {
+		err = p.atnd.CreateMember(name, event.User, dev)
+	} else {
+		err = p.atnd.AddDevice(name, dev)
+	}
+	p.recordAudit(ctx, event, "atnd device add "+name+" "+dev.Label, err)
+	if text, ok := conflictText(err); ok {
+		return p.sendText(ctx, event.Channel, text)
+	}
+
+	var macErr libatnd.InvalidMACAddressError
+	var nameErr libatnd.InvalidNameError
+	var existErr libatnd.DeviceExistError
+	var detectorErr libatnd.UnknownDetectorError
+	switch {
+	case errors.As(err, &macErr):
+		return p.sendText(ctx, event.Channel, "変なアドレスです (´･ω･｀)")
+	case errors.As(err, &nameErr):
+		return p.sendText(ctx, event.Channel, "その名前は使えません (´･ω･｀)")
+	case errors.As(err, &existErr):
+		return p.sendText(ctx, event.Channel, "そのラベルの機器はもう登録されています (´･ω･｀)")
+	case errors.As(err, &detectorErr):
+		return p.sendText(ctx, event.Channel, "検出方法は l2ping, ble, lan のどれかにしてください (´･ω･｀)")
+	case errors.Is(err, libatnd.ErrKeyMismatch):
+		return p.sendText(ctx, event.Channel, keyMismatchMessage)
+	case err != nil:
+		return fmt.Errorf("serve atnd device add error: %w", err)
+	}
+
+	return p.sendText(ctx, event.Channel, "機器を登録しました (｀･ω･´)")
+}
+
+// serveAtndDeviceRemove は `milbot atnd device remove <name> <label>` に答えます。
+func (p *Plugin) serveAtndDeviceRemove(ctx context.Context, event *slack.MessageEvent) error {
+	elems := strings.Fields(event.Text)
+	if len(elems) != 6 {
+		return p.sendText(ctx, event.Channel, "フォーマットが違います。`milbot help` をご覧ください (´･ω･｀)")
+	}
+
+	name, label := elems[4], elems[5]
+	g, err := p.authorize(ctx, event, name)
+	if err != nil {
+		return fmt.Errorf("serve atnd device remove error: %w", err)
+	} else if g == grantDenied {
+		return p.deny(ctx, event, "atnd device remove "+name+" "+label, name)
+	}
+
+	err = p.atnd.RemoveDevice(name, label)
+	p.recordAudit(ctx, event, "atnd device remove "+name+" "+label, err)
+
+	var memberErr libatnd.MemberNotExistError
+	var deviceErr libatnd.DeviceNotExistError
+	switch {
+	case errors.As(err, &memberErr):
+		return p.sendText(ctx, event.Channel, "その名前のメンバーはいません (´･ω･｀)")
+	case errors.As(err, &deviceErr):
+		return p.sendText(ctx, event.Channel, "そのラベルの機器はありません (´･ω･｀)")
+	case err != nil:
+		return fmt.Errorf("serve atnd device remove error: %w", err)
+	}
+
+	return p.sendText(ctx, event.Channel, "機器を削除しました (｀･ω･´)")
+}
+
+// serveAtndDeviceList は `milbot atnd device list <name>` に答えます。アドレスは表示しません。
+func (p *Plugin) serveAtndDeviceList(ctx context.Context, event *slack.MessageEvent) error {
+	elems := strings.Fields(event.Text)
+	if len(elems) != 5 {
+		return p.sendText(ctx, event.Channel, "フォーマットが違います。`milbot help` をご覧ください (´･ω･｀)")
+	}
+
+	name := elems[4]
+	devices, err := p.atnd.Devices(name)
+	var memberErr libatnd.MemberNotExistError
+	if errors.As(err, &memberErr) {
+		return p.sendText(ctx, event.Channel, "その名前のメンバーはいません (´･ω･｀)")
+	} else if err != nil {
+		return fmt.Errorf("serve atnd device list error: %w", err)
+	}
+
+	return p.sendText(ctx, event.Channel, p.deviceListMessage(name, devices))
+}
+
+// deviceListMessage は機器の一覧のメッセージを構築します。
+func (*Plugin) deviceListMessage(name string, devices []libatnd.DeviceInfo) string {
+	if len(devices) == 0 {
+		return name + " の機器は登録されていません (´･ω･｀)"
+	}
+
+	msg := new(strings.Builder)
+	msg.WriteString(name)
+	msg.WriteString(" の機器は\n")
+	for _, dev := range devices {
+		detector := dev.Detector
+		if detector == "" {
+			detector = "default"
+		}
+		msg.WriteString(fmt.Sprintf("%s (%s)\n", dev.Label, detector))
+	}
+	msg.WriteString("です (｀･ω･´)")
+	return msg.String()
+}
+
+// sendText は channel に text を送信します。
+func (p *Plugin) sendText(ctx context.Context, channel, text string) error {
+	_, _, _, err := p.client.SendMessageContext(ctx, channel, slack.MsgOptionText(text, true))
+	if err != nil {
+		return fmt.Errorf("send text failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package atnd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/high-moctane/milbot/botaudit"
+	"github.com/high-moctane/milbot/botlog"
+	"github.com/high-moctane/milbot/botplugin"
+	"github.com/high-moctane/milbot/libatnd"
+	"github.com/slack-go/slack"
+)
+
+// 暗号化キーのコマンドに反応する regexp たちです。
+var regexpAtndRotateKey = regexp.MustCompile(`(?i)^milbot atnd rotate-key`)
+var regexpAtndAcceptKey = regexp.MustCompile(`(?i)^milbot atnd accept-key`)
+
+// keyMismatchMessage は設定ファイルと違うキーで起動していて登録できないときの返信です。
+const keyMismatchMessage = "設定ファイルと違う暗号化キーで起動しているので登録できません。" +
+	"管理者が正しいキーに戻すか，`milbot atnd accept-key` で今のキーを使うことにしてください (´･ω･｀)"
+
+func (*Plugin) isAtndRotateKeyQuery(ev *slack.MessageEvent) bool {
+	return regexpAtndRotateKey.MatchString(ev.Text)
+}
+
+// serveAtndRotateKey は `milbot atnd rotate-key` で暗号化キーを入れ替えます。管理者しか使えません。
+func (p *Plugin) serveAtndRotateKey(ctx context.Context, event *slack.MessageEvent) error {
+	admin, err := botplugin.IsAdmin(ctx, p.client.Client, event.User)
+	if err != nil {
+		return fmt.Errorf("serve atnd rotate key error: %w", err)
+	}
+	if !admin {
+		if err := botaudit.RecordEvent(ctx, p.client.Client, event, "atnd rotate-key", botaudit.OutcomeDenied); err != nil {
+			botlog.Error("record audit failed", "error", err)
+		}
+		return p.sendText(ctx, event.Channel, "このコマンドは管理者しか使えません (´･ω･｀)")
+	}
+
+	id, err := p.atnd.RotateKey()
+	p.recordAudit(ctx, event, "atnd rotate-key", err)
+
+	var decryptErr libatnd.DecryptError
+	switch {
+	case errors.Is(err, libatnd.ErrKeyNotRotatable):
+		return p.sendText(ctx, event.Channel,
+			"キーを環境変数かクレデンシャルで渡しているので入れ替えられません (´･ω･｀)")
+	case errors.As(err, &decryptErr):
+		return p.sendText(ctx, event.Channel,
+			fmt.Sprintf("%s の機器が今のキーで読めないので入れ替えませんでした。登録しなおしてください (´･ω･｀)", decryptErr.Name))
+	case err != nil:
+		return fmt.Errorf("serve atnd rotate key error: %w", err)
+	}
+
+	return p.sendText(ctx, event.Channel, fmt.Sprintf("暗号化キーを入れ替えました (｀･ω･´) キー ID: %s", id))
+}
+
+func (*Plugin) isAtndAcceptKeyQuery(ev *slack.MessageEvent) bool {
+	return regexpAtndAcceptKey.MatchString(ev.Text)
+}
+
+// serveAtndAcceptKey は `milbot atnd accept-key` で設定ファイルと違う今のキーを使うことにします。
+// 管理者しか使えません。
+func (p *Plugin) serveAtndAcceptKey(ctx context.Context, event *slack.MessageEvent) error {
+	admin, err := botplugin.IsAdmin(ctx, p.client.Client, event.User)
+	if err != nil {
+		return fmt.Errorf("serve atnd accept key error: %w", err)
+	}
+	if !admin {
+		if err := botaudit.RecordEvent(ctx, p.client.Client, event, "atnd accept-key", botaudit.OutcomeDenied); err != nil {
+			botlog.Error("record audit failed", "error", err)
+		}
+		return p.sendText(ctx, event.Channel, "このコマンドは管理者しか使えません (´･ω･｀)")
+	}
+
+	if !p.atnd.KeyMismatch() {
+		return p.sendText(ctx, event.Channel, "暗号化キーは設定ファイルと合っています (｀･ω･´)")
+	}
+
+	err = p.atnd.AcceptKey()
+	p.recordAudit(ctx, event, "atnd accept-key", err)
+	if err != nil {
+		return fmt.Errorf("serve atnd accept key error: %w", err)
+	}
+
+	return p.sendText(ctx, event.Channel, fmt.Sprintf(
+		"今の暗号化キーを使うことにしました (｀･ω･´) キー ID: %s\n読めない機器は登録しなおしてください。", p.atnd.KeyID()))
+}
@@ -0,0 +1,151 @@
+package atnd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/high-moctane/milbot/botaudit"
+	"github.com/high-moctane/milbot/botlog"
+	"github.com/high-moctane/milbot/botplugin"
+	"github.com/high-moctane/milbot/libatnd"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackutilsx"
+)
+
+// 持ち主を決めるコマンドに反応する regexp たちです。
+var regexpAtndOwner = regexp.MustCompile(`(?i)^milbot atnd owner`)
+var regexpOwnerMention = regexp.MustCompile(`^<@([0-9A-Z]+)(\|[^>]*)?>$`)
+
+// grant は authorize で分かった，メンバーを変更できる理由です。
+type grant int
+
+const (
+	grantDenied grant = iota // 変更できません。
+	grantOwner               // 自分のメンバーです。
+	grantNew                 // まだいない名前のメンバーで，CreateMember で自分のメンバーとして登録します。
+	grantAdmin               // 管理者としてほかの人のメンバーを変更します。
+)
+
+// authorize は event を送ったユーザが name のメンバーを変更できるかどうかを返します。
+// 自分のメンバーは変更できます。まだ自分のメンバーがなければ，まだいない名前で新しく登録できます。
+// ほかの人のメンバーと持ち主のいないメンバーは管理者しか変更できません。
+// 持ち主のいないメンバーは管理者が `milbot atnd owner` で持ち主を決めてください。
+func (p *Plugin) authorize(ctx context.Context, event *slack.MessageEvent, name string) (grant, error) {
+	owner, err := p.atnd.MemberOwner(name)
+	var notExistErr libatnd.MemberNotExistError
+	exists := !errors.As(err, &notExistErr)
+	if err != nil && exists {
+		return grantDenied, fmt.Errorf("authorize failed: %w", err)
+	}
+
+	if exists && owner == event.User {
+		return grantOwner, nil
+	}
+	if _, hasOwn := p.atnd.MemberOf(event.User); !exists && !hasOwn {
+		return grantNew, nil
+	}
+
+	admin, err := botplugin.IsAdmin(ctx, p.client.Client, event.User)
+	if err != nil {
+		return grantDenied, fmt.Errorf("authorize failed: %w", err)
+	}
+	if admin {
+		return grantAdmin, nil
+	}
+	return grantDenied, nil
+}
+
+// deny は name のメンバーを変更できなかったことを記録して返信します。
+func (p *Plugin) deny(ctx context.Context, event *slack.MessageEvent, command, name string) error {
+	if err := botaudit.RecordEvent(ctx, p.client.Client, event, command, botaudit.OutcomeDenied); err != nil {
+		botlog.Error("record audit failed", "error", err)
+	}
+	if own, ok := p.atnd.MemberOf(event.User); ok && own != name {
+		return p.sendText(ctx, event.Channel,
+			fmt.Sprintf("あなたは %s として登録されています。ほかの人の登録は管理者しか変更できません (´･ω･｀)", own))
+	}
+	return p.sendText(ctx, event.Channel, "ほかの人の登録は管理者しか変更できません (´･ω･｀)")
+}
+
+// conflictText は新しく登録しようとしている間に，ほかの人が同じ名前を登録したり，
+// 自分がほかのメンバーを登録したりして登録できなかったときの返信を返します。
+func conflictText(err error) (string, bool) {
+	var memberExistErr libatnd.MemberExistError
+	var ownerExistErr libatnd.OwnerExistError
+	switch {
+	case errors.As(err, &memberExistErr):
+		return "その名前はほかの人が先に登録しました (´･ω･｀)", true
+	case errors.As(err, &ownerExistErr):
+		return fmt.Sprintf("あなたは %s として登録されています (´･ω･｀)", ownerExistErr.Name), true
+	}
+	return "", false
+}
+
+func (*Plugin) isAtndOwnerQuery(ev *slack.MessageEvent) bool {
+	return regexpAtndOwner.MatchString(ev.Text)
+}
+
+// serveAtndOwner は `milbot atnd owner <name> <@user>` で name のメンバーの持ち主を決めます。
+// 持ち主のいない以前からのメンバーを誰かのものにするときに使います。管理者しか使えません。
+func (p *Plugin) serveAtndOwner(ctx context.Context, event *slack.MessageEvent) error {
+	elems := strings.Fields(event.Text)
+	if len(elems) != 5 || !regexpOwnerMention.MatchString(elems[4]) {
+		return p.sendText(ctx, event.Channel, "フォーマットが違います。`milbot help` をご覧ください (´･ω･｀)")
+	}
+	name := elems[3]
+	userID := regexpOwnerMention.FindStringSubmatch(elems[4])[1]
+	command := "atnd owner " + name + " " + userID
+
+	admin, err := botplugin.IsAdmin(ctx, p.client.Client, event.User)
+	if err != nil {
+		return fmt.Errorf("serve atnd owner error: %w", err)
+	}
+	if !admin {
+		if err := botaudit.RecordEvent(ctx, p.client.Client, event, command, botaudit.OutcomeDenied); err != nil {
+			botlog.Error("record audit failed", "error", err)
+		}
+		return p.sendText(ctx, event.Channel, "このコマンドは管理者しか使えません (´･ω･｀)")
+	}
+
+	err = p.atnd.SetMemberOwner(name, userID)
+	p.recordAudit(ctx, event, command, err)
+
+	var notExistErr libatnd.MemberNotExistError
+	var ownerExistErr libatnd.OwnerExistError
+	switch {
+	case errors.As(err, &notExistErr):
+		return p.sendText(ctx, event.Channel, "その名前のメンバーはいません (´･ω･｀)")
+	case errors.As(err, &ownerExistErr):
+		return p.sendText(ctx, event.Channel,
+			fmt.Sprintf("その人はもう %s として登録されています (´･ω･｀)", ownerExistErr.Name))
+	case err != nil:
+		return fmt.Errorf("serve atnd owner error: %w", err)
+	}
+
+	return p.sendText(ctx, event.Channel, "持ち主を変更しました (｀･ω･´)")
+}
+
+// ownName は event を送ったユーザのメンバーの名前を返します。
+// まだ登録していなければ登録のしかたを返信して ok に false を返します。
+func (p *Plugin) ownName(ctx context.Context, event *slack.MessageEvent) (name string, ok bool, err error) {
+	name, ok = p.atnd.MemberOf(event.User)
+	if ok {
+		return name, true, nil
+	}
+	err = p.sendText(ctx, event.Channel,
+		"まだ登録されていません。`milbot atnd set <name> <bluetooth address>` で名前をつけて登録してください (´･ω･｀)")
+	return "", false, err
+}
+
+// mention は name のメンバーを Slack のメッセージに書くときの文字列を返します。
+// 持ち主の userID が分かればメンションにして，分からなければ名前を書きます。
+// メンションを使うメッセージはエスケープせずに送るので，名前はここでエスケープします。
+func mention(name, userID string) string {
+	if userID != "" {
+		return "<@" + userID + ">"
+	}
+	return slackutilsx.EscapeMessage(name)
+}
@@ -0,0 +1,180 @@
+package atnd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/libatnd"
+	"github.com/robfig/cron/v3"
+	"github.com/slack-go/slack"
+)
+
+// nopScheduler は何も実行しない libatnd.Scheduler です。
+type nopScheduler struct{}
+
+func (nopScheduler) AddFunc(string, func()) (cron.EntryID, error) {
+	return 1, nil
+}
+
+func (nopScheduler) Entry(cron.EntryID) cron.Entry {
+	return cron.Entry{}
+}
+
+// newTestPlugin は一時ディレクトリにデータを置いて，Slack の API を srv に向けた Plugin を作ります。
+// 投稿されたメッセージは texts に入ります。
+func newTestPlugin(t *testing.T) (p *Plugin, a *libatnd.Atnd, texts func() []string) {
+	dir, err := ioutil.TempDir("", "atnd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	os.Setenv("MILBOT_DATA_DIR", dir)
+	os.Setenv("MILBOT_ADMIN_USERS", "UADMIN")
+	t.Cleanup(func() {
+		os.Unsetenv("MILBOT_DATA_DIR")
+		os.Unsetenv("MILBOT_ADMIN_USERS")
+	})
+
+	var mu sync.Mutex
+	var posted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/chat.postMessage":
+			mu.Lock()
+			posted = append(posted, r.FormValue("text"))
+			mu.Unlock()
+			w.Write([]byte(`{"ok":true,"channel":"C1","ts":"1"}`))
+		case "/users.info":
+			w.Write([]byte(`{"ok":true,"user":{"id":"` + r.FormValue("user") + `","name":"someone"}}`))
+		default:
+			w.Write([]byte(`{"ok":false,"error":"unknown_method"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	a, err = libatnd.New(libatnd.Options{
+		ConfigPath:  filepath.Join(dir, "atnd_config.json"),
+		KeyPath:     filepath.Join(dir, ".atnd_key"),
+		HistoryPath: filepath.Join(dir, "atnd_history.jsonl"),
+		Scheduler:   nopScheduler{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+
+	client := botclient.New(slack.New("xoxb-test", slack.OptionAPIURL(srv.URL+"/")))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client.Close(ctx)
+	})
+
+	p = New(a)
+	if err := p.Start(client); err != nil {
+		t.Fatal(err)
+	}
+
+	texts = func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, posted...)
+	}
+	return p, a, texts
+}
+
+func TestAuthorizeUnowned(t *testing.T) {
+	p, a, texts := newTestPlugin(t)
+
+	// bob は持ち主のいない以前からのメンバーです。
+	if err := a.SetMember("bob", "01:23:45:67:89:ab"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user  string
+		text  string
+		reply string
+		check func() bool
+	}{
+		// まだメンバーを持っていない人もほかの人の持ち主のいないメンバーは変更できません。
+		{"UCAROL", "milbot atnd delete bob", "管理者しか",
+			func() bool { _, err := a.MemberOwner("bob"); return err == nil }},
+		{"UCAROL", "milbot atnd set bob 01:23:45:67:89:ac", "管理者しか",
+			func() bool { owner, _ := a.MemberOwner("bob"); return owner == "" }},
+		// まだいない名前なら登録できて自分のメンバーになります。
+		{"UCAROL", "milbot atnd set carol 01:23:45:67:89:ad", "登録しました",
+			func() bool { name, ok := a.MemberOf("UCAROL"); return ok && name == "carol" }},
+		// 持ち主は管理者が決めます。
+		{"UBOB", "milbot atnd owner bob <@UBOB>", "管理者しか",
+			func() bool { owner, _ := a.MemberOwner("bob"); return owner == "" }},
+		{"UADMIN", "milbot atnd owner bob <@UBOB|bob>", "持ち主を変更しました",
+			func() bool { owner, _ := a.MemberOwner("bob"); return owner == "UBOB" }},
+		{"UADMIN", "milbot atnd owner bob <@UCAROL>", "carol",
+			func() bool { owner, _ := a.MemberOwner("bob"); return owner == "UBOB" }},
+		{"UBOB", "milbot atnd delete", "削除しました",
+			func() bool { _, err := a.MemberOwner("bob"); return err != nil }},
+	}
+
+	for idx, test := range tests {
+		ev := &slack.MessageEvent{Msg: slack.Msg{User: test.user, Channel: "C1", Text: test.text}}
+		if err := p.Serve(context.Background(), slack.RTMEvent{Data: ev}); err != nil {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		posted := texts()
+		if len(posted) != idx+1 {
+			t.Fatalf("[%d] expected %d replies, got %v", idx, idx+1, posted)
+		}
+		if reply := posted[idx]; !strings.Contains(reply, test.reply) {
+			t.Errorf("[%d] expected reply containing %q, got %q", idx, test.reply, reply)
+		}
+		if !test.check() {
+			t.Errorf("[%d] unexpected members after %q", idx, test.text)
+		}
+	}
+}
+
+func TestAuthorizeConcurrentNew(t *testing.T) {
+	p, a, texts := newTestPlugin(t)
+
+	// 同時に同じ新しい名前を登録しても，登録できるのはひとりだけで，持ち主も変わりません。
+	users := []string{"UCAROL", "UDAVE", "UEVE", "UFRANK"}
+	wg := new(sync.WaitGroup)
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user string) {
+			defer wg.Done()
+			text := fmt.Sprintf("milbot atnd set dave 01:23:45:67:89:%02x", i)
+			ev := &slack.MessageEvent{Msg: slack.Msg{User: user, Channel: "C1", Text: text}}
+			if err := p.Serve(context.Background(), slack.RTMEvent{Data: ev}); err != nil {
+				t.Errorf("[%d] unexpected error: %v", i, err)
+			}
+		}(i, user)
+	}
+	wg.Wait()
+
+	registered := 0
+	for _, reply := range texts() {
+		if strings.Contains(reply, "登録しました") {
+			registered++
+		}
+	}
+	if registered != 1 {
+		t.Errorf("expected 1 registration, got %d: %v", registered, texts())
+	}
+	owner, err := a.MemberOwner("dave")
+	if err != nil || owner == "" {
+		t.Errorf("unexpected owner of dave: %q, %v", owner, err)
+	}
+}
@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/high-moctane/milbot/botaudit"
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/botlog"
+	"github.com/high-moctane/milbot/botplugin"
+	"github.com/slack-go/slack"
+)
+
+// validRegexp は反応するメッセージの正規表現です。
+var validRegexp = regexp.MustCompile(`(?i)^milbot audit`)
+
+// regexpMention は Slack のメンションの正規表現です。
+var regexpMention = regexp.MustCompile(`^<@([0-9A-Z]+)(\|[^>]*)?>$`)
+
+// maxEntries は一度に表示するエントリの最大数です。
+const maxEntries = 30
+
+// Plugin は監査ログを表示するプラグインです。
+type Plugin struct {
+	client *botclient.Client
+}
+
+// New でプラグインを生成します。
+func New() *Plugin {
+	return new(Plugin)
+}
+
+// Name はプラグインの名前を返します。
+func (*Plugin) Name() string {
+	return "audit"
+}
+
+// Commands はプラグインが受け付けるコマンドを返します。
+func (*Plugin) Commands() []string {
+	return []string{"audit"}
+}
+
+// Start でプラグインを有効化します。
+func (p *Plugin) Start(client *botclient.Client) error {
+	p.client = client
+	return nil
+}
+
+// Serve で監査ログを検索して返します。
+func (p *Plugin) Serve(ctx context.Context, event slack.RTMEvent) error {
+	if !p.isValidEvent(event) {
+		return nil
+	}
+
+	ev := event.Data.(*slack.MessageEvent)
+	admin, err := botplugin.IsAdmin(ctx, p.client.Client, ev.User)
+	if err != nil {
+		return fmt.Errorf("audit failed: %w", err)
+	}
+	// 誰が監査ログを見たかも監査ログに残します。
+	command := strings.Join(strings.Fields(ev.Text)[1:], " ")
+	if !admin {
+		p.recordAudit(ctx, ev, command, botaudit.OutcomeDenied)
+		return p.sendMessage(ctx, ev.Channel, "このコマンドは管理者しか使えません (´･ω･｀)")
+	}
+
+	filter, ok := p.parseFilter(ev.Text, time.Now())
+	if !ok {
+		p.recordAudit(ctx, ev, command, botaudit.OutcomeInvalid)
+		return p.sendMessage(ctx, ev.Channel, "フォーマットが違います。`milbot help` をご覧ください (´･ω･｀)")
+	}
+
+	entries, err := botaudit.Query(filter)
+	if err != nil {
+		p.recordAudit(ctx, ev, command, botaudit.OutcomeError(err))
+		return fmt.Errorf("audit failed: %w", err)
+	}
+	p.recordAudit(ctx, ev, command, botaudit.OutcomeOK)
+	return p.sendMessage(ctx, ev.Channel, p.entriesMessage(entries))
+}
+
+// isValidEvent は event に反応するべきかどうか返します。
+func (*Plugin) isValidEvent(event slack.RTMEvent) bool {
+	ev, ok := event.Data.(*slack.MessageEvent)
+	if !ok {
+		return false
+	}
+	return validRegexp.MatchString(ev.Text)
+}
+
+// parseFilter は `milbot audit [user] [since]` の引数を解釈します。
+func (p *Plugin) parseFilter(text string, now time.Time) (filter botaudit.Filter, ok bool) {
+	args := strings.Fields(text)[2:]
+	if len(args) > 2 {
+		return
+	}
+
+	for _, arg := range args {
+		if since, ok := p.parseSince(arg, now); ok {
+			filter.Since = since
+		} else if m := regexpMention.FindStringSubmatch(arg); m != nil {
+			filter.User = m[1]
+		} else {
+			filter.User = arg
+		}
+	}
+
+	return filter, true
+}
+
+// parseSince は "24h", "7d", "2006-01-02" のような形式の期間の始まりを解釈します。
+func (*Plugin) parseSince(arg string, now time.Time) (time.Time, bool) {
+	if strings.HasSuffix(arg, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(arg, "d")); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), true
+		}
+	}
+	if d, err := time.ParseDuration(arg); err == nil && d >= 0 {
+		return now.Add(-d), true
+	}
+	if t, err := time.ParseInLocation("2006-01-02", arg, now.Location()); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// entriesMessage は監査ログのエントリのメッセージを構築します。
+func (*Plugin) entriesMessage(entries []*botaudit.Entry) string {
+	if len(entries) == 0 {
+		return "該当する記録はありません (｀･ω･´)"
+	}
+
+	msg := new(strings.Builder)
+	if len(entries) > maxEntries {
+		fmt.Fprintf(msg, "%d 件のうち新しい %d 件です (｀･ω･´)\n", len(entries), maxEntries)
+		entries = entries[len(entries)-maxEntries:]
+	}
+	for _, e := range entries {
+		fmt.Fprintf(msg, "%s %s (%s) %s `%s` → %s\n",
+			e.Time.Format("2006-01-02 15:04:05"), e.UserName, e.UserID, e.Channel, e.Command, e.Outcome)
+	}
+
+	return strings.TrimSuffix(msg.String(), "\n")
+}
+
+// sendMessage は channel に text を送信します。
+func (p *Plugin) sendMessage(ctx context.Context, channel, text string) error {
+	_, _, _, err := p.client.SendMessageContext(
+		ctx,
+		channel,
+		slack.MsgOptionText(text, true),
+	)
+	if err != nil {
+		return fmt.Errorf("audit failed: %w", err)
+	}
+	return nil
+}
+
+// Stop でプラグインの終了処理をします。
+func (p *Plugin) Stop() error {
+	return nil
+}
+
+// Help でヘルプメッセージを返します。
+func (p *Plugin) Help() string {
+	return "[Audit]\n" +
+		"終了や再起動，在室確認のメンバー登録などの記録を表示します。管理者専用です。\n" +
+		"\n" +
+		"`milbot audit [user] [since]`\n" +
+		"`[user]` にユーザ名かメンション，`[since]` に `24h`, `7d`, `2006-01-02` のような期間を指定すると絞り込みます。\n" +
+		"例: `milbot audit @俺様 7d`"
+}
+
+// recordAudit は監査ログの検索を監査ログに記録します。
+func (p *Plugin) recordAudit(ctx context.Context, ev *slack.MessageEvent, command, outcome string) {
+	if err := botaudit.RecordEvent(ctx, p.client.Client, ev, command, outcome); err != nil {
+		botlog.Error("record audit failed", "error", err)
+	}
+}
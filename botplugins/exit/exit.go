@@ -3,10 +3,12 @@ package exit
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 
+	"github.com/high-moctane/milbot/botaudit"
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/botcrash"
 	"github.com/high-moctane/milbot/botlog"
 	"github.com/slack-go/slack"
 )
@@ -16,7 +18,7 @@ var validRegexp = regexp.MustCompile(`(?i)^milbot exit`)
 
 // Plugin は終了コマンドを受け付けるプラグインです
 type Plugin struct {
-	client *slack.Client
+	client *botclient.Client
 }
 
 // New でプラグインを生成します。
@@ -24,8 +26,18 @@ func New() *Plugin {
 	return new(Plugin)
 }
 
+// Name はプラグインの名前を返します。
+func (*Plugin) Name() string {
+	return "exit"
+}
+
+// Commands はプラグインが受け付けるコマンドを返します。
+func (*Plugin) Commands() []string {
+	return []string{"exit"}
+}
+
 // Start でプラグインを有効化します。
-func (p *Plugin) Start(client *slack.Client) error {
+func (p *Plugin) Start(client *botclient.Client) error {
 	p.client = client
 	return nil
 }
@@ -37,6 +49,8 @@ func (p *Plugin) Serve(ctx context.Context, event slack.RTMEvent) error {
 	}
 
 	defer os.Exit(0)
+	defer botcrash.Finish()
+	defer botlog.Flush(ctx)
 
 	ev, _ := event.Data.(*slack.MessageEvent)
 	user, err := p.getUserNameContext(ctx, ev)
@@ -44,6 +58,17 @@ func (p *Plugin) Serve(ctx context.Context, event slack.RTMEvent) error {
 		return fmt.Errorf("exit failed: %w", err)
 	}
 
+	err = botaudit.Record(botaudit.Entry{
+		UserID:   ev.User,
+		UserName: user,
+		Channel:  ev.Channel,
+		Command:  "exit",
+		Outcome:  botaudit.OutcomeOK,
+	})
+	if err != nil {
+		botlog.Error("record audit failed", "error", err)
+	}
+
 	_, _, _, err = p.client.SendMessageContext(
 		ctx,
 		ev.Channel,
@@ -52,8 +77,7 @@ func (p *Plugin) Serve(ctx context.Context, event slack.RTMEvent) error {
 	if err != nil {
 		return fmt.Errorf("exit failed: %v", err)
 	}
-	log.Printf("received exit command by %s", user)
-	botlog.SendfContext(ctx, "received exit command by %s", user)
+	botlog.LogContext(ctx, botlog.LevelWarn, "received exit command", "user", user)
 	return nil
 }
 
@@ -75,10 +99,6 @@ func (*Plugin) isValidEvent(event slack.RTMEvent) bool {
 		return false
 	}
 
-	if ev.BotID != "" {
-		return false
-	}
-
 	return validRegexp.MatchString(ev.Text)
 }
 
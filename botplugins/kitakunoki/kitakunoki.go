@@ -3,10 +3,14 @@ package kitakunoki
 import (
 	"context"
 	"fmt"
-	"log"
 	"math/rand"
+	"sync"
 	"time"
 
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/botcrash"
+	"github.com/high-moctane/milbot/botlog"
+	"github.com/high-moctane/milbot/botplugin"
 	"github.com/high-moctane/milbot/libatnd"
 	"github.com/robfig/cron/v3"
 	"github.com/slack-go/slack"
@@ -17,19 +21,29 @@ const cronSchedule = "* 21 * * *"
 
 // Plugin は帰宅を促します。
 type Plugin struct {
-	client       *slack.Client
+	client       *botclient.Client
 	kitakunoList []*kitakunoEntry
 	cron         *cron.Cron
 	atnd         *libatnd.Atnd
+
+	// occupied は研究室に誰かいるかどうかです。atnd のイベントで更新します。
+	muOccupied *sync.RWMutex
+	occupied   bool
+	cancel     context.CancelFunc
+}
+
+// New でプラグインを生成します。a に在室管理に使う Atnd を与えます。
+func New(a *libatnd.Atnd) *Plugin {
+	return &Plugin{atnd: a, muOccupied: new(sync.RWMutex)}
 }
 
-// New でプラグインを生成します。
-func New() *Plugin {
-	return new(Plugin)
+// Name はプラグインの名前を返します。
+func (*Plugin) Name() string {
+	return "kitakunoki"
 }
 
 // Start でプラグインを有効化します。
-func (p *Plugin) Start(client *slack.Client) error {
+func (p *Plugin) Start(client *botclient.Client) error {
 	p.client = client
 
 	kitakunoList, err := kitakunoList()
@@ -38,12 +52,16 @@ func (p *Plugin) Start(client *slack.Client) error {
 	}
 	p.kitakunoList = kitakunoList
 
-	p.atnd = libatnd.Instance()
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go p.watchLab(p.atnd.Subscribe(ctx))
 
 	p.cron = cron.New()
 	p.cron.AddFunc(cronSchedule, func() {
+		defer botcrash.Recover()
+
 		if err := p.kitakunoDo(); err != nil {
-			log.Print(err)
+			botlog.Error("kitakunoki failed", "error", err)
 		}
 	})
 	p.cron.Start()
@@ -51,13 +69,35 @@ func (p *Plugin) Start(client *slack.Client) error {
 	return nil
 }
 
+// watchLab は atnd のイベントで研究室に誰かいるかどうかを更新します。
+func (p *Plugin) watchLab(events <-chan libatnd.Event) {
+	defer botcrash.Recover()
+
+	for ev := range events {
+		switch ev.Type {
+		case libatnd.EventLabOccupied:
+			p.setOccupied(true)
+		case libatnd.EventLabEmpty:
+			p.setOccupied(false)
+		}
+	}
+}
+
+// setOccupied は研究室に誰かいるかどうかを記録します。
+func (p *Plugin) setOccupied(occupied bool) {
+	p.muOccupied.Lock()
+	defer p.muOccupied.Unlock()
+
+	p.occupied = occupied
+}
+
 // kitakunoDo は研究室に人がいる場合に kitakunoPost します。
+// 在室状況は定時の在室確認のイベントで知るので，ここでは在室確認をしません。
 func (p *Plugin) kitakunoDo() error {
-	attendance, err := p.atnd.Search()
-	if err != nil {
-		return fmt.Errorf("kitakuno do failed: %w", err)
-	}
-	if len(attendance) == 0 {
+	p.muOccupied.RLock()
+	occupied := p.occupied
+	p.muOccupied.RUnlock()
+	if !occupied {
 		return nil
 	}
 
@@ -93,13 +133,24 @@ func (p *Plugin) randomKitakunoki() *kitakunoEntry {
 	return p.kitakunoList[idx]
 }
 
+// Subscription は何もイベントを受け取らないことを示します。
+func (p *Plugin) Subscription() botplugin.Subscription {
+	return botplugin.Subscription{}
+}
+
 // Serve はとくに何もしません。
 func (p *Plugin) Serve(_ context.Context, _ slack.RTMEvent) error {
 	return nil
 }
 
-// Stop はとくになにもしません。
+// Stop は帰宅の木のスケジュールとイベントの購読を止めます。
 func (p *Plugin) Stop() error {
+	if p.cron != nil {
+		p.cron.Stop()
+	}
+	if p.cancel != nil {
+		p.cancel()
+	}
 	return nil
 }
 
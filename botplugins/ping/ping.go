@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 
+	"github.com/high-moctane/milbot/botclient"
 	"github.com/slack-go/slack"
 )
 
@@ -13,7 +14,7 @@ var validRegexp = regexp.MustCompile(`(?i)^milbot ping`)
 
 // Plugin は ping に pong するプラグインです。
 type Plugin struct {
-	client *slack.Client
+	client *botclient.Client
 }
 
 // New でプラグインを生成します。
@@ -21,8 +22,18 @@ func New() *Plugin {
 	return new(Plugin)
 }
 
+// Name はプラグインの名前を返します。
+func (*Plugin) Name() string {
+	return "ping"
+}
+
+// Commands はプラグインが受け付けるコマンドを返します。
+func (*Plugin) Commands() []string {
+	return []string{"ping"}
+}
+
 // Start でプラグインを有効化します。
-func (p *Plugin) Start(client *slack.Client) error {
+func (p *Plugin) Start(client *botclient.Client) error {
 	p.client = client
 	return nil
 }
@@ -51,10 +62,6 @@ func (*Plugin) isValidEvent(event slack.RTMEvent) bool {
 	if !ok {
 		return false
 	}
-	if ev.BotID != "" {
-		return false
-	}
-
 	return validRegexp.MatchString(ev.Text)
 }
 
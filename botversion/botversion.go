@@ -0,0 +1,24 @@
+// Package botversion はビルド時に埋め込まれる milbot のバージョン情報です。
+//
+// ビルド時に以下のように -ldflags で値を埋め込みます。
+//
+//	go build -ldflags "-X github.com/high-moctane/milbot/botversion.Version=v1.0.0"
+package botversion
+
+import "runtime"
+
+// Version は milbot のバージョンです。
+var Version = "unknown"
+
+// Commit はビルドしたコミットのハッシュです。
+var Commit = "unknown"
+
+// GoVersion はビルドに使った Go のバージョンです。
+func GoVersion() string {
+	return runtime.Version()
+}
+
+// String はバージョン情報を人間が読める形で返します。
+func String() string {
+	return Version + " (" + Commit + ", " + GoVersion() + ")"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/high-moctane/milbot/botplugin"
+)
+
+// maxSuggestDistance はコマンドの候補として提案する編集距離の最大値です。
+const maxSuggestDistance = 2
+
+// commandRouter はコマンドをそれを持つプラグインに対応させます。
+type commandRouter struct {
+	owners   map[string]botplugin.Plugin
+	commands []string
+}
+
+// newCommandRouter は plugins のコマンドから commandRouter を作ります。
+// 同じコマンドを複数のプラグインが持っている場合はエラーを返します。
+func newCommandRouter(plugins []botplugin.Plugin) (*commandRouter, error) {
+	r := &commandRouter{owners: map[string]botplugin.Plugin{}}
+
+	conflicts := []string{}
+	for _, plg := range plugins {
+		cmdr, ok := plg.(botplugin.Commander)
+		if !ok {
+			continue
+		}
+		for _, cmd := range cmdr.Commands() {
+			cmd = normalizeCommand(cmd)
+			if owner, ok := r.owners[cmd]; ok {
+				conflicts = append(conflicts,
+					fmt.Sprintf("%q (%s, %s)", cmd, owner.Name(), plg.Name()))
+				continue
+			}
+			r.owners[cmd] = plg
+			r.commands = append(r.commands, cmd)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("command conflict: %s", strings.Join(conflicts, ", "))
+	}
+
+	sort.Strings(r.commands)
+	return r, nil
+}
+
+// route は text のコマンドを持つプラグインを返します。
+// isCommand は text が CommandPrefix で始まるかどうかです。
+// コマンドであるのに対応するプラグインがない場合は plg が nil になります。
+func (r *commandRouter) route(text string) (plg botplugin.Plugin, isCommand bool) {
+	words, isCommand := commandWords(text)
+	if !isCommand {
+		return nil, false
+	}
+
+	longest := 0
+	for _, cmd := range r.commands {
+		n := len(strings.Fields(cmd))
+		if n <= longest || n > len(words) {
+			continue
+		}
+		if strings.Join(words[:n], " ") == cmd {
+			plg, longest = r.owners[cmd], n
+		}
+	}
+	return plg, true
+}
+
+// suggest は text に近いコマンドを近い順に返します。
+func (r *commandRouter) suggest(text string) []string {
+	words, isCommand := commandWords(text)
+	if !isCommand || len(words) == 0 {
+		return nil
+	}
+
+	best := maxSuggestDistance + 1
+	res := []string{}
+	for _, cmd := range r.commands {
+		n := len(strings.Fields(cmd))
+		if n > len(words) {
+			continue
+		}
+
+		d := editDistance(strings.Join(words[:n], " "), cmd)
+		if d < best {
+			best, res = d, []string{cmd}
+		} else if d == best {
+			res = append(res, cmd)
+		}
+	}
+	return res
+}
+
+// commandWords は text が CommandPrefix で始まる場合にそれに続く単語を返します。
+func commandWords(text string) (words []string, isCommand bool) {
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) == 0 || fields[0] != botplugin.CommandPrefix {
+		return nil, false
+	}
+	return fields[1:], true
+}
+
+// normalizeCommand はコマンドの大文字小文字と空白を揃えます。
+func normalizeCommand(cmd string) string {
+	return strings.Join(strings.Fields(strings.ToLower(cmd)), " ")
+}
+
+// editDistance は a と b のレーベンシュタイン距離を返します。
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// min3 は a, b, c のうち最小のものを返します。
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/botplugin"
+	"github.com/slack-go/slack"
+)
+
+// commandPlugin はテスト用のコマンドを持つプラグインです。
+type commandPlugin struct {
+	name     string
+	commands []string
+}
+
+func (p *commandPlugin) Name() string                                { return p.name }
+func (p *commandPlugin) Commands() []string                          { return p.commands }
+func (p *commandPlugin) Start(*botclient.Client) error               { return nil }
+func (p *commandPlugin) Serve(context.Context, slack.RTMEvent) error { return nil }
+func (p *commandPlugin) Stop() error                                 { return nil }
+func (p *commandPlugin) Help() string                                { return "" }
+
+func TestCommandRouterRoute(t *testing.T) {
+	atnd := &commandPlugin{name: "atnd", commands: []string{"atnd", "atnd set"}}
+	ping := &commandPlugin{name: "ping", commands: []string{"ping"}}
+	router, err := newCommandRouter([]botplugin.Plugin{atnd, ping})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text      string
+		plg       botplugin.Plugin
+		isCommand bool
+	}{
+		{"milbot atnd", atnd, true},
+		{"Milbot  ATND set foo 01:23:45:67:89:ab", atnd, true},
+		{"milbot ping", ping, true},
+		{"milbot atdn", nil, true},
+		{"milbot pingpong", nil, true},
+		{"milbot", nil, true},
+		{"hello milbot ping", nil, false},
+		{"", nil, false},
+	}
+
+	for idx, test := range tests {
+		plg, isCommand := router.route(test.text)
+		if plg != test.plg || isCommand != test.isCommand {
+			t.Errorf("[%d] expected (%v, %v), got (%v, %v)", idx, test.plg, test.isCommand, plg, isCommand)
+		}
+	}
+}
+
+func TestCommandRouterConflict(t *testing.T) {
+	a := &commandPlugin{name: "a", commands: []string{"foo"}}
+	b := &commandPlugin{name: "b", commands: []string{"FOO"}}
+	if _, err := newCommandRouter([]botplugin.Plugin{a, b}); err == nil {
+		t.Error("expected conflict error")
+	}
+}
+
+func TestCommandRouterSuggest(t *testing.T) {
+	router, err := newCommandRouter([]botplugin.Plugin{
+		&commandPlugin{name: "atnd", commands: []string{"atnd", "atnd set", "atnd list"}},
+		&commandPlugin{name: "ping", commands: []string{"ping"}},
+		&commandPlugin{name: "help", commands: []string{"help"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		res  []string
+	}{
+		{"milbot atdn", []string{"atnd"}},
+		{"milbot pnig", []string{"ping"}},
+		{"milbot hlep me", []string{"help"}},
+		{"milbot pong", []string{"ping"}},
+		{"milbot something", []string{}},
+	}
+
+	for idx, test := range tests {
+		if res := router.suggest(test.text); !reflect.DeepEqual(res, test.res) {
+			t.Errorf("[%d] expected %v, got %v", idx, test.res, res)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		d    int
+	}{
+		{"", "", 0},
+		{"atnd", "atnd", 0},
+		{"atdn", "atnd", 2},
+		{"atn", "atnd", 1},
+		{"kitten", "sitting", 3},
+		{"在室", "在室確認", 2},
+	}
+
+	for idx, test := range tests {
+		if d := editDistance(test.a, test.b); d != test.d {
+			t.Errorf("[%d] expected %d, got %d", idx, test.d, d)
+		}
+	}
+}
@@ -7,7 +7,7 @@ require (
 	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/joho/godotenv v1.3.0
 	github.com/robfig/cron/v3 v3.0.1
-	github.com/slack-go/slack v0.6.3
+	github.com/slack-go/slack v0.10.1
 	github.com/stretchr/testify v1.5.1 // indirect
 	golang.org/x/text v0.3.2
 )
@@ -6,13 +6,14 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/high-moctane/milbot/botclient"
 	"github.com/high-moctane/milbot/botplugin"
 	"github.com/slack-go/slack"
 )
 
 // HelpPlugin はヘルプメッセージを返すプラグインです
 type HelpPlugin struct {
-	client      *slack.Client
+	client      *botclient.Client
 	plugins     []botplugin.Plugin
 	validRegexp *regexp.Regexp
 }
@@ -25,8 +26,18 @@ func NewHelpPlugin(plugins []botplugin.Plugin) *HelpPlugin {
 	}
 }
 
+// Name はプラグインの名前を返します。
+func (*HelpPlugin) Name() string {
+	return "help"
+}
+
+// Commands はプラグインが受け付けるコマンドを返します。
+func (*HelpPlugin) Commands() []string {
+	return []string{"help"}
+}
+
 // Start でプラグインを有効化します。
-func (p *HelpPlugin) Start(client *slack.Client) error {
+func (p *HelpPlugin) Start(client *botclient.Client) error {
 	p.client = client
 	return nil
 }
@@ -55,9 +66,6 @@ func (p *HelpPlugin) isValidEvent(event slack.RTMEvent) bool {
 	if !ok {
 		return false
 	}
-	if ev.BotID != "" {
-		return false
-	}
 	return p.validRegexp.MatchString(ev.Text)
 }
 
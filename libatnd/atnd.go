@@ -1,7 +1,6 @@
 package libatnd
 
 import (
-	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
@@ -10,15 +9,15 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/high-moctane/milbot/botcrash"
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/high-moctane/milbot/botlog"
 	"github.com/robfig/cron/v3"
 )
 
@@ -37,16 +36,21 @@ const encKeyPerm = 0600
 // cronSearchSchedule は cron で Search をするスケジュールです。
 const cronSearchSchedule = "*/5 * * * *"
 
-// atnd は Atnd のシングルトンです。
+// defaultScanConcurrency は同時に在室判定をするメンバーの数のデフォルト値です。
+const defaultScanConcurrency = 4
+
+// defaultProbeTimeout はひとりの在室判定のタイムアウト時間のデフォルト値です。
+const defaultProbeTimeout = 15 * time.Second
+
+// defaultScanDeadline は Search 全体の期限のデフォルト値です。
+// milbot のプラグインのタイムアウトより十分短くしてください。
+const defaultScanDeadline = 60 * time.Second
+
+// atnd は Instance が返す Atnd です。
 var atnd *Atnd
 
-func init() {
-	var err error
-	atnd, err = newAtnd()
-	if err != nil {
-		log.Fatal("create Atnd error:", err)
-	}
-}
+// onceInstance は atnd を一度だけ作ります。
+var onceInstance = new(sync.Once)
 
 // InvalidNameError は name が使えないときのエラーです。
 type InvalidNameError struct {
@@ -103,74 +107,178 @@ func IsValidMACAddress(addr string) bool {
 	return true
 }
 
-// ErrL2pingNotFound は l2ping が $PATH にないときのエラーです。
-var ErrL2pingNotFound = errors.New("l2ping not found in $PATH")
-
 // Atnd は在室判定をする構造体です。
 type Atnd struct {
-	// 設定ファイルのパスです。
+	// 設定ファイルと暗号化キーファイルのパスです。
 	confPath string
+	keyPath  string
+
+	// now は今の時間を返します。
+	now func() time.Time
 
 	// 設定ファイルの中身です。
 	muConfig *sync.RWMutex
 	config   *config
 
-	// Bluetooth アドレスを暗号化するキーです。
-	encKey []byte
+	// configBackups は設定ファイルのバックアップを残す数です。
+	// lockFile はほかの milbot が同じ設定ファイルを使わないようにロックしているファイルです。
+	configBackups int
+	lockFile      *os.File
+
+	// 機器のアドレスを暗号化するキーです。muConfig で守ります。
+	// keyFixed はキーを Options.Key で渡されていて，キーファイルを使わないかどうかです。
+	// keyMismatch は今のキーが設定ファイルのキーの ID と違い，暗号化しないかどうかです。
+	encKey      []byte
+	keyFixed    bool
+	keyMismatch bool
+
+	// メンバーがいるかどうかを判定します。detectors は機器の Detector の種類ごとの Detector です。
+	detector  Detector
+	detectors map[string]Detector
+
+	// メンバーごとの在室状態です。
+	presence       *presenceTracker
+	missThreshold  int
+	departureGrace time.Duration
 
-	// メンバーの名前と最後に観測した時間との対応。
-	// Bot の起動から観測してない場合は nil が入る。
-	muStatus *sync.RWMutex
-	status   map[string]*time.Time
+	// 在室履歴です。
+	history *history
+
+	// 在室のイベントを配ります。
+	events *eventBus
+	lab    labState
+
+	// バックグラウンドで受信を続ける Detector です。
+	watches *watchState
 
 	// Search は同時に実行できないのでセマフォを使います。
+	// メンバーの在室判定は scanConcurrency 人まで同時にできます。
 	semaSearch       chan struct{}
 	semaSearchMember chan struct{}
 
-	cron *cron.Cron
+	scanConcurrency int
+	probeTimeout    time.Duration
+	scanDeadline    time.Duration
+
+	// 最後に Search した結果です。
+	muScan   *sync.RWMutex
+	lastScan ScanInfo
+
+	// scheduler は定時の Search を実行します。ownCron は New で作ったときの scheduler です。
+	scheduler    Scheduler
+	ownCron      *cron.Cron
+	cronSearchID cron.EntryID
 }
 
-// Instance はシングルトンの Atnd を返します。
+// Instance は環境変数の設定で作った Atnd を返します。最初に呼んだときに作ります。
+// 作れなかったときはクラッシュレポートを書いて終了します。
+//
+// Deprecated: New で作った Atnd を使ってください。
 func Instance() *Atnd {
+	onceInstance.Do(func() {
+		opts, err := OptionsFromEnv()
+		if err != nil {
+			botcrash.Fatal("create Atnd error: ", err)
+		}
+		atnd, err = New(opts)
+		if err != nil {
+			botcrash.Fatal("create Atnd error: ", err)
+		}
+	})
 	return atnd
 }
 
-// newAttend は Atnd を作って返します。
-func newAtnd() (*Atnd, error) {
-	a := new(Atnd)
-
-	var err error
-	a.confPath, err = a.configPath()
+// New は opts の設定で Atnd を作ります。設定ファイルと暗号化キーファイルが無ければ作ります。
+// opts.Scheduler が nil のときは cron を起動して定時の Search をするので，
+// 使い終わったら Close を呼んでください。
+func New(opts Options) (*Atnd, error) {
+	opts, err := opts.withDefaults()
 	if err != nil {
 		return nil, fmt.Errorf("create new Atnd failed: %w", err)
 	}
-	if err := a.initConfig(); err != nil {
-		return nil, fmt.Errorf("create new Atnd failed: %w", err)
+
+	a := &Atnd{
+		confPath:        opts.ConfigPath,
+		keyPath:         opts.KeyPath,
+		configBackups:   opts.ConfigBackups,
+		now:             opts.Clock,
+		detector:        opts.Detector,
+		detectors:       opts.Detectors,
+		scanConcurrency: opts.ScanConcurrency,
+		probeTimeout:    opts.ProbeTimeout,
+		scanDeadline:    opts.ScanDeadline,
+		missThreshold:   opts.MissThreshold,
+		departureGrace:  opts.DepartureGrace,
+		scheduler:       opts.Scheduler,
 	}
 
-	if err := a.initEncKey(); err != nil {
+	if err := a.lockConfig(); err != nil {
+		return nil, fmt.Errorf("create new Atnd failed: %w", err)
+	}
+	if err := a.init(opts); err != nil {
+		a.unlockConfig()
 		return nil, fmt.Errorf("create new Atnd failed: %w", err)
 	}
 
-	a.initStatus()
+	if a.ownCron != nil {
+		a.ownCron.Start()
+	}
 
-	a.semaSearch = make(chan struct{}, 1)
-	a.semaSearchMember = make(chan struct{}, 1)
+	return a, nil
+}
+
+// init は opts の設定ファイルや暗号化キーを読んで，定時の Search を登録します。
+func (a *Atnd) init(opts Options) error {
+	if err := a.initConfig(); err != nil {
+		return err
+	}
+	if err := a.initEncKey(opts.Key); err != nil {
+		return err
+	}
+	if err := a.checkKeyID(); err != nil {
+		return err
+	}
+	history, err := loadHistory(opts.HistoryPath, opts.HistoryRetention, a.now())
+	if err != nil {
+		return err
+	}
+	a.history = history
 
-	a.cron = cron.New()
-	a.addCronSearch()
-	a.cron.Start()
+	a.initState()
 
-	return a, nil
+	if a.scheduler == nil {
+		a.ownCron = cron.New()
+		a.scheduler = a.ownCron
+	}
+	return a.addCronSearch()
+}
+
+// Close は New で起動した cron とバックグラウンドの受信を止めて，設定ファイルのロックを外します。
+// 実行中の Search は待ちません。
+func (a *Atnd) Close() error {
+	if a.ownCron != nil {
+		a.ownCron.Stop()
+	}
+	if a.watches != nil {
+		a.watches.stop()
+	}
+	return a.unlockConfig()
 }
 
 // addCronSearch は定時でサーチするジョブを追加します
-func (a *Atnd) addCronSearch() {
-	a.cron.AddFunc(cronSearchSchedule, func() {
+func (a *Atnd) addCronSearch() error {
+	id, err := a.scheduler.AddFunc(cronSearchSchedule, func() {
+		defer botcrash.Recover()
+
 		if _, err := a.Search(); err != nil {
-			log.Print(err)
+			botlog.Warn("scheduled search failed", "error", err)
 		}
 	})
+	if err != nil {
+		return fmt.Errorf("add cron search failed: %w", err)
+	}
+	a.cronSearchID = id
+	return nil
 }
 
 // initConfig は必要であれば config ファイルを生成して a.config を初期化します。
@@ -205,7 +313,7 @@ func (a *Atnd) createConfigFile() error {
 		return fmt.Errorf("cannot create config file: %w", err)
 	}
 
-	if err := ioutil.WriteFile(a.confPath, append(bytes, '\n'), configPerm); err != nil {
+	if err := botdata.WriteFileAtomic(a.confPath, append(bytes, '\n'), configPerm); err != nil {
 		return fmt.Errorf("cannot create config file: %w", err)
 	}
 
@@ -213,13 +321,33 @@ func (a *Atnd) createConfigFile() error {
 }
 
 // loadConfigFile は設定ファイルをファイルから読みます。
+// 古いバージョンの設定ファイルならバックアップを書いてから今のバージョンに移行します。
 func (a *Atnd) loadConfigFile() (conf *config, err error) {
-	bytes, err := ioutil.ReadFile(a.confPath)
+	bytes, err := a.readConfigFile()
 	if err != nil {
 		err = fmt.Errorf("cannot load config file: %w", err)
 		return
 	}
 
+	version, migrated, err := migrateConfig(bytes)
+	if err != nil {
+		err = fmt.Errorf("cannot load config file: %w", err)
+		return
+	}
+	if version != configVersion {
+		backup, berr := a.backupConfig(bytes, version)
+		if berr != nil {
+			err = fmt.Errorf("cannot load config file: %w", berr)
+			return
+		}
+		if err = botdata.WriteFileAtomic(a.confPath, migrated, configPerm); err != nil {
+			err = fmt.Errorf("cannot load config file: %w", err)
+			return
+		}
+		botlog.Info("migrated atnd config", "from", version, "to", configVersion, "backup", backup)
+		bytes = migrated
+	}
+
 	if err = json.Unmarshal(bytes, &conf); err != nil {
 		err = fmt.Errorf("cannot load config file: %w", err)
 		return
@@ -235,37 +363,13 @@ func (a *Atnd) dumpConfig() error {
 		return fmt.Errorf("dump config error: %w", err)
 	}
 
-	if err := ioutil.WriteFile(a.confPath, append(bytes, '\n'), configPerm); err != nil {
+	if err := a.writeConfigFile(append(bytes, '\n')); err != nil {
 		return fmt.Errorf("dump config error: %w", err)
 	}
 
 	return nil
 }
 
-// configPath は設定ファイルの場所を返します。
-func (a *Atnd) configPath() (string, error) {
-	realExec, err := a.realExecPath()
-	if err != nil {
-		return "", fmt.Errorf("cannot get config path: %w", err)
-	}
-	return filepath.Join(filepath.Dir(realExec), configFileName), nil
-}
-
-// realExecDir は実行ファイルの実体のパスを返します。
-func (*Atnd) realExecPath() (string, error) {
-	executable, err := os.Executable()
-	if err != nil {
-		return "", fmt.Errorf("cannot get real executable path: %w", err)
-	}
-
-	realExec, err := filepath.EvalSymlinks(executable)
-	if err != nil {
-		return "", fmt.Errorf("cannot get real executable path: %w", err)
-	}
-
-	return realExec, nil
-}
-
 // generateNewKey は新しい暗号化キーを生成します。
 func (*Atnd) generateNewKey() ([]byte, error) {
 	key := make([]byte, 32)
@@ -275,24 +379,22 @@ func (*Atnd) generateNewKey() ([]byte, error) {
 	return key, nil
 }
 
-// encKeyPath は暗号化のキーファイルのパスを変えします。
-func (a *Atnd) encKeyPath() (string, error) {
-	realExec, err := a.realExecPath()
-	if err != nil {
-		return "", fmt.Errorf("cannot get enc key path: %w", err)
+// initEncEey は必要に応じてキーファイルを生成して encKey を初期化します。
+// given が nil でなければキーファイルを使わずに given を使います。
+func (a *Atnd) initEncKey(given []byte) error {
+	if given != nil {
+		if err := validateKey(given); err != nil {
+			return fmt.Errorf("init enc key failed: %w", err)
+		}
+		a.encKey = given
+		a.keyFixed = true
+		return nil
 	}
-	return filepath.Join(filepath.Dir(realExec), encKeyFileName), nil
-}
 
-// initEncEey は必要に応じてキーファイルを生成して encKey を初期化します。
-func (a *Atnd) initEncKey() error {
 	// キーファイルがなければ生成
-	encPath, err := a.encKeyPath()
-	if err != nil {
-		return fmt.Errorf("init enc key failed: %w", err)
-	}
+	encPath := a.keyPath
 
-	_, err = os.Stat(encPath)
+	_, err := os.Stat(encPath)
 	if os.IsNotExist(err) {
 		if err := a.createEncKeyFile(encPath); err != nil {
 			return fmt.Errorf("init enc key failed: %w", err)
@@ -305,6 +407,9 @@ func (a *Atnd) initEncKey() error {
 	if err != nil {
 		return fmt.Errorf("init enc key failed: %w", err)
 	}
+	if err := validateKey(key); err != nil {
+		return fmt.Errorf("init enc key failed: %w", err)
+	}
 
 	a.encKey = key
 	return nil
@@ -317,7 +422,7 @@ func (a *Atnd) createEncKeyFile(encPath string) error {
 		return fmt.Errorf("create enc key file failed: %w", err)
 	}
 
-	if err := ioutil.WriteFile(encPath, key, encKeyPerm); err != nil {
+	if err := botdata.WriteFileAtomic(encPath, key, encKeyPerm); err != nil {
 		return fmt.Errorf("create enc key failed: %w", err)
 	}
 
@@ -333,9 +438,18 @@ func (a *Atnd) loadEncKeyFile(encPath string) ([]byte, error) {
 	return key, nil
 }
 
-// encrypt は bytes を暗号化します。
+// encrypt は plain を今のキーで暗号化します。呼び出し側で muConfig をロックしてください。
+// 今のキーが設定ファイルと違うときは ErrKeyMismatch を返します。
 func (a *Atnd) encrypt(plain string) ([]byte, error) {
-	block, err := aes.NewCipher(a.encKey)
+	if a.keyMismatch {
+		return nil, ErrKeyMismatch
+	}
+	return encryptWithKey(a.encKey, plain)
+}
+
+// encryptWithKey は plain を key で暗号化します。
+func encryptWithKey(key []byte, plain string) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("encrypt error: %w", err)
 	}
@@ -356,9 +470,14 @@ func (a *Atnd) encrypt(plain string) ([]byte, error) {
 	return encrypted, nil
 }
 
-// decrypt は encrypted をデコードします。
+// decrypt は encrypted を今のキーで復号します。呼び出し側で muConfig をロックしてください。
 func (a *Atnd) decrypt(encrypted []byte) (string, error) {
-	block, err := aes.NewCipher(a.encKey)
+	return decryptWithKey(a.encKey, encrypted)
+}
+
+// decryptWithKey は encrypted を key で復号します。
+func decryptWithKey(key []byte, encrypted []byte) (string, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", fmt.Errorf("decrypt error: %w", err)
 	}
@@ -368,6 +487,9 @@ func (a *Atnd) decrypt(encrypted []byte) (string, error) {
 		return "", fmt.Errorf("decrypt error: %w", err)
 	}
 
+	if len(encrypted) < gcm.NonceSize() {
+		return "", fmt.Errorf("decrypt error: too short ciphertext")
+	}
 	nonce := encrypted[:gcm.NonceSize()]
 	plain, err := gcm.Open(nil, nonce, encrypted[gcm.NonceSize():], nil)
 	if err != nil {
@@ -377,13 +499,37 @@ func (a *Atnd) decrypt(encrypted []byte) (string, error) {
 	return string(plain), nil
 }
 
-// initStatus は a.config から a.status を初期化します。
-func (a *Atnd) initStatus() {
-	a.muStatus = new(sync.RWMutex)
+// initState は a.config から Search に使う状態を初期化します。
+func (a *Atnd) initState() {
+	a.initStatus()
+
+	a.semaSearch = make(chan struct{}, 1)
+	a.semaSearchMember = make(chan struct{}, a.scanConcurrency)
 
-	a.status = map[string]*time.Time{}
+	a.muScan = new(sync.RWMutex)
+	a.events = newEventBus()
+	a.watches = newWatchState()
+}
+
+// initStatus は a.config からメンバーの在室状態を初期化します。
+func (a *Atnd) initStatus() {
+	names := []string{}
 	for _, member := range a.config.Members {
-		a.status[member.Name] = nil
+		names = append(names, member.Name)
+	}
+	a.presence = newPresenceTracker(a.missThreshold, a.departureGrace, names)
+
+	// 在室履歴から前回の在室状態を戻します。止まっていた間に DepartureGrace 以上経っていたら，
+	// 最後に見つかった時間に退室したことにします。
+	now := a.now()
+	for _, s := range a.history.latest() {
+		if s.Ongoing() && now.Sub(s.LastSeen) >= a.departureGrace {
+			if err := a.history.departed(s.Member, s.LastSeen); err != nil {
+				botlog.Error("record history failed", "member", s.Member, "error", err)
+			}
+			s.Departed = s.LastSeen
+		}
+		a.presence.restore(s)
 	}
 }
 
@@ -391,14 +537,11 @@ func (a *Atnd) initStatus() {
 func (a *Atnd) Status() []*Attendance {
 	res := []*Attendance{}
 
-	a.muStatus.RLock()
-	defer a.muStatus.RUnlock()
-
-	for name, atndTime := range a.status {
-		if atndTime == nil {
+	for _, p := range a.presence.all() {
+		if p.LastSeen.IsZero() {
 			continue
 		}
-		res = append(res, &Attendance{Name: name, Time: *atndTime})
+		res = append(res, &Attendance{Name: p.Name, Time: p.LastSeen})
 	}
 
 	sort.Slice(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
@@ -406,58 +549,46 @@ func (a *Atnd) Status() []*Attendance {
 	return res
 }
 
-// SetMember は name を addr の状態にセットします。
-func (a *Atnd) SetMember(name, addr string) error {
-	if name == "" {
-		return InvalidNameError{Name: name}
-	}
-	if !IsValidMACAddress(addr) {
-		return InvalidMACAddressError{Address: addr}
-	}
-
-	encryptedAddr, err := a.encrypt(addr)
-	if err != nil {
-		return fmt.Errorf("set member error: %w", err)
-	}
-
-	a.muConfig.Lock()
-	defer a.muConfig.Unlock()
-
-	found := false
-	for _, mem := range a.config.Members {
-		if mem.Name == name {
-			found = true
-			break
-		}
+// Presence は name の在室状態を返します。
+func (a *Atnd) Presence(name string) (*Presence, error) {
+	p, ok := a.presence.get(name)
+	if !ok {
+		return nil, MemberNotExistError{Name: name}
 	}
+	return p, nil
+}
 
-	if found {
-		a.updateMember(name, encryptedAddr)
-	} else {
-		a.addMember(name, encryptedAddr)
-	}
+// Presences はすべてのメンバーの在室状態を名前順に返します。
+func (a *Atnd) Presences() []*Presence {
+	return a.presence.all()
+}
 
-	if err := a.dumpConfig(); err != nil {
+// SetMember は name の Bluetooth アドレスを addr にセットします。
+// name のメンバーがいなければ追加します。
+func (a *Atnd) SetMember(name, addr string) error {
+	err := a.setDevice(name, BluetoothDevice(addr), true)
+	if err != nil {
 		return fmt.Errorf("set member error: %w", err)
 	}
-
 	return nil
 }
 
-// addMember はメンバー情報を追加します。
-func (a *Atnd) addMember(name string, encryptedAddr []byte) {
-	newMember := member{Name: name, EncryptedAddress: encryptedAddr}
-	a.config.Members = append(a.config.Members, &newMember)
+// addMember は機器のないメンバーを追加します。a.muConfig をロックしてから呼んでください。
+func (a *Atnd) addMember(name string) *member {
+	newMember := &member{Name: name, Devices: []*device{}}
+	a.config.Members = append(a.config.Members, newMember)
+	a.presence.add(name)
+	return newMember
 }
 
-// updateMember は name の addr を変更します。
-func (a *Atnd) updateMember(name string, encryptedAddr []byte) {
-	for i := range a.config.Members {
-		if a.config.Members[i].Name == name {
-			a.config.Members[i].EncryptedAddress = encryptedAddr
-			return
-		}
+// SetMemberWiFi は name の Wi-Fi の MAC アドレスを addr にセットします。
+// name のメンバーがいなければ Wi-Fi だけのメンバーとして追加します。
+func (a *Atnd) SetMemberWiFi(name, addr string) error {
+	err := a.setDevice(name, WiFiDevice(addr), true)
+	if err != nil {
+		return fmt.Errorf("set member wifi error: %w", err)
 	}
+	return nil
 }
 
 // DeleteMember は name のメンバーを消し去ります。
@@ -471,6 +602,7 @@ func (a *Atnd) DeleteMember(name string) error {
 			if err := a.dumpConfig(); err != nil {
 				return fmt.Errorf("delete member error: %w", err)
 			}
+			a.presence.remove(name)
 			return nil
 		}
 	}
@@ -479,9 +611,20 @@ func (a *Atnd) DeleteMember(name string) error {
 }
 
 // SearchContext はメンバーをサーチして出席している人のリストを返します。
+// 一部のメンバーしか判定できなかったときは判定できた分だけを返します。
+// 判定できなかったメンバーも知りたいときは ScanContext を使ってください。
 func (a *Atnd) SearchContext(ctx context.Context) ([]*Attendance, error) {
-	res := []*Attendance{}
+	res, err := a.ScanContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return res.Attendance, nil
+}
 
+// ScanContext はメンバーを並行してサーチします。期限までに判定できなかったメンバーや
+// 判定に失敗したメンバーは ScanResult.Unscanned に入ります。
+// 判定しようとしたメンバー全員が失敗したときだけエラーを返します。
+func (a *Atnd) ScanContext(ctx context.Context) (*ScanResult, error) {
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -489,25 +632,100 @@ func (a *Atnd) SearchContext(ctx context.Context) ([]*Attendance, error) {
 	case a.semaSearch <- struct{}{}:
 		defer func() { <-a.semaSearch }()
 
-		a.muConfig.RLock()
-		members := make([]*member, len(a.config.Members))
-		copy(members, a.config.Members)
-		a.muConfig.RUnlock()
+		start := a.now()
+		res, err := a.scanMembers(ctx)
+		a.updateScanInfo(start, a.now().Sub(start), res, err)
+		a.publishScan(res, err, a.now())
+		return res, err
+	}
+}
 
-		for _, mem := range members {
-			attendance, err := a.SearchMemberContext(ctx, mem.Name)
-			if err != nil {
-				return nil, fmt.Errorf("search failed: %w", err)
+// scanMembers は登録されているメンバーを scanConcurrency 人まで並行してサーチします。
+// scanDeadline を過ぎたらまだ判定していないメンバーを残して終わります。
+func (a *Atnd) scanMembers(ctx context.Context) (*ScanResult, error) {
+	a.muConfig.RLock()
+	members := make([]*member, len(a.config.Members))
+	copy(members, a.config.Members)
+	a.muConfig.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, a.scanDeadline)
+	defer cancel()
+
+	attendance := make([]*Attendance, len(members))
+	errs := make([]error, len(members))
+
+	// 登録順に判定するように，scanConcurrency 個の worker で順に取り出します。
+	indices := make(chan int, len(members))
+	for i := range members {
+		indices <- i
+	}
+	close(indices)
+
+	wg := new(sync.WaitGroup)
+	for w := 0; w < a.scanConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer botcrash.Recover()
+			defer wg.Done()
+			for i := range indices {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				attendance[i], errs[i] = a.SearchMemberContext(ctx, members[i].Name)
 			}
-			if attendance != nil {
-				res = append(res, attendance)
+		}()
+	}
+	wg.Wait()
+
+	res := &ScanResult{Attendance: []*Attendance{}, Unscanned: []string{}, Errors: map[string]error{}}
+	var firstErr error
+	for i, mem := range members {
+		if errs[i] == nil {
+			if attendance[i] != nil {
+				res.Attendance = append(res.Attendance, attendance[i])
 			}
+			continue
+		}
+
+		res.Unscanned = append(res.Unscanned, mem.Name)
+		if ctx.Err() != nil && errors.Is(errs[i], ctx.Err()) {
+			continue
+		}
+		res.Errors[mem.Name] = errs[i]
+		if firstErr == nil {
+			firstErr = errs[i]
 		}
 	}
 
+	if firstErr != nil && len(res.Errors) == len(members) {
+		return res, fmt.Errorf("search failed: %w", firstErr)
+	}
 	return res, nil
 }
 
+// updateScanInfo は最後の Search の結果を記録します。
+func (a *Atnd) updateScanInfo(start time.Time, duration time.Duration, res *ScanResult, err error) {
+	a.muScan.Lock()
+	defer a.muScan.Unlock()
+
+	a.lastScan = ScanInfo{Start: start, Duration: duration, Err: err}
+	if res != nil {
+		a.lastScan.Unscanned = res.Unscanned
+	}
+}
+
+// ScanInfo は最後の Search の結果と次の定時 Search の時刻を返します。
+// まだ一度も Search していない場合は Start がゼロ値になります。
+func (a *Atnd) ScanInfo() ScanInfo {
+	a.muScan.RLock()
+	info := a.lastScan
+	a.muScan.RUnlock()
+
+	info.Next = a.scheduler.Entry(a.cronSearchID).Next
+	return info
+}
+
 // Search はメンバーをサーチして出席している人のリストを返します。
 func (a *Atnd) Search() ([]*Attendance, error) {
 	return a.SearchContext(context.Background())
@@ -515,12 +733,12 @@ func (a *Atnd) Search() ([]*Attendance, error) {
 
 // SearchMemberContext はひとりのメンバーをサーチします。いなかったら nil です。
 func (a *Atnd) SearchMemberContext(ctx context.Context, name string) (*Attendance, error) {
-	encryptedAddr, err := a.findAddr(name)
-	if err != nil {
-		return nil, fmt.Errorf("search member failed: %w", err)
-	}
-	addr, err := a.decrypt(encryptedAddr)
-	if err != nil {
+	// 復号できない機器があっても，ほかの機器で判定できれば判定します。
+	devices, err := a.findDevices(name)
+	var decryptErr DecryptError
+	if errors.As(err, &decryptErr) && len(devices) > 0 {
+		botlog.Warn("some devices cannot be decrypted", "member", name, "labels", decryptErr.Labels)
+	} else if err != nil {
 		return nil, fmt.Errorf("search member failed: %w", err)
 	}
 
@@ -531,60 +749,36 @@ func (a *Atnd) SearchMemberContext(ctx context.Context, name string) (*Attendanc
 	case a.semaSearchMember <- struct{}{}:
 		defer func() { <-a.semaSearchMember }()
 
-		exist, err := a.sendPing(ctx, addr)
+		probeCtx, cancel := context.WithTimeout(ctx, a.probeTimeout)
+		defer cancel()
+
+		res, err := a.detectDevices(probeCtx, name, devices)
 		if err != nil {
 			return nil, fmt.Errorf("search member failed: %w", err)
 		}
+		botlog.Debug("member probed", "member", name, "present", res.Present, "reason", res.Reason)
 
-		if exist {
-			now := time.Now()
-			a.updateStatus(name, &now)
-			return &Attendance{Name: name, Time: now}, nil
+		now := a.now()
+		from, to := a.presence.observe(name, res.Present, now)
+		if from != to {
+			botlog.Debug("member state changed", "member", name, "from", from, "to", to)
+			a.publishTransition(name, from, to, now)
 		}
-	}
-
-	return nil, nil
-}
-
-// findAddr は name に対応する暗号化された address を返します。
-func (a *Atnd) findAddr(name string) ([]byte, error) {
-	a.muConfig.RLock()
-	defer a.muConfig.RUnlock()
-
-	for _, mem := range a.config.Members {
-		if mem.Name == name {
-			return mem.EncryptedAddress, nil
+		if err := a.recordHistory(name, res.Source, from, to, now); err != nil {
+			botlog.Error("record history failed", "member", name, "error", err)
 		}
-	}
-
-	return nil, MemberNotExistError{Name: name}
-}
-
-// sendPing は メンバーがいる場合に true になります。
-func (*Atnd) sendPing(ctx context.Context, addr string) (bool, error) {
-	stdout := new(bytes.Buffer)
-	cmd := exec.CommandContext(ctx, "l2ping", "-c", "1", addr)
-	cmd.Stdout = stdout
-
-	if err := cmd.Run(); err != nil {
-		if errors.Is(err, exec.ErrNotFound) {
-			return false, ErrL2pingNotFound
-		} else if strings.Contains(stdout.String(), "No route to host") {
-			return false, ErrBluetoothNotAvailable
+		// 一度見つからなかっただけの退室しかけのメンバーも在室として返します。
+		if to.InLab() {
+			userID, _ := a.MemberOwner(name)
+			lastSeen := now
+			if p, ok := a.presence.get(name); ok {
+				lastSeen = p.LastSeen
+			}
+			return &Attendance{Name: name, UserID: userID, Time: lastSeen}, nil
 		}
-
-		return false, nil
 	}
 
-	return true, nil
-}
-
-// updateStatus は name の在室時間を ts に更新します。
-func (a *Atnd) updateStatus(name string, ts *time.Time) {
-	a.muStatus.Lock()
-	defer a.muStatus.Unlock()
-
-	a.status[name] = ts
+	return nil, nil
 }
 
 // Members は登録されているメンバーの名前のリストを返します。
@@ -603,24 +797,46 @@ func (a *Atnd) Members() []string {
 
 // config は設定ファイルの構造体です。
 type config struct {
+	Version int       `json:"version"` // 設定ファイルの形式のバージョンです。
+	KeyID   string    `json:"key_id"`  // 機器のアドレスを暗号化したキーの ID です。
 	Members []*member `json:"members"`
 }
 
 // newConfig は初期状態の config を返します。
 func newConfig() *config {
 	return &config{
+		Version: configVersion,
 		Members: []*member{},
 	}
 }
 
 // member は設定ファイルのメンバーを表します。
 type member struct {
-	Name             string `json:"name"`              // 表示名です。
-	EncryptedAddress []byte `json:"encrypted_address"` // 暗号化された Bluetooth アドレスです。
+	Name    string    `json:"name"`              // 表示名です。
+	UserID  string    `json:"user_id,omitempty"` // 登録した Slack のユーザ ID です。
+	Devices []*device `json:"devices"`           // 持っている機器です。
 }
 
 // Attendance はそのメンバーの最後に出席した時間を表します。
 type Attendance struct {
-	Name string    // 表示名です。
-	Time time.Time // 最後に在室確認した時間です。
+	Name   string    // 表示名です。
+	UserID string    // 登録した Slack のユーザ ID です。分からなければ空です。
+	Time   time.Time // 最後に在室確認した時間です。
+}
+
+// ScanInfo は Search の実行状況を表します。
+type ScanInfo struct {
+	Start    time.Time     // 最後に Search を始めた時間です。
+	Duration time.Duration // 最後の Search にかかった時間です。
+	Err      error         // 最後の Search のエラーです。
+	Next     time.Time     // 次に定時 Search をする時間です。
+
+	Unscanned []string // 最後の Search で判定できなかったメンバーです。
+}
+
+// ScanResult は ScanContext の結果です。
+type ScanResult struct {
+	Attendance []*Attendance    // 在室しているメンバーです。
+	Unscanned  []string         // 期限までに判定できなかったり，判定に失敗したりしたメンバーです。
+	Errors     map[string]error // 判定に失敗したメンバーとそのエラーです。
 }
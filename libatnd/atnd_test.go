@@ -1,6 +1,20 @@
 package libatnd
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
 
 func TestIsValidMACAddress(t *testing.T) {
 	tests := []struct {
@@ -22,3 +36,339 @@ func TestIsValidMACAddress(t *testing.T) {
 		}
 	}
 }
+
+// nopScheduler は何も実行しない Scheduler です。
+type nopScheduler struct {
+	specs []string
+}
+
+func (s *nopScheduler) AddFunc(spec string, _ func()) (cron.EntryID, error) {
+	s.specs = append(s.specs, spec)
+	return cron.EntryID(len(s.specs)), nil
+}
+
+func (*nopScheduler) Entry(cron.EntryID) cron.Entry {
+	return cron.Entry{}
+}
+
+// newTestAtnd は一時ディレクトリに設定ファイルを置く，cron を使わないテスト用の Atnd を作ります。
+func newTestAtnd(t *testing.T, detector Detector, members map[string]string) *Atnd {
+	return newTestAtndWithOptions(t, Options{Detector: detector}, members)
+}
+
+// newTestAtndWithOptions は一時ディレクトリに設定ファイルを作って opts の Atnd を作ります。
+func newTestAtndWithOptions(t *testing.T, opts Options, members map[string]string) *Atnd {
+	dir, err := ioutil.TempDir("", "libatnd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if opts.ConfigPath == "" {
+		opts.ConfigPath = filepath.Join(dir, configFileName)
+	}
+	if opts.KeyPath == "" {
+		opts.KeyPath = filepath.Join(dir, encKeyFileName)
+	}
+	if opts.HistoryPath == "" {
+		opts.HistoryPath = filepath.Join(dir, historyFileName)
+	}
+	opts.Scheduler = new(nopScheduler)
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+
+	for name, addr := range members {
+		if err := a.SetMember(name, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libatnd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	opts := Options{
+		ConfigPath:  filepath.Join(dir, "config.json"),
+		KeyPath:     filepath.Join(dir, "key"),
+		HistoryPath: filepath.Join(dir, "history.jsonl"),
+		Clock:       func() time.Time { return now },
+		Detector:    new(recordDetector),
+		Scheduler:   new(nopScheduler),
+	}
+
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetMember("alice", "01:23:45:67:89:ab"); err != nil {
+		t.Fatal(err)
+	}
+	if specs := opts.Scheduler.(*nopScheduler).specs; len(specs) != 1 || specs[0] != cronSearchSchedule {
+		t.Errorf("unexpected schedule: %v", specs)
+	}
+
+	// 閉じるまではほかの Atnd は同じ設定ファイルを使えません。
+	if _, err := New(opts); !errors.Is(err, ErrConfigLocked) {
+		t.Errorf("expected ErrConfigLocked, got %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じファイルから作り直すと，同じキーで復号できます。
+	b, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	attendance, err := b.SearchMemberContext(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attendance == nil || !attendance.Time.Equal(now) {
+		t.Errorf("unexpected attendance: %+v", attendance)
+	}
+	if info := b.ScanInfo(); !info.Start.IsZero() {
+		t.Errorf("unexpected scan info: %+v", info)
+	}
+}
+
+func TestSearchMemberContext(t *testing.T) {
+	script := `
+# 名前 結果 理由
+alice present
+bob absent
+bob present
+carol error bluetooth not available
+`
+	tests := []struct {
+		name    string
+		present bool
+		isErr   bool
+	}{
+		{"alice", true, false},
+		{"alice", true, false},
+		{"bob", false, false},
+		{"bob", true, false},
+		{"bob", true, false},
+		{"carol", false, true},
+		{"dave", false, false},
+		{"eve", false, true},
+	}
+
+	d, err := NewScriptDetector(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAtnd(t, d, map[string]string{
+		"alice": "01:23:45:67:89:ab",
+		"bob":   "01:23:45:67:89:ac",
+		"carol": "01:23:45:67:89:ad",
+		"dave":  "01:23:45:67:89:ae",
+	})
+
+	for idx, test := range tests {
+		attendance, err := a.SearchMemberContext(context.Background(), test.name)
+		if (err != nil) != test.isErr {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+			continue
+		}
+		if present := attendance != nil; present != test.present {
+			t.Errorf("[%d] expected present %v, got %v", idx, test.present, present)
+		}
+	}
+
+	status := a.Status()
+	if len(status) != 2 {
+		t.Errorf("unexpected status: %v", status)
+	}
+}
+
+// recordDetector は受け取った Target を覚えておく Detector です。
+type recordDetector struct {
+	targets []Target
+}
+
+func (d *recordDetector) Detect(_ context.Context, target Target) (Result, error) {
+	d.targets = append(d.targets, target)
+	return Result{Present: true}, nil
+}
+
+func TestSearchMemberContextDecrypt(t *testing.T) {
+	d := new(recordDetector)
+	a := newTestAtnd(t, d, map[string]string{"alice": "01:23:45:67:89:ab"})
+
+	if _, err := a.SearchMemberContext(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.targets) != 1 || d.targets[0].Name != "alice" ||
+		!reflect.DeepEqual(d.targets[0].Addresses, []string{"01:23:45:67:89:ab"}) {
+		t.Errorf("unexpected targets: %+v", d.targets)
+	}
+}
+
+func TestNewScriptDetector(t *testing.T) {
+	tests := []struct {
+		script string
+		isErr  bool
+	}{
+		{"alice present\nbob absent because\n", false},
+		{"# comment\n\n", false},
+		{"alice\n", true},
+		{"alice maybe\n", true},
+	}
+
+	for idx, test := range tests {
+		_, err := NewScriptDetector(strings.NewReader(test.script))
+		if (err != nil) != test.isErr {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+		}
+	}
+}
+
+// slowDetector は名前ごとに決めた時間だけ待ってから判定する Detector です。
+// 同時に判定している数の最大値を覚えておきます。
+type slowDetector struct {
+	delays  map[string]time.Duration
+	errs    map[string]error
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (d *slowDetector) Detect(ctx context.Context, target Target) (Result, error) {
+	d.mu.Lock()
+	d.running++
+	if d.running > d.max {
+		d.max = d.running
+	}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.running--
+		d.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case <-time.After(d.delays[target.Name]):
+	}
+	if err := d.errs[target.Name]; err != nil {
+		return Result{}, err
+	}
+	return Result{Present: true}, nil
+}
+
+func TestScanContext(t *testing.T) {
+	tests := []struct {
+		delays    map[string]time.Duration
+		errs      map[string]error
+		present   []string
+		unscanned []string
+		errors    []string
+		isErr     bool
+	}{
+		{
+			// 全員判定できます。
+			map[string]time.Duration{"a": 10 * time.Millisecond, "b": 10 * time.Millisecond,
+				"c": 10 * time.Millisecond, "d": 10 * time.Millisecond},
+			nil,
+			[]string{"a", "b", "c", "d"}, []string{}, []string{}, false,
+		},
+		{
+			// c はタイムアウトし，d はエラーになります。
+			map[string]time.Duration{"a": 0, "b": 0, "c": time.Hour, "d": 0},
+			map[string]error{"d": ErrBluetoothNotAvailable},
+			[]string{"a", "b"}, []string{"c", "d"}, []string{"c", "d"}, false,
+		},
+		{
+			// 全員エラーならエラーです。
+			map[string]time.Duration{"a": 0, "b": 0, "c": 0, "d": 0},
+			map[string]error{"a": ErrBluetoothNotAvailable, "b": ErrBluetoothNotAvailable,
+				"c": ErrBluetoothNotAvailable, "d": ErrBluetoothNotAvailable},
+			[]string{}, []string{"a", "b", "c", "d"}, []string{"a", "b", "c", "d"}, true,
+		},
+	}
+
+	for idx, test := range tests {
+		d := &slowDetector{delays: test.delays, errs: test.errs}
+		a := newTestAtnd(t, d, nil)
+		for _, name := range []string{"a", "b", "c", "d"} {
+			if err := a.SetMember(name, "01:23:45:67:89:ab"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a.scanConcurrency = 2
+		a.probeTimeout = 100 * time.Millisecond
+		a.initState()
+
+		res, err := a.ScanContext(context.Background())
+		if (err != nil) != test.isErr {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+			continue
+		}
+		if test.isErr {
+			if !errors.Is(err, ErrBluetoothNotAvailable) {
+				t.Errorf("[%d] expected ErrBluetoothNotAvailable, got %v", idx, err)
+			}
+			continue
+		}
+
+		present := []string{}
+		for _, att := range res.Attendance {
+			present = append(present, att.Name)
+		}
+		errNames := []string{}
+		for name := range res.Errors {
+			errNames = append(errNames, name)
+		}
+		sort.Strings(errNames)
+
+		if !reflect.DeepEqual(present, test.present) {
+			t.Errorf("[%d] expected present %v, got %v", idx, test.present, present)
+		}
+		if !reflect.DeepEqual(res.Unscanned, test.unscanned) {
+			t.Errorf("[%d] expected unscanned %v, got %v", idx, test.unscanned, res.Unscanned)
+		}
+		if !reflect.DeepEqual(errNames, test.errors) {
+			t.Errorf("[%d] expected errors %v, got %v", idx, test.errors, errNames)
+		}
+		if d.max > 2 {
+			t.Errorf("[%d] too many concurrent probes: %d", idx, d.max)
+		}
+	}
+}
+
+func TestScanContextDeadline(t *testing.T) {
+	d := &slowDetector{delays: map[string]time.Duration{"a": 0, "b": time.Hour, "c": time.Hour}}
+	a := newTestAtnd(t, d, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := a.SetMember(name, "01:23:45:67:89:ab"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.scanConcurrency = 1
+	a.scanDeadline = 100 * time.Millisecond
+	a.initState()
+
+	res, err := a.ScanContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Attendance) != 1 || res.Attendance[0].Name != "a" {
+		t.Errorf("unexpected attendance: %v", res.Attendance)
+	}
+	if !reflect.DeepEqual(res.Unscanned, []string{"b", "c"}) || len(res.Errors) != 0 {
+		t.Errorf("unexpected unscanned: %v, errors: %v", res.Unscanned, res.Errors)
+	}
+}
@@ -0,0 +1,292 @@
+package libatnd
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/high-moctane/milbot/botlog"
+)
+
+// defaultBLEWindow は BLE のアドバタイズを見てからいるとみなす時間のデフォルト値です。
+const defaultBLEWindow = 10 * time.Minute
+
+// bleScanInterval は btmgmt find でスキャンし直すまでの最短の間隔です。
+// Search ではメンバーごとに Detect が呼ばれるので，毎回スキャンしないようにします。
+const bleScanInterval = 1 * time.Minute
+
+// bleScanTimeout は btmgmt find の一回のスキャンの時間です。
+const bleScanTimeout = 15 * time.Second
+
+// bleWatchRetryInterval は btmon が止まってから動かし直すまでの時間です。
+var bleWatchRetryInterval = 1 * time.Minute
+
+// ErrBtmgmtNotFound は btmgmt が $PATH にないときのエラーです。
+var ErrBtmgmtNotFound = errors.New("btmgmt not found in $PATH")
+
+// BLEDetector は BLE のアドバタイズを使って在室判定をする Detector です。
+// ロックされたスマートフォンは l2ping に応答しないことがありますが，
+// アドバタイズは出し続けていることが多いです。
+//
+// Target.Addresses には以下のものが使えます。
+//
+//	01:23:45:67:89:ab          public アドレスか static アドレス
+//	irk:<32 桁の 16 進数>       resolvable アドレスを解決する IRK
+//	mfr:<会社 ID>[:<16 進数>]    メーカー固有データの会社 ID と，データの先頭
+//
+// btmgmt find の出力にはメーカー固有データがないので，mfr: は Watch で動かす btmon で受信したものに合います。
+// Atnd は BLEDetector で初めて判定するときに Watch を始めます。
+type BLEDetector struct {
+	window time.Duration
+	scan   func(ctx context.Context) ([]*Advertisement, error)
+	now    func() time.Time
+
+	// muScan はスキャンを同時にしないようにします。
+	muScan   *sync.Mutex
+	lastScan time.Time
+
+	// mu は seen を守ります。
+	mu   *sync.Mutex
+	seen map[string]*Advertisement
+}
+
+// NewBLEDetector は window の間に見たアドバタイズで在室判定をする BLEDetector を作ります。
+// Detect のときに必要であれば btmgmt find でスキャンします。
+func NewBLEDetector(window time.Duration) *BLEDetector {
+	return &BLEDetector{
+		window: window,
+		scan:   scanBtmgmt,
+		now:    time.Now,
+		muScan: new(sync.Mutex),
+		mu:     new(sync.Mutex),
+		seen:   map[string]*Advertisement{},
+	}
+}
+
+// Observe はアドバタイズを受信したことを覚えます。Time がゼロ値なら今受信したものとします。
+func (d *BLEDetector) Observe(advs ...*Advertisement) {
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, adv := range advs {
+		a := *adv
+		if a.Time.IsZero() {
+			a.Time = now
+		}
+		if old, ok := d.seen[a.Address]; ok && old.Time.After(a.Time) {
+			continue
+		}
+		d.seen[a.Address] = &a
+	}
+}
+
+// WatchBtmon は ctx が終わるまで btmon を動かして，受信したアドバタイズを覚えます。
+// btmon は root 権限が必要です。
+func (d *BLEDetector) WatchBtmon(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "btmon")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("watch btmon failed: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("watch btmon failed: %w", err)
+	}
+
+	perr := ParseBtmon(stdout, func(adv *Advertisement) { d.Observe(adv) })
+	werr := cmd.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if perr != nil {
+		return fmt.Errorf("watch btmon failed: %w", perr)
+	}
+	if werr != nil {
+		return fmt.Errorf("watch btmon failed: %w", werr)
+	}
+	return nil
+}
+
+// Watch は ctx が終わるまで WatchBtmon を動かし続けます。btmon が止まったら少し待ってから動かし直します。
+// btmon がなければ btmgmt find だけで判定します。
+func (d *BLEDetector) Watch(ctx context.Context) {
+	for {
+		err := d.WatchBtmon(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			botlog.Warn("btmon not found; manufacturer data is not available", "error", err)
+			return
+		}
+		botlog.Warn("btmon stopped", "error", err)
+
+		timer := time.NewTimer(bleWatchRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Detect は window の間に target のどれかの識別子に合うアドバタイズを見ていたらいると判定します。
+func (d *BLEDetector) Detect(ctx context.Context, target Target) (Result, error) {
+	if err := d.scanIfNeeded(ctx); err != nil {
+		return Result{}, err
+	}
+
+	matchers := []bleMatcher{}
+	for _, id := range target.Addresses {
+		m, err := parseBLEIdentifier(id)
+		if err != nil {
+			return Result{}, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var found *Advertisement
+	for addr, adv := range d.seen {
+		if now.Sub(adv.Time) > d.window {
+			delete(d.seen, addr)
+			continue
+		}
+		for _, m := range matchers {
+			if m(adv) && (found == nil || adv.Time.After(found.Time)) {
+				found = adv
+			}
+		}
+	}
+
+	if found == nil {
+		return Result{Present: false, Reason: "no BLE advertisement in " + d.window.String()}, nil
+	}
+	return Result{
+		Present: true,
+		Reason:  fmt.Sprintf("%s BLE advertisement seen %s ago", found.Kind, now.Sub(found.Time).Round(time.Second)),
+		Source:  "ble",
+	}, nil
+}
+
+// scanIfNeeded は前のスキャンから bleScanInterval 以上経っていればスキャンします。
+func (d *BLEDetector) scanIfNeeded(ctx context.Context) error {
+	if d.scan == nil {
+		return nil
+	}
+
+	d.muScan.Lock()
+	defer d.muScan.Unlock()
+
+	if d.now().Sub(d.lastScan) < bleScanInterval {
+		return nil
+	}
+
+	advs, err := d.scan(ctx)
+	if err != nil {
+		return fmt.Errorf("ble scan failed: %w", err)
+	}
+	d.lastScan = d.now()
+	d.Observe(advs...)
+	return nil
+}
+
+// scanBtmgmt は btmgmt find で LE の機器をスキャンします。
+func scanBtmgmt(ctx context.Context) ([]*Advertisement, error) {
+	ctx, cancel := context.WithTimeout(ctx, bleScanTimeout)
+	defer cancel()
+
+	stdout := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, "btmgmt", "find", "-l")
+	cmd.Stdout = stdout
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, ErrBtmgmtNotFound
+		}
+		// タイムアウトで止めたときもそれまでの出力は使えます。
+		if ctx.Err() == nil {
+			return nil, ErrBluetoothNotAvailable
+		}
+	}
+
+	return ParseBtmgmtFind(stdout)
+}
+
+// bleMatcher はアドバタイズが識別子に合うかどうかを返します。
+type bleMatcher func(adv *Advertisement) bool
+
+// parseBLEIdentifier は識別子 id の bleMatcher を作ります。
+func parseBLEIdentifier(id string) (bleMatcher, error) {
+	switch {
+	case strings.HasPrefix(id, "irk:"):
+		irk, err := hex.DecodeString(strings.TrimPrefix(id, "irk:"))
+		if err != nil || len(irk) != 16 {
+			return nil, fmt.Errorf("invalid IRK identifier")
+		}
+		return func(adv *Advertisement) bool {
+			return adv.Kind == AddressResolvable && resolveRPA(irk, adv.Address)
+		}, nil
+
+	case strings.HasPrefix(id, "mfr:"):
+		parts := strings.SplitN(strings.TrimPrefix(id, "mfr:"), ":", 2)
+		company, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manufacturer identifier: %w", err)
+		}
+		var prefix []byte
+		if len(parts) == 2 {
+			prefix, err = hex.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid manufacturer identifier: %w", err)
+			}
+		}
+		return func(adv *Advertisement) bool {
+			return adv.HasCompany && adv.Company == uint16(company) && bytes.HasPrefix(adv.Data, prefix)
+		}, nil
+
+	case IsValidMACAddress(id):
+		addr := strings.ToLower(id)
+		return func(adv *Advertisement) bool {
+			return (adv.Kind == AddressPublic || adv.Kind == AddressStatic) && adv.Address == addr
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid BLE identifier")
+}
+
+// resolveRPA は resolvable アドレス addr が irk で解決できるかどうかを返します。
+// アドレスの上位 3 バイトが prand，下位 3 バイトが hash で，
+// hash = ah(irk, prand) なら irk の持ち主です。
+func resolveRPA(irk []byte, addr string) bool {
+	raw, err := hex.DecodeString(strings.ReplaceAll(addr, ":", ""))
+	if err != nil || len(raw) != 6 {
+		return false
+	}
+	prand, hash := raw[:3], raw[3:]
+
+	block, err := aes.NewCipher(irk)
+	if err != nil {
+		return false
+	}
+	plain := make([]byte, aes.BlockSize)
+	copy(plain[aes.BlockSize-3:], prand)
+	out := make([]byte, aes.BlockSize)
+	block.Encrypt(out, plain)
+
+	return bytes.Equal(out[aes.BlockSize-3:], hash)
+}
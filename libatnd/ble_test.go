@@ -0,0 +1,143 @@
+package libatnd
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBtmgmtFind(t *testing.T) {
+	f, err := os.Open("testdata/btmgmt_find.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	advs, err := ParseBtmgmtFind(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Advertisement{
+		{Address: "70:81:94:0d:fb:aa", Kind: AddressResolvable, RSSI: -63},
+		{Address: "c4:7c:8d:6a:12:34", Kind: AddressStatic, RSSI: -78, Name: "Mi Band 4"},
+		{Address: "5c:f3:70:8b:00:11", Kind: AddressPublic, RSSI: -55},
+		{Address: "1e:2b:3c:4d:5e:6f", Kind: AddressNonResolvable, RSSI: -91},
+	}
+	if !reflect.DeepEqual(advs, expected) {
+		t.Errorf("expected %+v, got %+v", expected, advs)
+	}
+}
+
+func TestParseBtmon(t *testing.T) {
+	f, err := os.Open("testdata/btmon.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	advs := []*Advertisement{}
+	if err := ParseBtmon(f, func(adv *Advertisement) { advs = append(advs, adv) }); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Advertisement{
+		{Address: "70:81:94:0d:fb:aa", Kind: AddressResolvable, RSSI: -63,
+			Company: 76, HasCompany: true, Data: mustDecodeHex(t, "1005031c7a8e21")},
+		{Address: "c4:7c:8d:6a:12:34", Kind: AddressStatic, RSSI: -78, Name: "Mi Band 4"},
+		{Address: "1e:2b:3c:4d:5e:6f", Kind: AddressNonResolvable, RSSI: -91,
+			Company: 6, HasCompany: true, Data: mustDecodeHex(t, "0109200247a1b2c3d4")},
+		{Address: "5c:f3:70:8b:00:11", Kind: AddressPublic, RSSI: -55},
+	}
+	if !reflect.DeepEqual(advs, expected) {
+		t.Errorf("expected %+v, got %+v", expected, advs)
+	}
+}
+
+func TestResolveRPA(t *testing.T) {
+	// Bluetooth Core Specification の ah のテストベクタです。
+	irk := mustDecodeHex(t, "ec0234a357c8ad05341010a60a397d9b")
+
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"70:81:94:0d:fb:aa", true},
+		{"70:81:94:0d:fb:ab", false},
+		{"70:81:95:0d:fb:aa", false},
+		{"bogus", false},
+	}
+
+	for idx, test := range tests {
+		if ok := resolveRPA(irk, test.addr); ok != test.ok {
+			t.Errorf("[%d] expected %v, got %v", idx, test.ok, ok)
+		}
+	}
+}
+
+func TestBLEDetector(t *testing.T) {
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := base
+
+	d := NewBLEDetector(10 * time.Minute)
+	d.now = func() time.Time { return now }
+	d.scan = func(context.Context) ([]*Advertisement, error) {
+		return []*Advertisement{{Address: "c4:7c:8d:6a:12:34", Kind: AddressStatic}}, nil
+	}
+
+	d.Observe(
+		&Advertisement{Time: base.Add(-5 * time.Minute), Address: "70:81:94:0d:fb:aa", Kind: AddressResolvable},
+		&Advertisement{Time: base.Add(-20 * time.Minute), Address: "5c:f3:70:8b:00:11", Kind: AddressPublic},
+		&Advertisement{Time: base.Add(-1 * time.Minute), Address: "1e:2b:3c:4d:5e:6f", Kind: AddressNonResolvable,
+			Company: 6, HasCompany: true, Data: mustDecodeHex(t, "0109200247")},
+	)
+
+	tests := []struct {
+		addrs   []string
+		present bool
+		isErr   bool
+	}{
+		{[]string{"irk:ec0234a357c8ad05341010a60a397d9b"}, true, false},
+		{[]string{"irk:00000000000000000000000000000000"}, false, false},
+		{[]string{"C4:7C:8D:6A:12:34"}, true, false},
+		{[]string{"5c:f3:70:8b:00:11"}, false, false},
+		{[]string{"70:81:94:0d:fb:aa"}, false, false},
+		{[]string{"mfr:6"}, true, false},
+		{[]string{"mfr:6:010920"}, true, false},
+		{[]string{"mfr:6:ff"}, false, false},
+		{[]string{"5c:f3:70:8b:00:11", "mfr:6"}, true, false},
+		{[]string{"irk:zz"}, false, true},
+		{[]string{"bogus"}, false, true},
+	}
+
+	for idx, test := range tests {
+		res, err := d.Detect(context.Background(), Target{Name: "alice", Addresses: test.addrs})
+		if (err != nil) != test.isErr {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+			continue
+		}
+		if res.Present != test.present {
+			t.Errorf("[%d] expected present %v, got %v (%s)", idx, test.present, res.Present, res.Reason)
+		}
+	}
+
+	// window を過ぎたら忘れます。
+	now = base.Add(30 * time.Minute)
+	d.scan = func(context.Context) ([]*Advertisement, error) { return nil, nil }
+	res, err := d.Detect(context.Background(), Target{Name: "alice", Addresses: []string{"mfr:6"}})
+	if err != nil || res.Present {
+		t.Errorf("expected absent, got %+v, %v", res, err)
+	}
+}
+
+// mustDecodeHex は s を 16 進数として読みます。
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
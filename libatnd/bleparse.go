@@ -0,0 +1,218 @@
+package libatnd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AddressKind は BLE のアドレスの種類です。
+type AddressKind int
+
+const (
+	// AddressPublic は機器に固有のアドレスです。
+	AddressPublic AddressKind = iota
+	// AddressStatic は起動するまで変わらないランダムアドレスです。
+	AddressStatic
+	// AddressResolvable は IRK で持ち主がわかる，定期的に変わるランダムアドレスです。
+	AddressResolvable
+	// AddressNonResolvable は持ち主がわからないランダムアドレスです。
+	AddressNonResolvable
+)
+
+// String は k の名前を返します。
+func (k AddressKind) String() string {
+	switch k {
+	case AddressPublic:
+		return "public"
+	case AddressStatic:
+		return "static"
+	case AddressResolvable:
+		return "resolvable"
+	case AddressNonResolvable:
+		return "non-resolvable"
+	}
+	return "unknown"
+}
+
+// randomAddressKind はランダムアドレス addr の上位 2 ビットから種類を返します。
+func randomAddressKind(addr string) AddressKind {
+	b, err := strconv.ParseUint(addr[:2], 16, 8)
+	if err != nil {
+		return AddressNonResolvable
+	}
+	switch b >> 6 {
+	case 0x3:
+		return AddressStatic
+	case 0x1:
+		return AddressResolvable
+	}
+	return AddressNonResolvable
+}
+
+// Advertisement は受信した BLE のアドバタイズです。
+type Advertisement struct {
+	Time    time.Time   // 受信した時間です。わからなければゼロ値です。
+	Address string      // 小文字の MAC アドレスです。
+	Kind    AddressKind // アドレスの種類です。
+	RSSI    int         // 電波強度 (dBm) です。
+	Name    string      // 機器の名前です。
+
+	// Company はメーカー固有データの会社 ID です。HasCompany が false なら無効です。
+	Company    uint16
+	HasCompany bool
+	// Data はメーカー固有データです。
+	Data []byte
+}
+
+// regexpBtmgmtFound は btmgmt find の dev_found の行です。
+var regexpBtmgmtFound = regexp.MustCompile(
+	`dev_found: ([0-9A-Fa-f:]{17}) type (.+?) rssi (-?\d+)`)
+
+// ParseBtmgmtFind は `btmgmt find` の出力からアドバタイズを読みます。
+// BR/EDR の機器は無視します。btmgmt はメーカー固有データを出力しないので Data は空です。
+func ParseBtmgmtFind(r io.Reader) ([]*Advertisement, error) {
+	res := []*Advertisement{}
+	var cur *Advertisement
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+
+		if m := regexpBtmgmtFound.FindStringSubmatch(line); m != nil {
+			cur = nil
+			if !strings.HasPrefix(m[2], "LE") {
+				continue
+			}
+
+			addr := strings.ToLower(m[1])
+			rssi, _ := strconv.Atoi(m[3])
+			cur = &Advertisement{Address: addr, Kind: AddressPublic, RSSI: rssi}
+			if m[2] == "LE Random" {
+				cur.Kind = randomAddressKind(addr)
+			}
+			res = append(res, cur)
+			continue
+		}
+
+		if cur != nil && strings.HasPrefix(line, "name ") {
+			cur.Name = strings.TrimPrefix(line, "name ")
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("parse btmgmt find failed: %w", err)
+	}
+
+	return res, nil
+}
+
+// regexpBtmonParen は btmon の行の最後の括弧の中身です。
+var regexpBtmonParen = regexp.MustCompile(`\(([^()]*)\)\s*$`)
+
+// btmonParser は btmon の出力を 1 行ずつ読んでアドバタイズを取り出します。
+type btmonParser struct {
+	cur      *Advertisement
+	inReport bool
+	emit     func(*Advertisement)
+}
+
+// ParseBtmon は btmon の出力を読んで，LE Advertising Report を見つけるたびに emit を呼びます。
+// r が終わるまで返らないので，btmon を動かし続けながら読むこともできます。
+func ParseBtmon(r io.Reader, emit func(*Advertisement)) error {
+	p := &btmonParser{emit: emit}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		p.line(sc.Text())
+	}
+	p.flush()
+
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("parse btmon failed: %w", err)
+	}
+	return nil
+}
+
+// line は btmon の 1 行を読みます。
+func (p *btmonParser) line(raw string) {
+	// 行頭が空白でない行は新しいパケットの始まりです。
+	if raw != "" && raw[0] != ' ' && raw[0] != '\t' {
+		p.flush()
+		p.inReport = false
+		return
+	}
+
+	line := strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(line, "LE Advertising Report"),
+		strings.HasPrefix(line, "LE Extended Advertising Report"):
+		p.flush()
+		p.inReport = true
+
+	case !p.inReport:
+
+	case strings.HasPrefix(line, "Event type:"):
+		p.flush()
+		p.cur = new(Advertisement)
+
+	case strings.HasPrefix(line, "Address:"):
+		if p.cur == nil {
+			p.cur = new(Advertisement)
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Address:"))
+		if len(fields) == 0 || !IsValidMACAddress(fields[0]) {
+			return
+		}
+		p.cur.Address = strings.ToLower(fields[0])
+		p.cur.Kind = AddressPublic
+		if m := regexpBtmonParen.FindStringSubmatch(line); m != nil {
+			switch m[1] {
+			case "Static":
+				p.cur.Kind = AddressStatic
+			case "Resolvable":
+				p.cur.Kind = AddressResolvable
+			case "Non-Resolvable":
+				p.cur.Kind = AddressNonResolvable
+			}
+		}
+
+	case p.cur == nil:
+
+	case strings.HasPrefix(line, "Company:"):
+		if m := regexpBtmonParen.FindStringSubmatch(line); m != nil {
+			if id, err := strconv.ParseUint(m[1], 10, 16); err == nil {
+				p.cur.Company, p.cur.HasCompany = uint16(id), true
+			}
+		}
+
+	case strings.HasPrefix(line, "Data:"):
+		if p.cur.HasCompany && p.cur.Data == nil {
+			data, err := hex.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "Data:")))
+			if err == nil {
+				p.cur.Data = data
+			}
+		}
+
+	case strings.HasPrefix(line, "Name (complete):"), strings.HasPrefix(line, "Name (short):"):
+		p.cur.Name = strings.TrimSpace(line[strings.Index(line, ":")+1:])
+
+	case strings.HasPrefix(line, "RSSI:"):
+		fields := strings.Fields(strings.TrimPrefix(line, "RSSI:"))
+		if len(fields) > 0 {
+			p.cur.RSSI, _ = strconv.Atoi(fields[0])
+		}
+	}
+}
+
+// flush は読みかけのアドバタイズがあれば emit します。
+func (p *btmonParser) flush() {
+	if p.cur != nil && p.cur.Address != "" {
+		p.emit(p.cur)
+	}
+	p.cur = nil
+}
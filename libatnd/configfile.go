@@ -0,0 +1,133 @@
+package libatnd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/high-moctane/milbot/botlog"
+)
+
+// defaultConfigBackups は設定ファイルのバックアップを残す数のデフォルト値です。
+const defaultConfigBackups = 3
+
+// ErrConfigLocked はほかの milbot が設定ファイルを使っていることを表すエラーです。
+var ErrConfigLocked = errors.New("atnd config is locked by another process")
+
+// ErrConfigBroken は設定ファイルが壊れていて，使えるバックアップもないことを表すエラーです。
+var ErrConfigBroken = errors.New("atnd config is broken and no valid backup found")
+
+// configBackupPath は i 番目に新しい設定ファイルのバックアップのパスを返します。
+func (a *Atnd) configBackupPath(i int) string {
+	return a.confPath + ".bak." + strconv.Itoa(i)
+}
+
+// configLockPath は設定ファイルのロックファイルのパスを返します。
+func (a *Atnd) configLockPath() string {
+	return a.confPath + ".lock"
+}
+
+// readConfigFile は設定ファイルを読みます。壊れていたら新しいバックアップから順に試して，
+// 使えるバックアップで設定ファイルを戻します。
+func (a *Atnd) readConfigFile() ([]byte, error) {
+	data, err := ioutil.ReadFile(a.confPath)
+	if err != nil {
+		return nil, fmt.Errorf("read config file failed: %w", err)
+	}
+	if json.Valid(data) {
+		return data, nil
+	}
+
+	botlog.Error("atnd config is broken", "path", a.confPath)
+	for i := 1; i <= a.configBackups; i++ {
+		path := a.configBackupPath(i)
+		backup, err := ioutil.ReadFile(path)
+		if err != nil || !json.Valid(backup) {
+			continue
+		}
+		if err := botdata.WriteFileAtomic(a.confPath, backup, configPerm); err != nil {
+			return nil, fmt.Errorf("read config file failed: %w", err)
+		}
+		botlog.Warn("restored atnd config from backup", "backup", path)
+		return backup, nil
+	}
+
+	return nil, fmt.Errorf("read config file failed: %w", ErrConfigBroken)
+}
+
+// writeConfigFile は今の設定ファイルをバックアップに回してから data を書きます。
+func (a *Atnd) writeConfigFile(data []byte) error {
+	if err := a.rotateConfigBackups(); err != nil {
+		return fmt.Errorf("write config file failed: %w", err)
+	}
+	if err := botdata.WriteFileAtomic(a.confPath, data, configPerm); err != nil {
+		return fmt.Errorf("write config file failed: %w", err)
+	}
+	return nil
+}
+
+// rotateConfigBackups は古いバックアップをひとつずつずらして，今の設定ファイルを一番新しいバックアップにします。
+// 今の設定ファイルが壊れていたらバックアップにしません。
+func (a *Atnd) rotateConfigBackups() error {
+	if a.configBackups <= 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(a.confPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("rotate config backups failed: %w", err)
+	}
+	if !json.Valid(data) {
+		return nil
+	}
+
+	for i := a.configBackups - 1; i >= 1; i-- {
+		err := os.Rename(a.configBackupPath(i), a.configBackupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate config backups failed: %w", err)
+		}
+	}
+	if err := botdata.WriteFileAtomic(a.configBackupPath(1), data, configPerm); err != nil {
+		return fmt.Errorf("rotate config backups failed: %w", err)
+	}
+	return nil
+}
+
+// lockConfig は設定ファイルのロックを取ります。ほかの milbot が取っていたら ErrConfigLocked です。
+// ロックは Close で外します。
+func (a *Atnd) lockConfig() error {
+	f, err := os.OpenFile(a.configLockPath(), os.O_RDWR|os.O_CREATE, configPerm)
+	if err != nil {
+		return fmt.Errorf("lock config failed: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("lock config failed: %w", err)
+	}
+	a.lockFile = f
+	return nil
+}
+
+// unlockConfig は設定ファイルのロックを外します。ロックしていなければ何もしません。
+func (a *Atnd) unlockConfig() error {
+	if a.lockFile == nil {
+		return nil
+	}
+	f := a.lockFile
+	a.lockFile = nil
+
+	if err := unlockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("unlock config failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unlock config failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package libatnd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConfigBackupRestore(t *testing.T) {
+	a := newTestAtndWithOptions(t, Options{Detector: new(recordDetector), ConfigBackups: 2}, nil)
+
+	names := []string{"alice", "bob", "carol"}
+	for _, name := range names {
+		if err := a.SetMember(name, "01:23:45:67:89:ab"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		backup  int
+		members []string
+	}{
+		{1, []string{"alice", "bob"}},
+		{2, []string{"alice"}},
+	}
+	for idx, test := range tests {
+		data, err := ioutil.ReadFile(a.configBackupPath(test.backup))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := countMembers(t, data); n != len(test.members) {
+			t.Errorf("[%d] expected %d members in backup, got %d", idx, len(test.members), n)
+		}
+	}
+	if _, err := os.Stat(a.configBackupPath(3)); !os.IsNotExist(err) {
+		t.Errorf("unexpected third backup: %v", err)
+	}
+
+	// 書いている途中で電源が切れて空になった設定ファイルはバックアップから戻ります。
+	if err := ioutil.WriteFile(a.confPath, nil, configPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		ConfigPath:    a.confPath,
+		KeyPath:       a.keyPath,
+		HistoryPath:   a.history.path,
+		Detector:      new(recordDetector),
+		Scheduler:     new(nopScheduler),
+		ConfigBackups: 2,
+	}
+	b, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members := b.Members(); !reflect.DeepEqual(members, []string{"alice", "bob"}) {
+		t.Errorf("unexpected members after restore: %v", members)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 使えるバックアップがなければ起動しません。
+	for _, path := range []string{a.confPath, a.configBackupPath(1), a.configBackupPath(2)} {
+		if err := ioutil.WriteFile(path, []byte(`{"members": [`), configPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := New(opts); !errors.Is(err, ErrConfigBroken) {
+		t.Errorf("expected ErrConfigBroken, got %v", err)
+	}
+}
+
+// countMembers は設定ファイルの中身 data のメンバーの数を返します。
+func countMembers(t *testing.T, data []byte) int {
+	var conf config
+	if err := json.Unmarshal(data, &conf); err != nil {
+		t.Fatal(err)
+	}
+	return len(conf.Members)
+}
@@ -0,0 +1,145 @@
+package libatnd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// envMilbotAtndDetectorScript は ScriptDetector のスクリプトのパスの環境変数です。
+// 指定されていると Bluetooth を使わずにスクリプトどおりに在室判定をします。デモ用です。
+const envMilbotAtndDetectorScript = "MILBOT_ATND_DETECTOR_SCRIPT"
+
+// envMilbotAtndDetector は在室判定に使う Detector の環境変数です。
+// l2ping, ble, lan をカンマ区切りで指定します。複数指定するとどれかでいればいると判定します。
+// 指定されていなければ l2ping です。
+const envMilbotAtndDetector = "MILBOT_ATND_DETECTOR"
+
+// envMilbotAtndLANLeases は LANDetector が使う DHCP のリースファイルのパスの環境変数です。
+const envMilbotAtndLANLeases = "MILBOT_ATND_LAN_LEASES"
+
+// envMilbotAtndBLEWindow は BLEDetector がアドバタイズを見てからいるとみなす時間の環境変数です。
+const envMilbotAtndBLEWindow = "MILBOT_ATND_BLE_WINDOW"
+
+// Target は在室判定をするメンバーです。
+type Target struct {
+	Name      string   // 表示名です。
+	Addresses []string // 復号した Bluetooth のアドレスです。
+
+	WiFiAddresses []string // 復号した Wi-Fi の MAC アドレスです。
+}
+
+// Result は在室判定の結果です。
+type Result struct {
+	Present bool   // いたら true です。
+	Reason  string // 判定の理由です。アドレスは含めないでください。
+	Source  string // 判定した Detector の名前です。在室履歴に残ります。
+}
+
+// Detector はメンバーがいるかどうかを判定します。
+// 判定できなかったときはエラーを返します。
+type Detector interface {
+	Detect(ctx context.Context, target Target) (Result, error)
+}
+
+// detectorFromEnv は環境変数の設定で Detector と，機器の Detector の種類ごとの Detector を作ります。
+// 何も指定されていなければ L2pingDetector です。スクリプトが指定されていたら種類ごとの Detector は nil です。
+func detectorFromEnv() (Detector, map[string]Detector, error) {
+	if path, ok := os.LookupEnv(envMilbotAtndDetectorScript); ok {
+		d, err := scriptDetectorFromFile(path)
+		return d, nil, err
+	}
+
+	detectors := map[string]Detector{}
+	for _, name := range []string{"l2ping", "ble", "lan"} {
+		d, err := newDetectorFromEnv(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		detectors[name] = d
+	}
+
+	names := strings.Split(os.Getenv(envMilbotAtndDetector), ",")
+	res := AnyDetector{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			name = "l2ping"
+		}
+		d, ok := detectors[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("cannot create detector: unknown detector %q", name)
+		}
+		res = append(res, d)
+	}
+
+	if len(res) == 1 {
+		return res[0], detectors, nil
+	}
+	return res, detectors, nil
+}
+
+// newDetectorFromEnv は name の Detector を環境変数の設定で作ります。
+func newDetectorFromEnv(name string) (Detector, error) {
+	switch name {
+	case "l2ping":
+		return new(L2pingDetector), nil
+
+	case "ble":
+		window, err := time.ParseDuration(os.Getenv(envMilbotAtndBLEWindow))
+		if err != nil || window <= 0 {
+			window = defaultBLEWindow
+		}
+		return NewBLEDetector(window), nil
+
+	case "lan":
+		return NewLANDetector(os.Getenv(envMilbotAtndLANLeases)), nil
+	}
+
+	return nil, fmt.Errorf("cannot create detector: unknown detector %q", name)
+}
+
+// scriptDetectorFromFile は path のスクリプトで ScriptDetector を作ります。
+func scriptDetectorFromFile(path string) (Detector, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create detector: %w", err)
+	}
+	defer f.Close()
+
+	d, err := NewScriptDetector(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create detector: %w", err)
+	}
+	return d, nil
+}
+
+// AnyDetector は複数の Detector を順に使って，どれかでいればいると判定する Detector です。
+// すべての Detector がエラーになったときだけエラーを返します。
+type AnyDetector []Detector
+
+// Detect は d の Detector を順に使って target を判定します。
+func (d AnyDetector) Detect(ctx context.Context, target Target) (Result, error) {
+	reasons := []string{}
+	errs := []error{}
+
+	for _, detector := range d {
+		res, err := detector.Detect(ctx, target)
+		if err != nil {
+			errs = append(errs, err)
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		if res.Present {
+			return res, nil
+		}
+		reasons = append(reasons, res.Reason)
+	}
+
+	if len(errs) > 0 && len(errs) == len(d) {
+		return Result{}, errs[0]
+	}
+	return Result{Present: false, Reason: strings.Join(reasons, ", ")}, nil
+}
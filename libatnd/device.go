@@ -0,0 +1,334 @@
+package libatnd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// 設定ファイルのバージョン 0 から移した機器のラベルです。
+// SetMember と SetMemberWiFi もこのラベルの機器をセットします。
+const (
+	defaultBluetoothLabel = "bluetooth"
+	defaultWiFiLabel      = "wifi"
+)
+
+// BluetoothDevice は SetMember でセットする Bluetooth の機器です。
+func BluetoothDevice(addr string) Device {
+	return Device{Label: defaultBluetoothLabel, Address: addr}
+}
+
+// WiFiDevice は SetMemberWiFi でセットする Wi-Fi の機器です。
+func WiFiDevice(addr string) Device {
+	return Device{Label: defaultWiFiLabel, Detector: "lan", Address: addr}
+}
+
+// DeviceExistError は同じラベルの機器がもう登録されていることを表すエラーです。
+type DeviceExistError struct {
+	Name  string
+	Label string
+}
+
+// Error です。
+func (e DeviceExistError) Error() string {
+	return fmt.Sprintf("device already exists: %q of %q", e.Label, e.Name)
+}
+
+// DeviceNotExistError は機器が登録されていないことを表すエラーです。
+type DeviceNotExistError struct {
+	Name  string
+	Label string
+}
+
+// Error です。
+func (e DeviceNotExistError) Error() string {
+	return fmt.Sprintf("device not exist: %q of %q", e.Label, e.Name)
+}
+
+// UnknownDetectorError は機器の Detector の種類が使えないことを表すエラーです。
+type UnknownDetectorError struct {
+	Detector string
+}
+
+// Error です。
+func (e UnknownDetectorError) Error() string {
+	return fmt.Sprintf("unknown detector: %q", e.Detector)
+}
+
+// Device はメンバーが持っている機器です。
+type Device struct {
+	// Label は機器の名前です。メンバーの中で重複しないようにします。
+	Label string
+
+	// Detector は機器の在室判定に使う Detector の種類で，l2ping, ble, lan のどれかです。
+	// 空なら Options.Detector を使います。
+	Detector string
+
+	// Address は機器のアドレスです。ble では BLEDetector の識別子も使えます。
+	Address string
+}
+
+// DeviceInfo は登録されている機器の情報です。アドレスは含みません。
+type DeviceInfo struct {
+	Label    string
+	Detector string
+}
+
+// device は設定ファイルの機器を表します。
+type device struct {
+	Label            string `json:"label"`
+	Detector         string `json:"detector,omitempty"`
+	EncryptedAddress []byte `json:"encrypted_address"` // 暗号化されたアドレスです。
+}
+
+// validateDevice は dev の Detector の種類とアドレスが正しいか確かめて，アドレスを正規化します。
+func validateDevice(dev *Device) error {
+	if dev.Label == "" || strings.ContainsAny(dev.Label, " \t\n") {
+		return InvalidNameError{Name: dev.Label}
+	}
+
+	switch dev.Detector {
+	case "":
+		if !IsValidMACAddress(dev.Address) {
+			return InvalidMACAddressError{Address: dev.Address}
+		}
+	case "l2ping", "lan":
+		if !IsValidMACAddress(dev.Address) {
+			return InvalidMACAddressError{Address: dev.Address}
+		}
+		dev.Address = strings.ToLower(dev.Address)
+	case "ble":
+		if IsValidMACAddress(dev.Address) {
+			dev.Address = strings.ToLower(dev.Address)
+		}
+		if _, err := parseBLEIdentifier(dev.Address); err != nil {
+			return InvalidMACAddressError{Address: dev.Address}
+		}
+	default:
+		return UnknownDetectorError{Detector: dev.Detector}
+	}
+	return nil
+}
+
+// AddDevice は name のメンバーに dev を登録します。メンバーがいなければ追加します。
+// 同じラベルの機器があれば DeviceExistError を返します。
+func (a *Atnd) AddDevice(name string, dev Device) error {
+	if err := a.setDevice(name, dev, false); err != nil {
+		return fmt.Errorf("add device failed: %w", err)
+	}
+	return nil
+}
+
+// setDevice は name のメンバーに dev をセットします。replace なら同じラベルの機器を置き換えます。
+func (a *Atnd) setDevice(name string, dev Device, replace bool) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return InvalidNameError{Name: name}
+	}
+	if err := validateDevice(&dev); err != nil {
+		return err
+	}
+
+	a.muConfig.Lock()
+	defer a.muConfig.Unlock()
+
+	encryptedAddr, err := a.encrypt(dev.Address)
+	if err != nil {
+		return err
+	}
+	newDevice := &device{Label: dev.Label, Detector: dev.Detector, EncryptedAddress: encryptedAddr}
+
+	mem := a.findMember(name)
+	if mem == nil {
+		mem = a.addMember(name)
+	}
+
+	found := false
+	for i, d := range mem.Devices {
+		if d.Label != dev.Label {
+			continue
+		}
+		if !replace {
+			return DeviceExistError{Name: name, Label: dev.Label}
+		}
+		mem.Devices[i] = newDevice
+		found = true
+		break
+	}
+	if !found {
+		mem.Devices = append(mem.Devices, newDevice)
+	}
+
+	return a.dumpConfig()
+}
+
+// RemoveDevice は name のメンバーの label の機器を消します。メンバーは残ります。
+func (a *Atnd) RemoveDevice(name, label string) error {
+	a.muConfig.Lock()
+	defer a.muConfig.Unlock()
+
+	mem := a.findMember(name)
+	if mem == nil {
+		return MemberNotExistError{Name: name}
+	}
+
+	for i, d := range mem.Devices {
+		if d.Label == label {
+			mem.Devices = append(mem.Devices[:i], mem.Devices[i+1:]...)
+			if err := a.dumpConfig(); err != nil {
+				return fmt.Errorf("remove device failed: %w", err)
+			}
+			return nil
+		}
+	}
+
+	return DeviceNotExistError{Name: name, Label: label}
+}
+
+// Devices は name のメンバーの機器を登録順に返します。
+func (a *Atnd) Devices(name string) ([]DeviceInfo, error) {
+	a.muConfig.RLock()
+	defer a.muConfig.RUnlock()
+
+	mem := a.findMember(name)
+	if mem == nil {
+		return nil, MemberNotExistError{Name: name}
+	}
+
+	res := []DeviceInfo{}
+	for _, d := range mem.Devices {
+		res = append(res, DeviceInfo{Label: d.Label, Detector: d.Detector})
+	}
+	return res, nil
+}
+
+// findMember は name のメンバーを返します。いなければ nil です。a.muConfig をロックしてから呼んでください。
+func (a *Atnd) findMember(name string) *member {
+	for _, mem := range a.config.Members {
+		if mem.Name == name {
+			return mem
+		}
+	}
+	return nil
+}
+
+// findDevices は name のメンバーの機器のアドレスを復号して返します。
+// 復号できなかった機器は除いて，その機器のラベルを DecryptError で返します。
+func (a *Atnd) findDevices(name string) ([]Device, error) {
+	a.muConfig.RLock()
+	mem := a.findMember(name)
+	var devices []*device
+	if mem != nil {
+		devices = make([]*device, len(mem.Devices))
+		copy(devices, mem.Devices)
+	}
+	key := a.encKey
+	a.muConfig.RUnlock()
+
+	if mem == nil {
+		return nil, MemberNotExistError{Name: name}
+	}
+
+	res := []Device{}
+	var decryptErr *DecryptError
+	for _, d := range devices {
+		addr, err := decryptWithKey(key, d.EncryptedAddress)
+		if err != nil {
+			if decryptErr == nil {
+				decryptErr = &DecryptError{Name: name, Err: err}
+			}
+			decryptErr.Labels = append(decryptErr.Labels, d.Label)
+			continue
+		}
+		res = append(res, Device{Label: d.Label, Detector: d.Detector, Address: addr})
+	}
+	if decryptErr != nil {
+		return res, *decryptErr
+	}
+	return res, nil
+}
+
+// deviceGroup は同じ Detector で判定する機器をまとめたものです。
+type deviceGroup struct {
+	name     string
+	detector Detector
+	target   Target
+	labels   []string
+	err      error
+}
+
+// detectDevices は name の devices を Detector ごとにまとめて判定します。
+// どれかの機器がいればいると判定します。すべての Detector がエラーになったときだけエラーを返します。
+func (a *Atnd) detectDevices(ctx context.Context, name string, devices []Device) (Result, error) {
+	groups := []*deviceGroup{}
+	if len(devices) == 0 {
+		groups = append(groups, &deviceGroup{detector: a.detector, target: Target{Name: name}})
+	}
+
+	for _, dev := range devices {
+		detectorName, detector, err := a.resolveDetector(dev.Detector)
+
+		var g *deviceGroup
+		for _, group := range groups {
+			if group.name == detectorName {
+				g = group
+				break
+			}
+		}
+		if g == nil {
+			g = &deviceGroup{name: detectorName, detector: detector, target: Target{Name: name}, err: err}
+			groups = append(groups, g)
+		}
+
+		if dev.Detector == "lan" {
+			g.target.WiFiAddresses = append(g.target.WiFiAddresses, dev.Address)
+		} else {
+			g.target.Addresses = append(g.target.Addresses, dev.Address)
+		}
+		g.labels = append(g.labels, dev.Label)
+	}
+
+	reasons := []string{}
+	errs := []error{}
+	for _, g := range groups {
+		if g.err != nil {
+			errs = append(errs, g.err)
+			continue
+		}
+
+		a.watches.watch(g.detector)
+		res, err := g.detector.Detect(ctx, g.target)
+		if err != nil {
+			errs = append(errs, err)
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		if len(g.labels) > 0 {
+			res.Reason = strings.Join(g.labels, ", ") + ": " + res.Reason
+		}
+		if res.Present {
+			if res.Source == "" {
+				res.Source = g.name
+			}
+			return res, nil
+		}
+		reasons = append(reasons, res.Reason)
+	}
+
+	if len(errs) > 0 && len(errs) == len(groups) {
+		return Result{}, errs[0]
+	}
+	return Result{Present: false, Reason: strings.Join(reasons, "; ")}, nil
+}
+
+// resolveDetector は機器の Detector の種類から使う Detector を選びます。
+// 種類が空か，Options.Detectors がなければ Options.Detector を使います。
+func (a *Atnd) resolveDetector(name string) (string, Detector, error) {
+	if name == "" || a.detectors == nil {
+		return "", a.detector, nil
+	}
+	d, ok := a.detectors[name]
+	if !ok {
+		return name, nil, UnknownDetectorError{Detector: name}
+	}
+	return name, d, nil
+}
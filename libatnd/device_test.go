@@ -0,0 +1,164 @@
+package libatnd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateDevices(t *testing.T) {
+	first := newTestAtnd(t, new(recordDetector), nil)
+
+	bt, err := first.encrypt("01:23:45:67:89:ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wifi, err := first.encrypt("aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := map[string]interface{}{
+		"members": []map[string]interface{}{
+			{"name": "alice", "encrypted_address": bt, "encrypted_wifi_address": wifi},
+			{"name": "bob", "encrypted_address": bt},
+		},
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(first.confPath, data, configPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := new(recordDetector)
+	a, err := New(Options{
+		ConfigPath:  first.confPath,
+		KeyPath:     first.keyPath,
+		HistoryPath: first.history.path,
+		Detector:    d,
+		Scheduler:   new(nopScheduler),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	tests := []struct {
+		name     string
+		expected []DeviceInfo
+	}{
+		{"alice", []DeviceInfo{{Label: "bluetooth"}, {Label: "wifi", Detector: "lan"}}},
+		{"bob", []DeviceInfo{{Label: "bluetooth"}}},
+	}
+	for idx, test := range tests {
+		devices, err := a.Devices(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(devices, test.expected) {
+			t.Errorf("[%d] expected %+v, got %+v", idx, test.expected, devices)
+		}
+	}
+
+	if _, err := a.SearchMemberContext(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	expected := Target{
+		Name:          "alice",
+		Addresses:     []string{"01:23:45:67:89:ab"},
+		WiFiAddresses: []string{"aa:bb:cc:dd:ee:ff"},
+	}
+	if len(d.targets) != 1 || !reflect.DeepEqual(d.targets[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, d.targets)
+	}
+
+	// 移したあとの設定ファイルには古いアドレスが残りません。
+	conf, err := a.loadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Version != configVersion {
+		t.Errorf("expected version %d, got %d", configVersion, conf.Version)
+	}
+	for _, mem := range conf.Members {
+		if len(mem.Devices) == 0 {
+			t.Errorf("config not migrated: %+v", mem)
+		}
+	}
+}
+
+// absentDetector は誰もいないと判定して，受け取った Target を覚えておく Detector です。
+type absentDetector struct {
+	recordDetector
+}
+
+func (d *absentDetector) Detect(ctx context.Context, target Target) (Result, error) {
+	d.recordDetector.Detect(ctx, target)
+	return Result{Present: false, Reason: "absent"}, nil
+}
+
+func TestDevices(t *testing.T) {
+	l2ping, lan := new(absentDetector), new(recordDetector)
+	a := newTestAtndWithOptions(t, Options{
+		Detector:  new(absentDetector),
+		Detectors: map[string]Detector{"l2ping": l2ping, "lan": lan},
+	}, nil)
+
+	tests := []struct {
+		dev Device
+		err interface{}
+	}{
+		{Device{Label: "phone", Detector: "l2ping", Address: "01:23:45:67:89:AB"}, nil},
+		{Device{Label: "laptop", Detector: "lan", Address: "aa:bb:cc:dd:ee:ff"}, nil},
+		{Device{Label: "watch", Detector: "l2ping", Address: "01:23:45:67:89:ac"}, nil},
+		{Device{Label: "phone", Detector: "l2ping", Address: "01:23:45:67:89:ad"}, &DeviceExistError{}},
+		{Device{Label: "tag", Detector: "ble", Address: "irk:zz"}, &InvalidMACAddressError{}},
+		{Device{Label: "tag", Detector: "nfc", Address: "01:23:45:67:89:ad"}, &UnknownDetectorError{}},
+		{Device{Label: "", Detector: "l2ping", Address: "01:23:45:67:89:ad"}, &InvalidNameError{}},
+	}
+	for idx, test := range tests {
+		err := a.AddDevice("alice", test.dev)
+		if test.err == nil && err != nil {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+		} else if test.err != nil && !errors.As(err, test.err) {
+			t.Errorf("[%d] expected %T, got %v", idx, test.err, err)
+		}
+	}
+
+	res, err := a.SearchMemberContext(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res == nil {
+		t.Error("expected present by laptop")
+	}
+	if len(l2ping.targets) != 1 ||
+		!reflect.DeepEqual(l2ping.targets[0].Addresses, []string{"01:23:45:67:89:ab", "01:23:45:67:89:ac"}) {
+		t.Errorf("unexpected l2ping targets: %+v", l2ping.targets)
+	}
+	if len(lan.targets) != 1 || !reflect.DeepEqual(lan.targets[0].WiFiAddresses, []string{"aa:bb:cc:dd:ee:ff"}) {
+		t.Errorf("unexpected lan targets: %+v", lan.targets)
+	}
+
+	if err := a.RemoveDevice("alice", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemoveDevice("alice", "laptop"); !errors.As(err, new(DeviceNotExistError)) {
+		t.Errorf("expected DeviceNotExistError, got %v", err)
+	}
+	devices, err := a.Devices("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DeviceInfo{{Label: "phone", Detector: "l2ping"}, {Label: "watch", Detector: "l2ping"}}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("expected %+v, got %+v", expected, devices)
+	}
+}
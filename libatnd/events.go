@@ -0,0 +1,215 @@
+package libatnd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/high-moctane/milbot/botlog"
+)
+
+// subscriberBufferSize は Subscribe で返すチャンネルのバッファの大きさです。
+const subscriberBufferSize = 64
+
+// EventType は在室のイベントの種類です。
+type EventType int
+
+const (
+	// EventArrived はメンバーが在室し始めたことを表します。
+	EventArrived EventType = iota + 1
+	// EventDeparted はメンバーが退室したことを表します。
+	EventDeparted
+	// EventLabOccupied は研究室に誰かがいるようになったことを表します。
+	EventLabOccupied
+	// EventLabEmpty は研究室に誰もいなくなったことを表します。
+	EventLabEmpty
+	// EventScanFailed は Search が失敗したことを表します。
+	EventScanFailed
+	// EventBluetoothDown は Bluetooth が使えなくなったことを表します。
+	EventBluetoothDown
+	// EventBluetoothUp は Bluetooth がまた使えるようになったことを表します。
+	EventBluetoothUp
+)
+
+// String は t の名前を返します。
+func (t EventType) String() string {
+	switch t {
+	case EventArrived:
+		return "arrived"
+	case EventDeparted:
+		return "departed"
+	case EventLabOccupied:
+		return "lab_occupied"
+	case EventLabEmpty:
+		return "lab_empty"
+	case EventScanFailed:
+		return "scan_failed"
+	case EventBluetoothDown:
+		return "bluetooth_down"
+	case EventBluetoothUp:
+		return "bluetooth_up"
+	}
+	return "invalid"
+}
+
+// Event は在室のイベントです。
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Member は EventArrived と EventDeparted のメンバーの名前です。
+	Member string
+
+	// Presence は EventArrived と EventDeparted のメンバーの在室状態です。
+	// EventDeparted では Departed が退室した時間です。
+	Presence *Presence
+
+	// Err は EventScanFailed と EventBluetoothDown の原因です。
+	Err error
+
+	// Dropped はこのイベントの前に受け取れずに捨てられたイベントの数です。
+	Dropped int
+}
+
+// eventBus は Subscribe したチャンネルにイベントを配ります。
+type eventBus struct {
+	mu     *sync.Mutex
+	nextID int
+	subs   map[int]*subscriber
+}
+
+// subscriber は Subscribe したひとつのチャンネルです。
+type subscriber struct {
+	ch      chan Event
+	dropped int
+}
+
+// newEventBus は eventBus を作ります。
+func newEventBus() *eventBus {
+	return &eventBus{mu: new(sync.Mutex), subs: map[int]*subscriber{}}
+}
+
+// subscribe はイベントを受け取るチャンネルを追加します。ctx が終わったらチャンネルを閉じます。
+func (b *eventBus) subscribe(ctx context.Context) <-chan Event {
+	sub := &subscriber{ch: make(chan Event, subscriberBufferSize)}
+
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = sub
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs, id)
+		close(sub.ch)
+	}()
+
+	return sub.ch
+}
+
+// publish は ev をすべてのチャンネルに送ります。チャンネルがいっぱいなら待たずに捨てて，
+// 次に送れたイベントの Dropped に捨てた数を入れます。
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, sub := range b.subs {
+		e := ev
+		e.Dropped = sub.dropped
+		select {
+		case sub.ch <- e:
+			sub.dropped = 0
+		default:
+			if sub.dropped == 0 {
+				botlog.Warn("atnd event subscriber overflowed", "subscriber", id, "event", ev.Type)
+			}
+			sub.dropped++
+		}
+	}
+}
+
+// labState は研究室全体のイベントを出すために前回の Search の状態を覚えます。
+// ScanContext は同時に実行されないので，その中でだけ触ります。
+type labState struct {
+	known         bool
+	occupied      bool
+	bluetoothDown bool
+}
+
+// Subscribe は在室のイベントを受け取るチャンネルを返します。ctx が終わるとチャンネルは閉じます。
+// イベントは定時の Search でも出るので，プラグインが自分で Search する必要はありません。
+// 受け取りが遅れてチャンネルがいっぱいになると，イベントは捨てられて Event.Dropped で知らされます。
+func (a *Atnd) Subscribe(ctx context.Context) <-chan Event {
+	return a.events.subscribe(ctx)
+}
+
+// publishTransition はメンバーの状態が from から to に変わったときのイベントを出します。
+func (a *Atnd) publishTransition(name string, from, to PresenceState, now time.Time) {
+	var typ EventType
+	switch {
+	case to.InLab() && !from.InLab():
+		typ = EventArrived
+	case to == StateAbsent && from.InLab():
+		typ = EventDeparted
+	default:
+		return
+	}
+
+	p, _ := a.presence.get(name)
+	a.events.publish(Event{Type: typ, Time: now, Member: name, Presence: p})
+}
+
+// publishScan は Search の結果から研究室全体のイベントを出します。
+func (a *Atnd) publishScan(res *ScanResult, err error, now time.Time) {
+	if err != nil {
+		a.events.publish(Event{Type: EventScanFailed, Time: now, Err: err})
+	}
+
+	btErr := err
+	if res != nil {
+		for _, e := range res.Errors {
+			if errors.Is(e, ErrBluetoothNotAvailable) {
+				btErr = e
+				break
+			}
+		}
+	}
+	if errors.Is(btErr, ErrBluetoothNotAvailable) {
+		if !a.lab.bluetoothDown {
+			a.lab.bluetoothDown = true
+			a.events.publish(Event{Type: EventBluetoothDown, Time: now, Err: btErr})
+		}
+	} else if err == nil && a.lab.bluetoothDown {
+		a.lab.bluetoothDown = false
+		a.events.publish(Event{Type: EventBluetoothUp, Time: now})
+	}
+
+	if err != nil {
+		return
+	}
+
+	// まだ状態がわからないメンバーがいるうちは，誰もいないとは言えません。
+	occupied, unknown := false, false
+	for _, p := range a.presence.all() {
+		occupied = occupied || p.State.InLab()
+		unknown = unknown || p.State == StateUnknown
+	}
+	if !occupied && unknown {
+		return
+	}
+	if a.lab.known && a.lab.occupied == occupied {
+		return
+	}
+	a.lab.known, a.lab.occupied = true, occupied
+	if occupied {
+		a.events.publish(Event{Type: EventLabOccupied, Time: now})
+	} else {
+		a.events.publish(Event{Type: EventLabEmpty, Time: now})
+	}
+}
@@ -0,0 +1,97 @@
+package libatnd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBusOverflow(t *testing.T) {
+	b := newEventBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := b.subscribe(ctx)
+
+	for i := 0; i < subscriberBufferSize+2; i++ {
+		b.publish(Event{Type: EventArrived})
+	}
+	for i := 0; i < subscriberBufferSize; i++ {
+		if ev := <-ch; ev.Dropped != 0 {
+			t.Errorf("[%d] expected no dropped, got %d", i, ev.Dropped)
+		}
+	}
+
+	b.publish(Event{Type: EventDeparted})
+	if ev := <-ch; ev.Type != EventDeparted || ev.Dropped != 2 {
+		t.Errorf("expected departed with 2 dropped, got %v with %d dropped", ev.Type, ev.Dropped)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("expected closed channel")
+		}
+	case <-time.After(time.Second):
+		t.Error("channel not closed")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	script := `
+alice present
+alice absent
+bob error bluetooth not available
+bob absent
+`
+	d, err := NewScriptDetector(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAtndWithOptions(t, Options{
+		Detector:       d,
+		MissThreshold:  1,
+		DepartureGrace: time.Nanosecond,
+	}, map[string]string{
+		"alice": "01:23:45:67:89:ab",
+		"bob":   "01:23:45:67:89:ac",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := a.Subscribe(ctx)
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.ScanContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		typ    EventType
+		member string
+	}{
+		{EventArrived, "alice"},
+		{EventBluetoothDown, ""},
+		{EventLabOccupied, ""},
+		{EventDeparted, "alice"},
+		{EventBluetoothUp, ""},
+		{EventLabEmpty, ""},
+	}
+
+	for idx, test := range tests {
+		select {
+		case ev := <-ch:
+			if ev.Type != test.typ || ev.Member != test.member {
+				t.Errorf("[%d] expected %v %q, got %v %q", idx, test.typ, test.member, ev.Type, ev.Member)
+			}
+		default:
+			t.Fatalf("[%d] expected %v, got nothing", idx, test.typ)
+		}
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event %v", ev.Type)
+	default:
+	}
+}
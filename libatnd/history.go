@@ -0,0 +1,303 @@
+package libatnd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/high-moctane/milbot/botlog"
+)
+
+// historyFileName は在室履歴のファイルの名前です。
+const historyFileName = "atnd_history.jsonl"
+
+// historyPerm は在室履歴のファイルのパーミッションです。
+const historyPerm = 0600
+
+// defaultHistoryRetention は在室履歴を残す期間のデフォルト値です。
+const defaultHistoryRetention = 90 * 24 * time.Hour
+
+// historySeenInterval は在室中のメンバーの最後に見つかった時間を書き足す最短の間隔です。
+// 再起動したときに退室した時間がわかるようにしますが，毎回は書きません。
+const historySeenInterval = 10 * time.Minute
+
+// historyCompactRecords は起動してから書き足したレコードがこの数を超えたら在室履歴を詰め直します。
+const historyCompactRecords = 1000
+
+// レコードの種類です。
+const (
+	historyArrived  = "arrived"
+	historySeen     = "seen"
+	historyDeparted = "departed"
+)
+
+// Session はメンバーが一度在室した記録です。
+type Session struct {
+	Member   string    `json:"member"`
+	Arrived  time.Time `json:"arrived"`
+	Departed time.Time `json:"departed"`  // 在室中ならゼロ値です。
+	LastSeen time.Time `json:"last_seen"` // 最後に見つかった時間です。
+	Source   string    `json:"source"`    // 在室し始めたときに判定した Detector の名前です。
+}
+
+// Ongoing は在室中の記録かどうかを返します。
+func (s *Session) Ongoing() bool {
+	return s.Departed.IsZero()
+}
+
+// historyRecord は在室履歴のファイルの 1 行です。
+//
+//	{"type":"arrived","member":"alice","time":"2020-04-01T10:12:00+09:00","source":"l2ping"}
+//	{"type":"seen","member":"alice","time":"2020-04-01T10:22:00+09:00"}
+//	{"type":"departed","member":"alice","time":"2020-04-01T18:40:00+09:00"}
+type historyRecord struct {
+	Type   string    `json:"type"`
+	Member string    `json:"member"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source,omitempty"`
+}
+
+// history は在室履歴を追記だけのファイルに記録します。
+type history struct {
+	path      string
+	retention time.Duration
+
+	mu       *sync.Mutex
+	sessions []*Session
+	open     map[string]*Session  // 在室中の記録です。
+	lastSeen map[string]time.Time // 最後に seen を書いた時間です。
+	appended int
+}
+
+// loadHistory は path の在室履歴を読み込んで，retention より古い記録を消して詰め直します。
+// ファイルがなければ空の在室履歴になります。
+func loadHistory(path string, retention time.Duration, now time.Time) (*history, error) {
+	h := &history{
+		path:      path,
+		retention: retention,
+		mu:        new(sync.Mutex),
+		sessions:  []*Session{},
+		open:      map[string]*Session{},
+		lastSeen:  map[string]time.Time{},
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load history failed: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		var rec historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// 書き込み中に落ちたときは最後の行が壊れていることがあります。
+			botlog.Warn("skip broken history record", "line", lineno, "error", err)
+			continue
+		}
+		h.apply(&rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("load history failed: %w", err)
+	}
+
+	if err := h.compact(now); err != nil {
+		return nil, fmt.Errorf("load history failed: %w", err)
+	}
+	return h, nil
+}
+
+// apply は rec を在室履歴に反映します。
+func (h *history) apply(rec *historyRecord) {
+	switch rec.Type {
+	case historyArrived:
+		if s, ok := h.open[rec.Member]; ok {
+			// 退室を書く前に落ちていたら，最後に見つかった時間に退室したことにします。
+			s.Departed = s.LastSeen
+		}
+		s := &Session{Member: rec.Member, Arrived: rec.Time, LastSeen: rec.Time, Source: rec.Source}
+		h.sessions = append(h.sessions, s)
+		h.open[rec.Member] = s
+
+	case historySeen:
+		if s, ok := h.open[rec.Member]; ok && rec.Time.After(s.LastSeen) {
+			s.LastSeen = rec.Time
+		}
+
+	case historyDeparted:
+		if s, ok := h.open[rec.Member]; ok {
+			s.Departed = rec.Time
+			if rec.Time.After(s.LastSeen) {
+				s.LastSeen = rec.Time
+			}
+			delete(h.open, rec.Member)
+		}
+	}
+}
+
+// arrived は member が source の判定で t に在室し始めたことを記録します。
+func (h *history) arrived(member, source string, t time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastSeen[member] = t
+	return h.append(&historyRecord{Type: historyArrived, Member: member, Time: t, Source: source})
+}
+
+// seen は在室中の member が t に見つかったことを，historySeenInterval に一度だけ記録します。
+func (h *history) seen(member string, t time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.open[member]; !ok || t.Sub(h.lastSeen[member]) < historySeenInterval {
+		return nil
+	}
+	h.lastSeen[member] = t
+	return h.append(&historyRecord{Type: historySeen, Member: member, Time: t})
+}
+
+// departed は member が t に退室したことを記録します。
+func (h *history) departed(member string, t time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.lastSeen, member)
+	return h.append(&historyRecord{Type: historyDeparted, Member: member, Time: t})
+}
+
+// append は rec を在室履歴に反映してファイルに書き足します。
+// 書き足したレコードが多くなったら詰め直します。
+func (h *history) append(rec *historyRecord) error {
+	h.apply(rec)
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("append history failed: %w", err)
+	}
+
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, historyPerm)
+	if err != nil {
+		return fmt.Errorf("append history failed: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("append history failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("append history failed: %w", err)
+	}
+
+	h.appended++
+	if h.appended >= historyCompactRecords {
+		return h.compact(rec.Time)
+	}
+	return nil
+}
+
+// compact は retention より前に退室した記録を消して，記録ごとにまとめたファイルに書き直します。
+func (h *history) compact(now time.Time) error {
+	kept := []*Session{}
+	for _, s := range h.sessions {
+		if !s.Ongoing() && now.Sub(s.Departed) > h.retention {
+			continue
+		}
+		kept = append(kept, s)
+	}
+
+	buf := []byte{}
+	for _, s := range kept {
+		recs := []*historyRecord{{Type: historyArrived, Member: s.Member, Time: s.Arrived, Source: s.Source}}
+		if s.LastSeen.After(s.Arrived) && (s.Ongoing() || s.LastSeen.Before(s.Departed)) {
+			recs = append(recs, &historyRecord{Type: historySeen, Member: s.Member, Time: s.LastSeen})
+		}
+		if !s.Ongoing() {
+			recs = append(recs, &historyRecord{Type: historyDeparted, Member: s.Member, Time: s.Departed})
+		}
+		for _, rec := range recs {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return fmt.Errorf("compact history failed: %w", err)
+			}
+			buf = append(append(buf, data...), '\n')
+		}
+	}
+
+	if err := botdata.WriteFileAtomic(h.path, buf, historyPerm); err != nil {
+		return fmt.Errorf("compact history failed: %w", err)
+	}
+
+	h.sessions = kept
+	h.appended = 0
+	return nil
+}
+
+// query は from から to までに在室していた member の記録のコピーを，在室し始めた順に返します。
+// member が空ならすべてのメンバーの記録を返します。
+func (h *history) query(from, to time.Time, member string) []*Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := []*Session{}
+	for _, s := range h.sessions {
+		if member != "" && s.Member != member {
+			continue
+		}
+		if !to.IsZero() && !s.Arrived.Before(to) {
+			continue
+		}
+		if !from.IsZero() && !s.Ongoing() && s.Departed.Before(from) {
+			continue
+		}
+		cp := *s
+		res = append(res, &cp)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Arrived.Before(res[j].Arrived) })
+	return res
+}
+
+// latest はメンバーごとの最後の記録のコピーを返します。
+func (h *history) latest() map[string]*Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := map[string]*Session{}
+	for _, s := range h.sessions {
+		if old, ok := res[s.Member]; ok && old.Arrived.After(s.Arrived) {
+			continue
+		}
+		cp := *s
+		res[s.Member] = &cp
+	}
+	return res
+}
+
+// recordHistory はメンバーの状態が from から to に変わったことを在室履歴に記録します。
+func (a *Atnd) recordHistory(name, source string, from, to PresenceState, now time.Time) error {
+	switch {
+	case to.InLab() && !from.InLab():
+		return a.history.arrived(name, source, now)
+	case to == StateAbsent && from.InLab():
+		p, ok := a.presence.get(name)
+		if !ok {
+			return nil
+		}
+		return a.history.departed(name, p.Departed)
+	case to == StatePresent:
+		return a.history.seen(name, now)
+	}
+	return nil
+}
+
+// History は from から to までに在室していた member の記録を，在室し始めた順に返します。
+// from と to がゼロ値ならその側は限りません。member が空ならすべてのメンバーの記録を返します。
+// 削除したメンバーの記録も返します。
+func (a *Atnd) History(from, to time.Time, member string) []*Session {
+	return a.history.query(from, to, member)
+}
@@ -0,0 +1,128 @@
+package libatnd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// copyHistoryFixture は testdata の在室履歴を一時ディレクトリにコピーしてパスを返します。
+func copyHistoryFixture(t *testing.T) string {
+	data, err := ioutil.ReadFile("testdata/atnd_history.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "libatnd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, historyFileName)
+	if err := ioutil.WriteFile(path, data, historyPerm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHistoryQuery(t *testing.T) {
+	date := func(day, hour, min int) time.Time { return time.Date(2020, 4, day, hour, min, 0, 0, time.UTC) }
+
+	path := copyHistoryFixture(t)
+	h, err := loadHistory(path, 30*24*time.Hour, date(2, 9, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &Session{Member: "alice", Arrived: date(1, 10, 12), Departed: date(1, 18, 40), LastSeen: date(1, 18, 40), Source: "l2ping"}
+	bob := &Session{Member: "bob", Arrived: date(1, 11, 0), LastSeen: date(1, 19, 0), Source: "lan"}
+	carol := &Session{Member: "carol", Arrived: date(1, 13, 0), LastSeen: date(1, 13, 0), Source: "ble"}
+
+	tests := []struct {
+		from, to time.Time
+		member   string
+		expected []*Session
+	}{
+		{time.Time{}, time.Time{}, "", []*Session{alice, bob, carol}},
+		{time.Time{}, time.Time{}, "alice", []*Session{alice}},
+		{date(1, 19, 0), time.Time{}, "", []*Session{bob, carol}},
+		{time.Time{}, date(1, 11, 0), "", []*Session{alice}},
+		{date(1, 0, 0), date(2, 0, 0), "dave", []*Session{}},
+	}
+
+	for idx, test := range tests {
+		res := h.query(test.from, test.to, test.member)
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("[%d] expected %+v, got %+v", idx, test.expected, res)
+		}
+	}
+
+	// 詰め直したファイルを読み直しても同じ記録になります。
+	h2, err := loadHistory(path, 30*24*time.Hour, date(2, 9, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := h2.query(time.Time{}, time.Time{}, ""); !reflect.DeepEqual(res, []*Session{alice, bob, carol}) {
+		t.Errorf("unexpected sessions after compaction: %+v", res)
+	}
+}
+
+func TestHistoryRestore(t *testing.T) {
+	now := time.Date(2020, 4, 1, 19, 5, 0, 0, time.UTC)
+	path := copyHistoryFixture(t)
+
+	d, err := NewScriptDetector(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		HistoryPath: path,
+		Clock:       func() time.Time { return now },
+		Detector:    d,
+	}
+	first := newTestAtndWithOptions(t, opts, map[string]string{
+		"alice": "01:23:45:67:89:ab",
+		"bob":   "01:23:45:67:89:ac",
+		"carol": "01:23:45:67:89:ad",
+	})
+
+	// 再起動します。
+	opts.ConfigPath, opts.KeyPath, opts.Scheduler = first.confPath, first.keyPath, new(nopScheduler)
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	tests := []struct {
+		name  string
+		state PresenceState
+	}{
+		{"alice", StateAbsent},
+		{"bob", StateLeaving},
+		{"carol", StateAbsent},
+	}
+
+	for idx, test := range tests {
+		p, err := a.Presence(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.State != test.state {
+			t.Errorf("[%d] expected %v, got %v", idx, test.state, p.State)
+		}
+	}
+
+	// carol は止まっている間に退室したことになります。
+	res := a.History(time.Time{}, time.Time{}, "carol")
+	if len(res) != 1 || !res[0].Departed.Equal(res[0].LastSeen) {
+		t.Errorf("expected carol departed at last seen, got %+v", res)
+	}
+}
@@ -0,0 +1,304 @@
+package libatnd
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/high-moctane/milbot/botlog"
+)
+
+// envMilbotAtndKey は暗号化キーを base64 で書いた環境変数です。
+const envMilbotAtndKey = "MILBOT_ATND_KEY"
+
+// envMilbotAtndKeyPath は暗号化キーファイルのパスの環境変数です。
+const envMilbotAtndKeyPath = "MILBOT_ATND_KEY_PATH"
+
+// envCredentialsDirectory は systemd の LoadCredential= で渡したファイルのあるディレクトリの環境変数です。
+const envCredentialsDirectory = "CREDENTIALS_DIRECTORY"
+
+// credentialKeyName は systemd のクレデンシャルとして渡す暗号化キーの名前です。
+const credentialKeyName = "atnd_key"
+
+// ErrKeyMismatch は今のキーが設定ファイルのキーの ID と違うので，アドレスを暗号化しないことを表すエラーです。
+// 管理者が正しいキーに戻すか，AcceptKey で今のキーを使うと決めるまで返します。
+var ErrKeyMismatch = errors.New("atnd key does not match config")
+
+// ErrKeyNotRotatable はキーファイルを使っていないのでキーを入れ替えられないことを表すエラーです。
+var ErrKeyNotRotatable = errors.New("atnd key is not rotatable")
+
+// InvalidKeyError は暗号化キーの長さが AES のキーとして使えないことを表すエラーです。
+type InvalidKeyError struct {
+	Length int
+}
+
+// Error です。
+func (e InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key length: %d", e.Length)
+}
+
+// DecryptError はメンバーの機器のアドレスを復号できなかったことを表すエラーです。
+// たいていは設定ファイルと違うキーで起動しています。
+type DecryptError struct {
+	Name   string
+	Labels []string
+	Err    error
+}
+
+// Error です。
+func (e DecryptError) Error() string {
+	return fmt.Sprintf("cannot decrypt devices of %s %v: %v", e.Name, e.Labels, e.Err)
+}
+
+// Unwrap です。
+func (e DecryptError) Unwrap() error {
+	return e.Err
+}
+
+// keyFromEnv は環境変数から暗号化キーを読みます。
+// MILBOT_ATND_KEY があればその値を，systemd のクレデンシャル atnd_key があればその中身を返します。
+// どちらもなければ nil を返し，MILBOT_ATND_KEY_PATH かデフォルトのキーファイルを使います。
+func keyFromEnv() ([]byte, error) {
+	if s := os.Getenv(envMilbotAtndKey); s != "" {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("key from env failed: %s: %w", envMilbotAtndKey, err)
+		}
+		return key, nil
+	}
+
+	if dir := os.Getenv(envCredentialsDirectory); dir != "" {
+		key, err := ioutil.ReadFile(filepath.Join(dir, credentialKeyName))
+		if err == nil {
+			return key, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("key from env failed: %w", err)
+		}
+	}
+
+	return nil, nil
+}
+
+// validateKey は key が AES のキーとして使えるかどうかを調べます。
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return InvalidKeyError{Length: len(key)}
+}
+
+// keyID は key を識別する ID を返します。キーそのものは分からないように SHA-256 の先頭を使います。
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyBackupPath は ID が id のキーを残しておくファイルのパスを返します。
+func (a *Atnd) keyBackupPath(id string) string {
+	return a.keyPath + "." + id
+}
+
+// checkKeyID は設定ファイルに書いてあるキーの ID と今のキーを比べます。
+// 設定ファイルに ID がなければ今のキーの ID を書きます。
+// キーの入れ替えの途中で止まっていて違うキーを読んでいたら，残しておいたキーに戻します。
+func (a *Atnd) checkKeyID() error {
+	id := keyID(a.encKey)
+
+	a.muConfig.Lock()
+	defer a.muConfig.Unlock()
+
+	if a.config.KeyID == "" {
+		a.config.KeyID = id
+		if err := a.dumpConfig(); err != nil {
+			return fmt.Errorf("check key id failed: %w", err)
+		}
+		return nil
+	}
+	if a.config.KeyID == id {
+		return nil
+	}
+
+	if !a.keyFixed {
+		key, err := ioutil.ReadFile(a.keyBackupPath(a.config.KeyID))
+		if err == nil && keyID(key) == a.config.KeyID {
+			if err := botdata.WriteFileAtomic(a.keyPath, key, encKeyPerm); err != nil {
+				return fmt.Errorf("check key id failed: %w", err)
+			}
+			a.encKey = key
+			botlog.Warn("atnd key restored from backup", "key_id", a.config.KeyID)
+			return nil
+		}
+	}
+
+	// 起動はして，読めないことはメンバーごとに返します。設定ファイルと違うキーで暗号化すると
+	// 読めるアドレスと読めないアドレスが混ざるので，AcceptKey まで暗号化はしません。
+	a.keyMismatch = true
+	botlog.Error("atnd key does not match config", "key_id", id, "config_key_id", a.config.KeyID)
+	return nil
+}
+
+// AcceptKey は設定ファイルと違うキーで起動しているときに，今のキーを使うことにします。
+// 設定ファイルのキーの ID を今のキーの ID にして，また登録できるようにします。
+// 今のキーで読めない機器は登録しなおすまで DecryptError のままです。
+func (a *Atnd) AcceptKey() error {
+	a.muConfig.Lock()
+	defer a.muConfig.Unlock()
+
+	oldID := a.config.KeyID
+	a.config.KeyID = keyID(a.encKey)
+	if err := a.dumpConfig(); err != nil {
+		a.config.KeyID = oldID
+		return fmt.Errorf("accept key failed: %w", err)
+	}
+	a.keyMismatch = false
+
+	botlog.Warn("atnd key accepted", "from", oldID, "to", a.config.KeyID)
+	return nil
+}
+
+// KeyMismatch は今のキーが設定ファイルのキーの ID と違うかどうかを返します。
+func (a *Atnd) KeyMismatch() bool {
+	a.muConfig.RLock()
+	defer a.muConfig.RUnlock()
+
+	return a.keyMismatch
+}
+
+// pruneKeyBackups は残しておいた古いキーを新しいものから configBackups 個だけ残して消します。
+// それより古い設定ファイルのバックアップはないので，古いキーも要りません。
+// latest は今残したキーの ID で，時刻が同じでもいちばん新しいものとして扱います。
+func (a *Atnd) pruneKeyBackups(latest string) error {
+	paths, err := filepath.Glob(a.keyPath + ".*")
+	if err != nil {
+		return fmt.Errorf("prune key backups failed: %w", err)
+	}
+
+	type backup struct {
+		id      string
+		path    string
+		modTime time.Time
+	}
+	backups := []backup{}
+	for _, path := range paths {
+		id := strings.TrimPrefix(path, a.keyPath+".")
+		if _, err := hex.DecodeString(id); err != nil || len(id) != 16 {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("prune key backups failed: %w", err)
+		}
+		backups = append(backups, backup{id, path, info.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].id == latest || backups[j].id == latest {
+			return backups[i].id == latest
+		}
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+
+	keep := a.configBackups
+	if keep < 0 {
+		keep = 0
+	}
+	for i := keep; i < len(backups); i++ {
+		if err := os.Remove(backups[i].path); err != nil {
+			return fmt.Errorf("prune key backups failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// KeyID は今の暗号化キーの ID を返します。
+func (a *Atnd) KeyID() string {
+	a.muConfig.RLock()
+	defer a.muConfig.RUnlock()
+
+	return keyID(a.encKey)
+}
+
+// RotateKey は新しい暗号化キーを作り，すべての機器のアドレスを新しいキーで暗号化しなおします。
+// 新しいキーの ID を返します。
+//
+// 古いキーはキーファイルのパスに .<ID> をつけて，設定ファイルのバックアップと同じ数だけ残します。
+// 設定ファイルのバックアップは古いキーで読めます。
+// 書いている途中で止まっても，次に起動したときに設定ファイルと合うキーに戻します。
+// キーを Options.Key や環境変数で渡しているときは ErrKeyNotRotatable を返します。
+func (a *Atnd) RotateKey() (string, error) {
+	if a.keyFixed {
+		return "", ErrKeyNotRotatable
+	}
+
+	newKey, err := a.generateNewKey()
+	if err != nil {
+		return "", fmt.Errorf("rotate key failed: %w", err)
+	}
+	newID := keyID(newKey)
+
+	a.muConfig.Lock()
+	defer a.muConfig.Unlock()
+
+	oldKey, oldID := a.encKey, keyID(a.encKey)
+
+	// 一台でも復号できなければ入れ替えません。入れ替えるとその機器は二度と読めなくなります。
+	conf := &config{Version: a.config.Version, KeyID: newID, Members: []*member{}}
+	for _, mem := range a.config.Members {
+		newMem := &member{Name: mem.Name, UserID: mem.UserID, Devices: []*device{}}
+		for _, d := range mem.Devices {
+			addr, err := decryptWithKey(oldKey, d.EncryptedAddress)
+			if err != nil {
+				return "", fmt.Errorf("rotate key failed: %w",
+					DecryptError{Name: mem.Name, Labels: []string{d.Label}, Err: err})
+			}
+			encrypted, err := encryptWithKey(newKey, addr)
+			if err != nil {
+				return "", fmt.Errorf("rotate key failed: %w", err)
+			}
+			newMem.Devices = append(newMem.Devices,
+				&device{Label: d.Label, Detector: d.Detector, EncryptedAddress: encrypted})
+		}
+		conf.Members = append(conf.Members, newMem)
+	}
+
+	// 新しいキーを先に残しておけば，設定ファイルを書いたあとで止まっても checkKeyID で戻せます。
+	if err := botdata.WriteFileAtomic(a.keyBackupPath(oldID), oldKey, encKeyPerm); err != nil {
+		return "", fmt.Errorf("rotate key failed: %w", err)
+	}
+	if err := botdata.WriteFileAtomic(a.keyBackupPath(newID), newKey, encKeyPerm); err != nil {
+		return "", fmt.Errorf("rotate key failed: %w", err)
+	}
+
+	oldConf := a.config
+	a.config = conf
+	if err := a.dumpConfig(); err != nil {
+		a.config = oldConf
+		return "", fmt.Errorf("rotate key failed: %w", err)
+	}
+	a.encKey = newKey
+	a.keyMismatch = false
+
+	if err := botdata.WriteFileAtomic(a.keyPath, newKey, encKeyPerm); err != nil {
+		return "", fmt.Errorf("rotate key failed: %w", err)
+	}
+	if err := os.Remove(a.keyBackupPath(newID)); err != nil {
+		botlog.Warn("remove new key backup failed", "error", err)
+	}
+
+	if err := a.pruneKeyBackups(oldID); err != nil {
+		botlog.Warn("prune key backups failed", "error", err)
+	}
+
+	botlog.Info("atnd key rotated", "from", oldID, "to", newID)
+	return newID, nil
+}
@@ -0,0 +1,233 @@
+package libatnd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRotateKey(t *testing.T) {
+	a := newTestAtnd(t, new(recordDetector), nil)
+	if err := a.SetMember("alice", "01:23:45:67:89:ab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetMemberWiFi("alice", "aa:bb:cc:dd:ee:ff"); err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey, err := ioutil.ReadFile(a.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := a.KeyID()
+
+	newID, err := a.RotateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == oldID || a.KeyID() != newID {
+		t.Errorf("key not rotated: %s -> %s", oldID, a.KeyID())
+	}
+
+	newKey, err := ioutil.ReadFile(a.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID(newKey) != newID {
+		t.Errorf("unexpected key file: %s", keyID(newKey))
+	}
+	if backup, err := ioutil.ReadFile(a.keyBackupPath(oldID)); err != nil || !bytes.Equal(backup, oldKey) {
+		t.Errorf("old key not kept: %v", err)
+	}
+	if _, err := os.Stat(a.keyBackupPath(newID)); !os.IsNotExist(err) {
+		t.Errorf("new key backup not removed: %v", err)
+	}
+
+	conf, err := a.loadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.KeyID != newID {
+		t.Errorf("expected key id %s, got %s", newID, conf.KeyID)
+	}
+
+	devices, err := a.findDevices("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Device{
+		{Label: "bluetooth", Address: "01:23:45:67:89:ab"},
+		{Label: "wifi", Detector: "lan", Address: "aa:bb:cc:dd:ee:ff"},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("expected %+v, got %+v", expected, devices)
+	}
+
+	// 設定ファイルを書いたあとキーファイルを書く前に止まったら，残しておいた新しいキーに戻します。
+	if err := ioutil.WriteFile(a.keyPath, oldKey, encKeyPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(a.keyBackupPath(newID), newKey, encKeyPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestAtndWithOptions(t, Options{
+		ConfigPath:  a.confPath,
+		KeyPath:     a.keyPath,
+		HistoryPath: a.history.path,
+		Detector:    new(recordDetector),
+	}, nil)
+	if b.KeyID() != newID {
+		t.Errorf("expected key id %s, got %s", newID, b.KeyID())
+	}
+	if restored, _ := ioutil.ReadFile(a.keyPath); !bytes.Equal(restored, newKey) {
+		t.Error("key file not restored")
+	}
+	if _, err := b.findDevices("alice"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyMismatch(t *testing.T) {
+	a := newTestAtnd(t, new(recordDetector), nil)
+	if err := a.SetMember("alice", "01:23:45:67:89:ab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetMember("bob", "01:23:45:67:89:ac"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 違うキーで起動しても，復号できないことはメンバーごとに返します。
+	b := newTestAtndWithOptions(t, Options{
+		ConfigPath:  a.confPath,
+		HistoryPath: a.history.path,
+		Key:         bytes.Repeat([]byte{1}, 32),
+		Detector:    new(recordDetector),
+	}, nil)
+
+	res, err := b.ScanContext(context.Background())
+	if err == nil {
+		t.Error("expected error")
+	}
+	for _, name := range []string{"alice", "bob"} {
+		var decryptErr DecryptError
+		if !errors.As(res.Errors[name], &decryptErr) || decryptErr.Name != name {
+			t.Errorf("expected DecryptError for %s, got %v", name, res.Errors[name])
+		}
+	}
+
+	if _, err := b.RotateKey(); !errors.Is(err, ErrKeyNotRotatable) {
+		t.Errorf("expected ErrKeyNotRotatable, got %v", err)
+	}
+
+	// 今のキーを使うと決めるまでは，違うキーで暗号化しません。
+	if !b.KeyMismatch() {
+		t.Error("key mismatch not recorded")
+	}
+	if err := b.SetMember("alice", "01:23:45:67:89:ab"); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+	if err := b.AcceptKey(); err != nil {
+		t.Fatal(err)
+	}
+	if b.KeyMismatch() {
+		t.Error("key mismatch not cleared")
+	}
+	if conf, err := b.loadConfigFile(); err != nil || conf.KeyID != b.KeyID() {
+		t.Errorf("key id not saved: %+v, %v", conf, err)
+	}
+
+	// 登録しなおせばそのメンバーは判定できます。
+	if err := b.SetMember("alice", "01:23:45:67:89:ab"); err != nil {
+		t.Fatal(err)
+	}
+	res, err = b.ScanContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Errors["alice"]; ok || res.Errors["bob"] == nil {
+		t.Errorf("unexpected errors: %v", res.Errors)
+	}
+}
+
+func TestPruneKeyBackups(t *testing.T) {
+	a := newTestAtnd(t, new(recordDetector), map[string]string{"alice": "01:23:45:67:89:ab"})
+
+	ids := []string{}
+	for i := 0; i < a.configBackups+2; i++ {
+		ids = append(ids, a.KeyID())
+		if _, err := a.RotateKey(); err != nil {
+			t.Fatalf("[%d] unexpected error: %v", i, err)
+		}
+		// 続けて入れ替えても順番がわかるように時刻をずらします。
+		mtime := time.Date(2020, 1, 1, 0, i, 0, 0, time.UTC)
+		if err := os.Chtimes(a.keyBackupPath(ids[i]), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for idx, id := range ids {
+		_, err := os.Stat(a.keyBackupPath(id))
+		if kept := idx >= len(ids)-a.configBackups; kept && err != nil {
+			t.Errorf("[%d] key backup removed: %v", idx, err)
+		} else if !kept && !os.IsNotExist(err) {
+			t.Errorf("[%d] key backup not removed: %v", idx, err)
+		}
+	}
+	if _, err := os.Stat(a.keyPath); err != nil {
+		t.Errorf("key file removed: %v", err)
+	}
+}
+
+func TestKeyFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "milbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	credKey := bytes.Repeat([]byte{2}, 32)
+	if err := ioutil.WriteFile(filepath.Join(dir, credentialKeyName), credKey, encKeyPerm); err != nil {
+		t.Fatal(err)
+	}
+	envKey := bytes.Repeat([]byte{3}, 32)
+
+	tests := []struct {
+		env      string
+		credDir  string
+		expected []byte
+		isErr    bool
+	}{
+		{"", "", nil, false},
+		{base64.StdEncoding.EncodeToString(envKey), dir, envKey, false},
+		{"", dir, credKey, false},
+		{"", filepath.Join(dir, "none"), nil, false},
+		{"!!!", "", nil, true},
+	}
+	for idx, test := range tests {
+		os.Setenv(envMilbotAtndKey, test.env)
+		os.Setenv(envCredentialsDirectory, test.credDir)
+
+		key, err := keyFromEnv()
+		if (err != nil) != test.isErr {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+		}
+		if !bytes.Equal(key, test.expected) {
+			t.Errorf("[%d] expected %v, got %v", idx, test.expected, key)
+		}
+	}
+	os.Unsetenv(envMilbotAtndKey)
+	os.Unsetenv(envCredentialsDirectory)
+}
@@ -0,0 +1,54 @@
+package libatnd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// ErrL2pingNotFound は l2ping が $PATH にないときのエラーです。
+var ErrL2pingNotFound = errors.New("l2ping not found in $PATH")
+
+// L2pingDetector は l2ping を使って在室判定をする Detector です。
+type L2pingDetector struct{}
+
+// Detect は target のアドレスに順に l2ping を送って，どれかが応答したらいると判定します。
+func (d *L2pingDetector) Detect(ctx context.Context, target Target) (Result, error) {
+	if len(target.Addresses) == 0 {
+		return Result{Present: false, Reason: "no Bluetooth address registered"}, nil
+	}
+
+	for _, addr := range target.Addresses {
+		exist, err := d.sendPing(ctx, addr)
+		if err != nil {
+			return Result{}, err
+		}
+		if exist {
+			return Result{Present: true, Reason: "l2ping replied", Source: "l2ping"}, nil
+		}
+	}
+	return Result{Present: false, Reason: "no reply to l2ping"}, nil
+}
+
+// sendPing は メンバーがいる場合に true になります。
+func (*L2pingDetector) sendPing(ctx context.Context, addr string) (bool, error) {
+	stdout := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, "l2ping", "-c", "1", addr)
+	cmd.Stdout = stdout
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		} else if errors.Is(err, exec.ErrNotFound) {
+			return false, ErrL2pingNotFound
+		} else if strings.Contains(stdout.String(), "No route to host") {
+			return false, ErrBluetoothNotAvailable
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
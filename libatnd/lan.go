@@ -0,0 +1,190 @@
+package libatnd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// procNetARPPath は ip コマンドがないときに使う ARP テーブルのパスです。
+const procNetARPPath = "/proc/net/arp"
+
+// lanProbeTimeout は近隣テーブルを更新するために送る ping のタイムアウト時間です。
+const lanProbeTimeout = 2 * time.Second
+
+// LANDetector は研究室の LAN の近隣テーブルで在室判定をする Detector です。
+// Bluetooth を切っているメンバーでも，研究室の Wi-Fi につながっていれば判定できます。
+//
+// 近隣テーブルは `ip neigh show` か /proc/net/arp から読みます。
+// 到達可能なエントリがなければ，STALE などのエントリの IP と，DHCP のリースファイルがあれば
+// リースの IP に ping を送って近隣テーブルを更新してから判定し直します。
+type LANDetector struct {
+	leasesPath string
+
+	neighbors func(ctx context.Context) ([]*Neighbor, error)
+	probe     func(ctx context.Context, ip string)
+	now       func() time.Time
+}
+
+// NewLANDetector は LANDetector を作ります。leasesPath は dnsmasq か ISC DHCP の
+// リースファイルのパスで，空ならリースを使いません。
+func NewLANDetector(leasesPath string) *LANDetector {
+	return &LANDetector{
+		leasesPath: leasesPath,
+		neighbors:  readNeighbors,
+		probe:      pingProbe,
+		now:        time.Now,
+	}
+}
+
+// Detect は target の Wi-Fi の MAC アドレスが近隣テーブルで到達可能ならいると判定します。
+func (d *LANDetector) Detect(ctx context.Context, target Target) (Result, error) {
+	if len(target.WiFiAddresses) == 0 {
+		return Result{Present: false, Reason: "no Wi-Fi address registered"}, nil
+	}
+
+	macs := map[string]bool{}
+	for _, addr := range target.WiFiAddresses {
+		macs[strings.ToLower(addr)] = true
+	}
+
+	neighbors, err := d.neighbors(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	if res, ok := d.match(neighbors, macs); ok {
+		return res, nil
+	}
+
+	// 電波を節約している Wi-Fi の端末は STALE のままのことが多いので，IP が分かれば ping を送って
+	// 近隣テーブルを更新させてから判定し直します。
+	ips := d.staleIPs(neighbors, macs)
+	if d.leasesPath != "" {
+		leaseIPs, err := d.leaseIPs(macs)
+		if err != nil {
+			return Result{}, err
+		}
+		ips = appendUnique(ips, leaseIPs...)
+	}
+	if len(ips) == 0 {
+		return d.absent(neighbors, macs), nil
+	}
+	for _, ip := range ips {
+		d.probe(ctx, ip)
+	}
+
+	neighbors, err = d.neighbors(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	if res, ok := d.match(neighbors, macs); ok {
+		res.Reason += " after probing"
+		return res, nil
+	}
+	return d.absent(neighbors, macs), nil
+}
+
+// staleIPs は neighbors のうち，macs の到達可能でないエントリの IP を返します。
+func (*LANDetector) staleIPs(neighbors []*Neighbor, macs map[string]bool) []string {
+	res := []string{}
+	for _, n := range neighbors {
+		if macs[n.MAC] && !n.Reachable() && n.IP != "" {
+			res = appendUnique(res, n.IP)
+		}
+	}
+	return res
+}
+
+// appendUnique は ips のうち s にないものを s に加えます。
+func appendUnique(s []string, ips ...string) []string {
+	for _, ip := range ips {
+		found := false
+		for _, v := range s {
+			if v == ip {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, ip)
+		}
+	}
+	return s
+}
+
+// match は neighbors に macs の到達可能なエントリがあれば，いると判定した Result を返します。
+func (*LANDetector) match(neighbors []*Neighbor, macs map[string]bool) (Result, bool) {
+	for _, n := range neighbors {
+		if macs[n.MAC] && n.Reachable() {
+			return Result{Present: true, Reason: "neighbor entry " + n.State, Source: "lan"}, true
+		}
+	}
+	return Result{}, false
+}
+
+// absent はいないと判定した Result を返します。
+func (*LANDetector) absent(neighbors []*Neighbor, macs map[string]bool) Result {
+	for _, n := range neighbors {
+		if macs[n.MAC] {
+			return Result{Present: false, Reason: "neighbor entry " + n.State}
+		}
+	}
+	return Result{Present: false, Reason: "not in neighbor table"}
+}
+
+// leaseIPs はリースファイルから macs の有効なリースの IP を返します。
+func (d *LANDetector) leaseIPs(macs map[string]bool) ([]string, error) {
+	data, err := ioutil.ReadFile(d.leasesPath)
+	if err != nil {
+		return nil, fmt.Errorf("read leases failed: %w", err)
+	}
+	leases, err := ParseLeases(data)
+	if err != nil {
+		return nil, fmt.Errorf("read leases failed: %w", err)
+	}
+
+	now := d.now()
+	res := []string{}
+	for _, l := range leases {
+		if macs[l.MAC] && l.Active(now) {
+			res = append(res, l.IP)
+		}
+	}
+	return res, nil
+}
+
+// readNeighbors は `ip neigh show` で近隣テーブルを読みます。
+// ip コマンドがなければ /proc/net/arp を読みます。
+func readNeighbors(ctx context.Context) ([]*Neighbor, error) {
+	stdout := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, "ip", "neigh", "show")
+	cmd.Stdout = stdout
+
+	err := cmd.Run()
+	if err == nil {
+		return ParseIPNeigh(stdout)
+	} else if !errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("read neighbors failed: %w", err)
+	}
+
+	f, err := os.Open(procNetARPPath)
+	if err != nil {
+		return nil, fmt.Errorf("read neighbors failed: %w", err)
+	}
+	defer f.Close()
+	return ParseProcNetARP(f)
+}
+
+// pingProbe は ip に ping を 1 回送って近隣テーブルを更新させます。結果は見ません。
+func pingProbe(ctx context.Context, ip string) {
+	ctx, cancel := context.WithTimeout(ctx, lanProbeTimeout)
+	defer cancel()
+
+	_ = exec.CommandContext(ctx, "ping", "-c", "1", "-W", "1", ip).Run()
+}
@@ -0,0 +1,177 @@
+package libatnd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIPNeigh(t *testing.T) {
+	f, err := os.Open("testdata/ip_neigh.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	neighbors, err := ParseIPNeigh(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Neighbor{
+		{IP: "192.168.1.1", MAC: "00:11:22:33:44:55", Device: "wlan0", State: "REACHABLE"},
+		{IP: "192.168.1.10", MAC: "aa:bb:cc:dd:ee:01", Device: "wlan0", State: "STALE"},
+		{IP: "192.168.1.11", MAC: "aa:bb:cc:dd:ee:02", Device: "wlan0", State: "DELAY"},
+		{IP: "192.168.1.12", Device: "wlan0", State: "FAILED"},
+		{IP: "fe80::1", MAC: "00:11:22:33:44:55", Device: "wlan0", State: "REACHABLE"},
+	}
+	if !reflect.DeepEqual(neighbors, expected) {
+		t.Errorf("expected %+v, got %+v", expected, neighbors)
+	}
+}
+
+func TestParseProcNetARP(t *testing.T) {
+	f, err := os.Open("testdata/proc_net_arp.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	neighbors, err := ParseProcNetARP(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Neighbor{
+		{IP: "192.168.1.1", MAC: "00:11:22:33:44:55", Device: "wlan0", State: "COMPLETE"},
+		{IP: "192.168.1.10", MAC: "aa:bb:cc:dd:ee:01", Device: "wlan0", State: "COMPLETE"},
+		{IP: "192.168.1.12", Device: "wlan0", State: "INCOMPLETE"},
+	}
+	if !reflect.DeepEqual(neighbors, expected) {
+		t.Errorf("expected %+v, got %+v", expected, neighbors)
+	}
+}
+
+func TestParseLeases(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []*Lease
+	}{
+		{
+			"testdata/dnsmasq.leases",
+			[]*Lease{
+				{IP: "192.168.1.10", MAC: "aa:bb:cc:dd:ee:01", Hostname: "alice-phone", Expiry: time.Unix(1577880000, 0)},
+				{IP: "192.168.1.13", MAC: "aa:bb:cc:dd:ee:03", Expiry: time.Unix(1577800000, 0)},
+				{IP: "192.168.1.14", MAC: "aa:bb:cc:dd:ee:04", Hostname: "printer"},
+			},
+		},
+		{
+			"testdata/dhcpd.leases",
+			[]*Lease{
+				{IP: "192.168.1.10", MAC: "aa:bb:cc:dd:ee:01", Hostname: "alice-phone",
+					Expiry: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)},
+			},
+		},
+	}
+
+	for idx, test := range tests {
+		data, err := ioutil.ReadFile(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases, err := ParseLeases(data)
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+			continue
+		}
+		if !reflect.DeepEqual(leases, test.expected) {
+			t.Errorf("[%d] expected %+v, got %+v", idx, test.expected, leases)
+		}
+	}
+}
+
+func TestParseISCLeasesMalformed(t *testing.T) {
+	// 手で書き換えて ; だけになった行があっても読めます。
+	data := "lease 192.168.1.10 {\n" +
+		"  ;\n" +
+		"  ends 3 2020/01/01 12:00:00;\n" +
+		"  binding state active;\n" +
+		" ; \n" +
+		"  hardware ethernet aa:bb:cc:dd:ee:01;\n" +
+		"}\n" +
+		";\n"
+
+	leases, err := ParseISCLeases(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Lease{
+		{IP: "192.168.1.10", MAC: "aa:bb:cc:dd:ee:01", Expiry: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(leases, expected) {
+		t.Errorf("expected %+v, got %+v", expected, leases)
+	}
+}
+
+func TestLANDetector(t *testing.T) {
+	f, err := os.Open("testdata/ip_neigh.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	neighbors, err := ParseIPNeigh(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ping に応答しない STALE の端末です。
+	neighbors = append(neighbors, &Neighbor{IP: "192.168.1.15", MAC: "aa:bb:cc:dd:ee:05", State: "STALE"})
+
+	tests := []struct {
+		leases  string
+		macs    []string
+		present bool
+		probed  []string
+	}{
+		{"", []string{"AA:BB:CC:DD:EE:02"}, true, nil},
+		// STALE のエントリは IP に ping を送ってから判定します。
+		{"", []string{"aa:bb:cc:dd:ee:01"}, true, []string{"192.168.1.10"}},
+		{"", []string{"aa:bb:cc:dd:ee:05"}, false, []string{"192.168.1.15"}},
+		{"", []string{"aa:bb:cc:dd:ee:09"}, false, nil},
+		{"", nil, false, nil},
+		{"testdata/dnsmasq.leases", []string{"aa:bb:cc:dd:ee:01"}, true, []string{"192.168.1.10"}},
+		{"testdata/dnsmasq.leases", []string{"aa:bb:cc:dd:ee:03"}, false, nil},
+		{"testdata/dnsmasq.leases", []string{"aa:bb:cc:dd:ee:04"}, false, []string{"192.168.1.14"}},
+	}
+
+	for idx, test := range tests {
+		probed := []string{}
+		current := neighbors
+
+		d := NewLANDetector(test.leases)
+		d.now = func() time.Time { return time.Unix(1577850000, 0) }
+		d.neighbors = func(context.Context) ([]*Neighbor, error) { return current, nil }
+		d.probe = func(_ context.Context, ip string) {
+			probed = append(probed, ip)
+			// ping に応答したら近隣テーブルが REACHABLE になります。
+			if ip == "192.168.1.10" {
+				current = append([]*Neighbor{{IP: ip, MAC: "aa:bb:cc:dd:ee:01", State: "REACHABLE"}}, neighbors...)
+			}
+		}
+
+		res, err := d.Detect(context.Background(), Target{Name: "alice", WiFiAddresses: test.macs})
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+			continue
+		}
+		if res.Present != test.present {
+			t.Errorf("[%d] expected present %v, got %v (%s)", idx, test.present, res.Present, res.Reason)
+		}
+		if len(probed) != len(test.probed) || (len(probed) > 0 && !reflect.DeepEqual(probed, test.probed)) {
+			t.Errorf("[%d] expected probed %v, got %v", idx, test.probed, probed)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package libatnd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Neighbor は近隣テーブル (ARP テーブル) のひとつのエントリです。
+type Neighbor struct {
+	IP     string
+	MAC    string // 小文字の MAC アドレスです。わからなければ空です。
+	Device string
+	State  string // REACHABLE や STALE などの状態です。/proc/net/arp では COMPLETE か INCOMPLETE です。
+}
+
+// Reachable は最近通信が確認できたエントリかどうかを返します。
+func (n *Neighbor) Reachable() bool {
+	switch n.State {
+	case "REACHABLE", "DELAY", "PROBE", "PERMANENT", "COMPLETE":
+		return true
+	}
+	return false
+}
+
+// ParseIPNeigh は `ip neigh show` の出力を読みます。
+//
+//	192.168.1.10 dev wlan0 lladdr aa:bb:cc:dd:ee:ff REACHABLE
+func ParseIPNeigh(r io.Reader) ([]*Neighbor, error) {
+	res := []*Neighbor{}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		n := &Neighbor{IP: fields[0], State: fields[len(fields)-1]}
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "dev":
+				n.Device = fields[i+1]
+			case "lladdr":
+				n.MAC = strings.ToLower(fields[i+1])
+			}
+		}
+		res = append(res, n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("parse ip neigh failed: %w", err)
+	}
+
+	return res, nil
+}
+
+// arpFlagComplete は /proc/net/arp の Flags の解決済みを表すビットです。
+const arpFlagComplete = 0x2
+
+// ParseProcNetARP は /proc/net/arp を読みます。
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        wlan0
+func ParseProcNetARP(r io.Reader) ([]*Neighbor, error) {
+	res := []*Neighbor{}
+
+	sc := bufio.NewScanner(r)
+	for first := true; sc.Scan(); first = false {
+		fields := strings.Fields(sc.Text())
+		if first || len(fields) < 6 {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+		if err != nil {
+			continue
+		}
+		n := &Neighbor{IP: fields[0], Device: fields[5], State: "INCOMPLETE"}
+		if flags&arpFlagComplete != 0 {
+			n.MAC = strings.ToLower(fields[3])
+			n.State = "COMPLETE"
+		}
+		res = append(res, n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("parse /proc/net/arp failed: %w", err)
+	}
+
+	return res, nil
+}
+
+// Lease は DHCP のリースです。
+type Lease struct {
+	IP       string
+	MAC      string // 小文字の MAC アドレスです。
+	Hostname string
+	Expiry   time.Time // リースが切れる時間です。無期限ならゼロ値です。
+}
+
+// Active は now にリースが有効かどうかを返します。
+func (l *Lease) Active(now time.Time) bool {
+	return l.Expiry.IsZero() || now.Before(l.Expiry)
+}
+
+// ParseLeases は dnsmasq か ISC DHCP のリースファイルを読みます。形式は中身で判断します。
+func ParseLeases(data []byte) ([]*Lease, error) {
+	if bytes.Contains(data, []byte("lease ")) && bytes.Contains(data, []byte("{")) {
+		return ParseISCLeases(bytes.NewReader(data))
+	}
+	return ParseDnsmasqLeases(bytes.NewReader(data))
+}
+
+// ParseDnsmasqLeases は dnsmasq のリースファイルを読みます。
+//
+//	1577880000 aa:bb:cc:dd:ee:ff 192.168.1.10 alice-phone 01:aa:bb:cc:dd:ee:ff
+func ParseDnsmasqLeases(r io.Reader) ([]*Lease, error) {
+	res := []*Lease{}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || !IsValidMACAddress(fields[1]) {
+			continue
+		}
+
+		l := &Lease{IP: fields[2], MAC: strings.ToLower(fields[1])}
+		if fields[3] != "*" {
+			l.Hostname = fields[3]
+		}
+		if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expiry > 0 {
+			l.Expiry = time.Unix(expiry, 0)
+		}
+		res = append(res, l)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("parse dnsmasq leases failed: %w", err)
+	}
+
+	return res, nil
+}
+
+// ParseISCLeases は ISC DHCP サーバの dhcpd.leases を読みます。
+// 同じ IP のリースが複数あるときは後のものが新しいです。
+//
+//	lease 192.168.1.10 {
+//	  ends 3 2020/01/01 12:00:00;
+//	  binding state active;
+//	  hardware ethernet aa:bb:cc:dd:ee:ff;
+//	  client-hostname "alice-phone";
+//	}
+func ParseISCLeases(r io.Reader) ([]*Lease, error) {
+	res := []*Lease{}
+	var cur *Lease
+	active := false
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "lease" && len(fields) >= 2:
+			cur, active = &Lease{IP: fields[1]}, false
+
+		case cur == nil:
+
+		case fields[0] == "}":
+			if active && cur.MAC != "" {
+				res = append(res, cur)
+			}
+			cur = nil
+
+		case fields[0] == "ends" && len(fields) >= 4:
+			if t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+				cur.Expiry = t
+			}
+
+		case fields[0] == "binding" && len(fields) >= 3 && fields[1] == "state":
+			active = fields[2] == "active"
+
+		case fields[0] == "hardware" && len(fields) >= 3:
+			cur.MAC = strings.ToLower(fields[2])
+
+		case fields[0] == "client-hostname" && len(fields) >= 2:
+			cur.Hostname = strings.Trim(fields[1], `"`)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("parse ISC leases failed: %w", err)
+	}
+
+	return res, nil
+}
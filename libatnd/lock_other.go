@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package libatnd
+
+import "os"
+
+// lockFile は flock のない OS では何もしません。
+func lockFile(*os.File) error {
+	return nil
+}
+
+// unlockFile は flock のない OS では何もしません。
+func unlockFile(*os.File) error {
+	return nil
+}
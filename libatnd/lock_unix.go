@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package libatnd
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile は f に排他的なアドバイザリロックをかけます。待たずに ErrConfigLocked を返します。
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrConfigLocked
+	}
+	return err
+}
+
+// unlockFile は f のロックを外します。
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,146 @@
+package libatnd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/high-moctane/milbot/botdata"
+)
+
+// configVersion は今の設定ファイルの形式のバージョンです。
+// 形式を変えたら上げて，configMigrations に前のバージョンからの移行を追加してください。
+const configVersion = 3
+
+// configMigration は設定ファイルをひとつ前のバージョンから移行します。
+// doc は JSON をそのまま読んだもので，書き換えて次のバージョンの形にします。
+type configMigration func(doc map[string]interface{}) error
+
+// configMigrations はバージョン i から i+1 への移行です。
+var configMigrations = []configMigration{
+	migrateConfigDevices,
+	migrateConfigKeyID,
+	migrateConfigUserID,
+}
+
+// UnsupportedConfigVersionError は設定ファイルがこの milbot より新しい形式であることを表すエラーです。
+// 古い milbot で読むとデータを落としてしまうので起動しません。
+type UnsupportedConfigVersionError struct {
+	Version   int
+	Supported int
+}
+
+// Error です。
+func (e UnsupportedConfigVersionError) Error() string {
+	return fmt.Sprintf("unsupported config version: %d (supported up to %d)", e.Version, e.Supported)
+}
+
+// migrateConfig は設定ファイルの中身 data を今のバージョンに移行します。
+// 移行前のバージョンと，移行した中身を返します。移行しなくてよければ data をそのまま返します。
+func migrateConfig(data []byte) (int, []byte, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, nil, fmt.Errorf("migrate config failed: %w", err)
+	}
+
+	version := 0
+	if v, ok := doc["version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || f < 0 {
+			return 0, nil, fmt.Errorf("migrate config failed: invalid version %v", v)
+		}
+		version = int(f)
+	}
+
+	if version > configVersion {
+		return version, nil, UnsupportedConfigVersionError{Version: version, Supported: configVersion}
+	}
+	if version == configVersion {
+		return version, data, nil
+	}
+
+	for v := version; v < configVersion; v++ {
+		if err := configMigrations[v](doc); err != nil {
+			return version, nil, fmt.Errorf("migrate config from version %d failed: %w", v, err)
+		}
+		doc["version"] = v + 1
+	}
+
+	migrated, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return version, nil, fmt.Errorf("migrate config failed: %w", err)
+	}
+	return version, append(migrated, '\n'), nil
+}
+
+// backupConfig は移行する前の設定ファイルの中身 data を version のバックアップとして書き出します。
+func (a *Atnd) backupConfig(data []byte, version int) (string, error) {
+	path := a.confPath + ".v" + strconv.Itoa(version) + ".bak"
+	if err := botdata.WriteFileAtomic(path, data, configPerm); err != nil {
+		return "", fmt.Errorf("backup config failed: %w", err)
+	}
+	return path, nil
+}
+
+// migrateConfigDevices はバージョン 0 から 1 への移行です。
+// メンバーのひとつの Bluetooth アドレスと Wi-Fi の MAC アドレスを，ラベルをつけた機器に移します。
+//
+//	{"name": "alice", "encrypted_address": "...", "encrypted_wifi_address": "..."}
+//
+// は
+//
+//	{"name": "alice", "devices": [
+//	  {"label": "bluetooth", "encrypted_address": "..."},
+//	  {"label": "wifi", "detector": "lan", "encrypted_address": "..."}
+//	]}
+//
+// になります。
+func migrateConfigDevices(doc map[string]interface{}) error {
+	members, _ := doc["members"].([]interface{})
+	for i, m := range members {
+		mem, ok := m.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("member %d is not an object", i)
+		}
+
+		devices, _ := mem["devices"].([]interface{})
+		if devices == nil {
+			devices = []interface{}{}
+		}
+		if addr, ok := mem["encrypted_address"]; ok && addr != nil && addr != "" {
+			devices = append(devices, map[string]interface{}{
+				"label":             defaultBluetoothLabel,
+				"encrypted_address": addr,
+			})
+		}
+		if addr, ok := mem["encrypted_wifi_address"]; ok && addr != nil && addr != "" {
+			devices = append(devices, map[string]interface{}{
+				"label":             defaultWiFiLabel,
+				"detector":          "lan",
+				"encrypted_address": addr,
+			})
+		}
+
+		delete(mem, "encrypted_address")
+		delete(mem, "encrypted_wifi_address")
+		mem["devices"] = devices
+	}
+	return nil
+}
+
+// migrateConfigKeyID はバージョン 1 から 2 への移行です。
+// 暗号化キーの ID の key_id を追加します。移行するときにはどのキーで暗号化したか分からないので，
+// 空にしておいて起動したときに今のキーの ID を書きます。
+func migrateConfigKeyID(doc map[string]interface{}) error {
+	if _, ok := doc["key_id"]; !ok {
+		doc["key_id"] = ""
+	}
+	return nil
+}
+
+// migrateConfigUserID はバージョン 2 から 3 への移行です。
+// メンバーに登録した Slack のユーザ ID の user_id が増えました。
+// 今までのメンバーは誰が登録したか分からないので，持ち主のいないメンバーのままにします。
+func migrateConfigUserID(doc map[string]interface{}) error {
+	return nil
+}
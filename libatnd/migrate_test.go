@@ -0,0 +1,116 @@
+package libatnd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		isErr   bool
+	}{
+		{"v0_legacy", 0, false},
+		{"v0_devices", 0, false},
+		{"v1", 1, false},
+		{"v2", 2, false},
+		{"v3", 3, false},
+		{"v4", 4, true},
+	}
+
+	for idx, test := range tests {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "config", test.name+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version, migrated, err := migrateConfig(data)
+		if version != test.version {
+			t.Errorf("[%d] expected version %d, got %d", idx, test.version, version)
+		}
+		if (err != nil) != test.isErr {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		expectedData, err := ioutil.ReadFile(filepath.Join("testdata", "config", test.name+".expected.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected, actual interface{}
+		if err := json.Unmarshal(expectedData, &expected); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(migrated, &actual); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("[%d] expected %v, got %v", idx, expected, actual)
+		}
+	}
+}
+
+func TestLoadConfigFileMigration(t *testing.T) {
+	a := newTestAtnd(t, new(recordDetector), nil)
+
+	legacy, err := ioutil.ReadFile("testdata/config/v0_legacy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(a.confPath, legacy, configPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := a.loadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Version != configVersion || len(conf.Members) != 2 || len(conf.Members[0].Devices) != 2 {
+		t.Errorf("unexpected config: %+v", conf)
+	}
+
+	backup, err := ioutil.ReadFile(a.confPath + ".v0.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != string(legacy) {
+		t.Errorf("unexpected backup: %s", backup)
+	}
+
+	// 新しいバージョンの設定ファイルでは起動しません。
+	future, err := ioutil.ReadFile("testdata/config/v4.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(a.confPath, future, configPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(Options{
+		ConfigPath:  a.confPath,
+		KeyPath:     a.keyPath,
+		HistoryPath: a.history.path,
+		Scheduler:   new(nopScheduler),
+	})
+	var versionErr UnsupportedConfigVersionError
+	if !errors.As(err, &versionErr) || versionErr.Version != 4 {
+		t.Errorf("expected UnsupportedConfigVersionError, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(a.confPath); !strings.Contains(string(data), `"groups"`) {
+		t.Error("future config overwritten")
+	}
+	if _, err := os.Stat(a.confPath + ".v4.bak"); !os.IsNotExist(err) {
+		t.Errorf("unexpected backup of future config: %v", err)
+	}
+}
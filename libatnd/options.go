@@ -0,0 +1,167 @@
+package libatnd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/high-moctane/milbot/botdata"
+	"github.com/robfig/cron/v3"
+)
+
+// envMilbotAtndScanConcurrency は同時に在室判定をするメンバーの数の環境変数です。
+const envMilbotAtndScanConcurrency = "MILBOT_ATND_SCAN_CONCURRENCY"
+
+// envMilbotAtndProbeTimeout はひとりの在室判定のタイムアウト時間の環境変数です。
+const envMilbotAtndProbeTimeout = "MILBOT_ATND_PROBE_TIMEOUT"
+
+// envMilbotAtndScanDeadline は Search 全体の期限の環境変数です。
+const envMilbotAtndScanDeadline = "MILBOT_ATND_SCAN_DEADLINE"
+
+// envMilbotAtndMissThreshold は在室していたメンバーを退室したとみなすまでに必要な，
+// 連続して見つからなかった回数の環境変数です。
+const envMilbotAtndMissThreshold = "MILBOT_ATND_MISS_THRESHOLD"
+
+// envMilbotAtndDepartureGrace は最後に見つかってから退室したとみなすまでの最短の時間の環境変数です。
+const envMilbotAtndDepartureGrace = "MILBOT_ATND_DEPARTURE_GRACE"
+
+// envMilbotAtndHistoryRetention は在室履歴を残す期間の環境変数です。
+const envMilbotAtndHistoryRetention = "MILBOT_ATND_HISTORY_RETENTION"
+
+// envMilbotAtndConfigBackups は設定ファイルのバックアップを残す数の環境変数です。
+const envMilbotAtndConfigBackups = "MILBOT_ATND_CONFIG_BACKUPS"
+
+// Scheduler は定時の Search を実行するスケジューラです。*cron.Cron が使えます。
+// 起動と停止は Scheduler を渡した側でしてください。
+type Scheduler interface {
+	AddFunc(spec string, cmd func()) (cron.EntryID, error)
+	Entry(id cron.EntryID) cron.Entry
+}
+
+// Options は New で Atnd を作るときの設定です。ゼロ値の項目はデフォルト値になります。
+type Options struct {
+	// ConfigPath は設定ファイルのパスです。デフォルトはデータディレクトリの atnd_config.json です。
+	ConfigPath string
+
+	// KeyPath は暗号化キーファイルのパスです。デフォルトはデータディレクトリの .atnd_key です。
+	KeyPath string
+
+	// Key は暗号化キーです。nil でなければ KeyPath は使わず，RotateKey もできません。
+	Key []byte
+
+	// ConfigBackups は設定ファイルを書き換えるときに残すバックアップの数です。デフォルトは 3 です。
+	// 負の値ならバックアップを残しません。
+	ConfigBackups int
+
+	// HistoryPath は在室履歴のファイルのパスです。デフォルトはデータディレクトリの atnd_history.jsonl です。
+	HistoryPath string
+
+	// HistoryRetention は退室してから在室履歴を残しておく期間です。デフォルトは 90 日です。
+	HistoryRetention time.Duration
+
+	// Clock は今の時間を返します。デフォルトは time.Now です。
+	Clock func() time.Time
+
+	// Detector は在室判定をします。デフォルトは L2pingDetector です。
+	Detector Detector
+
+	// Detectors は機器の Detector の種類 (l2ping, ble, lan) ごとの Detector です。
+	// nil なら機器の種類によらず Detector を使います。
+	Detectors map[string]Detector
+
+	// Scheduler は定時の Search を実行します。デフォルトは New の中で起動する cron です。
+	Scheduler Scheduler
+
+	// ScanConcurrency は同時に在室判定をするメンバーの数です。デフォルトは 4 です。
+	ScanConcurrency int
+
+	// ProbeTimeout はひとりの在室判定のタイムアウト時間です。デフォルトは 15 秒です。
+	ProbeTimeout time.Duration
+
+	// ScanDeadline は Search 全体の期限です。デフォルトは 60 秒です。
+	ScanDeadline time.Duration
+
+	// MissThreshold は在室していたメンバーを退室したとみなすまでに必要な，
+	// 連続して見つからなかった回数です。デフォルトは 3 回です。
+	MissThreshold int
+
+	// DepartureGrace は最後に見つかってから退室したとみなすまでの最短の時間です。
+	// デフォルトは 15 分です。
+	DepartureGrace time.Duration
+}
+
+// OptionsFromEnv は環境変数から Options を作ります。
+func OptionsFromEnv() (Options, error) {
+	detector, detectors, err := detectorFromEnv()
+	if err != nil {
+		return Options{}, fmt.Errorf("options from env failed: %w", err)
+	}
+
+	key, err := keyFromEnv()
+	if err != nil {
+		return Options{}, fmt.Errorf("options from env failed: %w", err)
+	}
+
+	opts := Options{Detector: detector, Detectors: detectors, Key: key}
+	opts.KeyPath = os.Getenv(envMilbotAtndKeyPath)
+	opts.ScanConcurrency, _ = strconv.Atoi(os.Getenv(envMilbotAtndScanConcurrency))
+	opts.ProbeTimeout, _ = time.ParseDuration(os.Getenv(envMilbotAtndProbeTimeout))
+	opts.ScanDeadline, _ = time.ParseDuration(os.Getenv(envMilbotAtndScanDeadline))
+	opts.MissThreshold, _ = strconv.Atoi(os.Getenv(envMilbotAtndMissThreshold))
+	opts.DepartureGrace, _ = time.ParseDuration(os.Getenv(envMilbotAtndDepartureGrace))
+	opts.HistoryRetention, _ = time.ParseDuration(os.Getenv(envMilbotAtndHistoryRetention))
+	opts.ConfigBackups, _ = strconv.Atoi(os.Getenv(envMilbotAtndConfigBackups))
+	return opts, nil
+}
+
+// withDefaults はゼロ値の項目をデフォルト値にした Options を返します。
+func (opts Options) withDefaults() (Options, error) {
+	var err error
+	if opts.ConfigPath == "" {
+		opts.ConfigPath, err = botdata.Path(configFileName)
+		if err != nil {
+			return opts, fmt.Errorf("cannot get config path: %w", err)
+		}
+	}
+	if opts.KeyPath == "" {
+		opts.KeyPath, err = botdata.Path(encKeyFileName)
+		if err != nil {
+			return opts, fmt.Errorf("cannot get enc key path: %w", err)
+		}
+	}
+	if opts.ConfigBackups == 0 {
+		opts.ConfigBackups = defaultConfigBackups
+	}
+	if opts.HistoryPath == "" {
+		opts.HistoryPath, err = botdata.Path(historyFileName)
+		if err != nil {
+			return opts, fmt.Errorf("cannot get history path: %w", err)
+		}
+	}
+	if opts.HistoryRetention <= 0 {
+		opts.HistoryRetention = defaultHistoryRetention
+	}
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+	if opts.Detector == nil {
+		opts.Detector = new(L2pingDetector)
+	}
+	if opts.ScanConcurrency <= 0 {
+		opts.ScanConcurrency = defaultScanConcurrency
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = defaultProbeTimeout
+	}
+	if opts.ScanDeadline <= 0 {
+		opts.ScanDeadline = defaultScanDeadline
+	}
+	if opts.MissThreshold <= 0 {
+		opts.MissThreshold = defaultMissThreshold
+	}
+	if opts.DepartureGrace <= 0 {
+		opts.DepartureGrace = defaultDepartureGrace
+	}
+	return opts, nil
+}
@@ -0,0 +1,124 @@
+package libatnd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OwnerExistError はユーザがすでにほかのメンバーの持ち主であることを表すエラーです。
+// ひとりのユーザが持てるメンバーはひとつだけです。
+type OwnerExistError struct {
+	UserID string
+	Name   string
+}
+
+// Error です。
+func (e OwnerExistError) Error() string {
+	return fmt.Sprintf("user %s already owns member %q", e.UserID, e.Name)
+}
+
+// MemberExistError は同じ名前のメンバーがもう登録されていることを表すエラーです。
+type MemberExistError struct {
+	Name string
+}
+
+// Error です。
+func (e MemberExistError) Error() string {
+	return fmt.Sprintf("member already exists: %q", e.Name)
+}
+
+// MemberOwner は name のメンバーを登録した Slack のユーザ ID を返します。
+// 持ち主のいないメンバーなら空文字列を返します。
+func (a *Atnd) MemberOwner(name string) (string, error) {
+	a.muConfig.RLock()
+	defer a.muConfig.RUnlock()
+
+	mem := a.findMember(name)
+	if mem == nil {
+		return "", MemberNotExistError{Name: name}
+	}
+	return mem.UserID, nil
+}
+
+// MemberOf は userID が持ち主のメンバーの名前を返します。いなければ ok は false です。
+func (a *Atnd) MemberOf(userID string) (name string, ok bool) {
+	if userID == "" {
+		return "", false
+	}
+
+	a.muConfig.RLock()
+	defer a.muConfig.RUnlock()
+
+	for _, mem := range a.config.Members {
+		if mem.UserID == userID {
+			return mem.Name, true
+		}
+	}
+	return "", false
+}
+
+// SetMemberOwner は name のメンバーの持ち主を userID にします。userID が空なら持ち主をなくします。
+// userID がすでにほかのメンバーの持ち主なら OwnerExistError を返します。
+func (a *Atnd) SetMemberOwner(name, userID string) error {
+	a.muConfig.Lock()
+	defer a.muConfig.Unlock()
+
+	mem := a.findMember(name)
+	if mem == nil {
+		return MemberNotExistError{Name: name}
+	}
+
+	if userID != "" {
+		for _, other := range a.config.Members {
+			if other != mem && other.UserID == userID {
+				return OwnerExistError{UserID: userID, Name: other.Name}
+			}
+		}
+	}
+
+	mem.UserID = userID
+	if err := a.dumpConfig(); err != nil {
+		return fmt.Errorf("set member owner failed: %w", err)
+	}
+	return nil
+}
+
+// CreateMember は name のメンバーを dev の機器で新しく登録して，持ち主を userID にします。
+// name のメンバーがもういれば MemberExistError を，userID がすでにほかのメンバーの持ち主なら
+// OwnerExistError を返します。確かめてから登録するまでロックしたままなので，
+// 同時に同じ名前を登録しても最初のひとりだけが登録できます。
+func (a *Atnd) CreateMember(name, userID string, dev Device) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return InvalidNameError{Name: name}
+	}
+	if err := validateDevice(&dev); err != nil {
+		return err
+	}
+
+	a.muConfig.Lock()
+	defer a.muConfig.Unlock()
+
+	if a.findMember(name) != nil {
+		return MemberExistError{Name: name}
+	}
+	if userID != "" {
+		for _, other := range a.config.Members {
+			if other.UserID == userID {
+				return OwnerExistError{UserID: userID, Name: other.Name}
+			}
+		}
+	}
+
+	encryptedAddr, err := a.encrypt(dev.Address)
+	if err != nil {
+		return err
+	}
+
+	mem := a.addMember(name)
+	mem.UserID = userID
+	mem.Devices = append(mem.Devices, &device{Label: dev.Label, Detector: dev.Detector, EncryptedAddress: encryptedAddr})
+	if err := a.dumpConfig(); err != nil {
+		return fmt.Errorf("create member failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package libatnd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestMemberOwner(t *testing.T) {
+	a := newTestAtnd(t, new(recordDetector), map[string]string{
+		"alice": "01:23:45:67:89:ab",
+		"bob":   "01:23:45:67:89:ac",
+	})
+
+	tests := []struct {
+		name   string
+		userID string
+		err    interface{}
+	}{
+		{"alice", "UALICE", nil},
+		{"bob", "UBOB", nil},
+		{"bob", "UALICE", &OwnerExistError{}},
+		{"carol", "UCAROL", &MemberNotExistError{}},
+		{"alice", "UALICE", nil},
+	}
+	for idx, test := range tests {
+		err := a.SetMemberOwner(test.name, test.userID)
+		if test.err == nil && err != nil {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+		} else if test.err != nil && !errors.As(err, test.err) {
+			t.Errorf("[%d] expected %T, got %v", idx, test.err, err)
+		}
+	}
+
+	if owner, err := a.MemberOwner("bob"); err != nil || owner != "UBOB" {
+		t.Errorf("unexpected owner of bob: %q, %v", owner, err)
+	}
+	if name, ok := a.MemberOf("UALICE"); !ok || name != "alice" {
+		t.Errorf("unexpected member of UALICE: %q, %v", name, ok)
+	}
+	if _, ok := a.MemberOf(""); ok {
+		t.Error("unowned member found by empty user id")
+	}
+
+	// 持ち主は設定ファイルに残り，在室確認の結果にも入ります。
+	conf, err := a.loadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mem := range conf.Members {
+		if mem.Name == "alice" && mem.UserID != "UALICE" {
+			t.Errorf("owner not saved: %+v", mem)
+		}
+	}
+	res, err := a.SearchMemberContext(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res == nil || res.UserID != "UALICE" {
+		t.Errorf("unexpected attendance: %+v", res)
+	}
+
+	if err := a.SetMemberOwner("alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.MemberOf("UALICE"); ok {
+		t.Error("owner not cleared")
+	}
+}
+
+func TestCreateMember(t *testing.T) {
+	a := newTestAtnd(t, new(recordDetector), map[string]string{"bob": "01:23:45:67:89:ab"})
+
+	tests := []struct {
+		name   string
+		userID string
+		dev    Device
+		err    interface{}
+	}{
+		{"alice", "UALICE", BluetoothDevice("01:23:45:67:89:ac"), nil},
+		{"bob", "UBOB", BluetoothDevice("01:23:45:67:89:ad"), &MemberExistError{}},
+		{"carol", "UALICE", WiFiDevice("01:23:45:67:89:ae"), &OwnerExistError{}},
+		{"carol", "UCAROL", WiFiDevice("invalid"), &InvalidMACAddressError{}},
+		{"carol dave", "UCAROL", WiFiDevice("01:23:45:67:89:ae"), &InvalidNameError{}},
+		{"carol", "UCAROL", WiFiDevice("01:23:45:67:89:ae"), nil},
+	}
+	for idx, test := range tests {
+		err := a.CreateMember(test.name, test.userID, test.dev)
+		if test.err == nil && err != nil {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+		} else if test.err != nil && !errors.As(err, test.err) {
+			t.Errorf("[%d] expected %T, got %v", idx, test.err, err)
+		}
+	}
+
+	if owner, err := a.MemberOwner("bob"); err != nil || owner != "" {
+		t.Errorf("unexpected owner of bob: %q, %v", owner, err)
+	}
+	if name, ok := a.MemberOf("UCAROL"); !ok || name != "carol" {
+		t.Errorf("unexpected member of UCAROL: %q, %v", name, ok)
+	}
+	if devices, err := a.Devices("carol"); err != nil || len(devices) != 1 || devices[0].Detector != "lan" {
+		t.Errorf("unexpected devices of carol: %+v, %v", devices, err)
+	}
+}
+
+func TestCreateMemberConcurrent(t *testing.T) {
+	a := newTestAtnd(t, new(recordDetector), nil)
+
+	// 同時に同じ名前を登録しても，登録できるのはひとりだけです。
+	users := []string{"U1", "U2", "U3", "U4", "U5", "U6", "U7", "U8"}
+	errs := make([]error, len(users))
+	wg := new(sync.WaitGroup)
+	for i, userID := range users {
+		wg.Add(1)
+		go func(i int, userID string) {
+			defer wg.Done()
+			errs[i] = a.CreateMember("alice", userID, BluetoothDevice("01:23:45:67:89:ab"))
+		}(i, userID)
+	}
+	wg.Wait()
+
+	winner := ""
+	for i, err := range errs {
+		var existErr MemberExistError
+		if err == nil {
+			if winner != "" {
+				t.Errorf("both %s and %s created alice", winner, users[i])
+			}
+			winner = users[i]
+		} else if !errors.As(err, &existErr) {
+			t.Errorf("unexpected error for %s: %v", users[i], err)
+		}
+	}
+	if owner, err := a.MemberOwner("alice"); err != nil || owner != winner || winner == "" {
+		t.Errorf("expected owner %q, got %q, %v", winner, owner, err)
+	}
+}
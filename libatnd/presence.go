@@ -0,0 +1,189 @@
+package libatnd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultMissThreshold は在室していたメンバーを退室したとみなすまでに必要な，
+// 連続して見つからなかった回数のデフォルト値です。
+const defaultMissThreshold = 3
+
+// defaultDepartureGrace は最後に見つかってから退室したとみなすまでの最短の時間のデフォルト値です。
+const defaultDepartureGrace = 15 * time.Minute
+
+// PresenceState はメンバーの在室状態です。
+//
+//	StateUnknown → StatePresent ⇄ StateLeaving → StateAbsent → StatePresent → …
+//
+// 在室しているメンバーが見つからなかったら StateLeaving になり，
+// MissThreshold 回続けて見つからず，最後に見つかってから DepartureGrace 経ったら StateAbsent になります。
+// StateLeaving の間に見つかれば，在室し始めた時間はそのままで StatePresent に戻ります。
+type PresenceState int
+
+const (
+	// StateUnknown は Bot を起動してからまだ状態がわからないことを表します。
+	StateUnknown PresenceState = iota
+	// StatePresent は在室していることを表します。
+	StatePresent
+	// StateLeaving は在室していたが最近見つからないことを表します。まだ在室中として扱います。
+	StateLeaving
+	// StateAbsent は不在であることを表します。
+	StateAbsent
+)
+
+// String は s の名前を返します。
+func (s PresenceState) String() string {
+	switch s {
+	case StateUnknown:
+		return "unknown"
+	case StatePresent:
+		return "present"
+	case StateLeaving:
+		return "leaving"
+	case StateAbsent:
+		return "absent"
+	}
+	return "invalid"
+}
+
+// InLab は s が在室中として扱う状態かどうかを返します。
+func (s PresenceState) InLab() bool {
+	return s == StatePresent || s == StateLeaving
+}
+
+// Presence はメンバーの在室状態です。
+type Presence struct {
+	Name     string
+	State    PresenceState
+	Arrived  time.Time // 今の在室が始まった時間です。在室中でなければ最後の在室が始まった時間です。
+	Departed time.Time // 最後に退室した時間です。わからなければゼロ値です。
+	LastSeen time.Time // 最後に見つかった時間です。
+
+	misses int // 続けて見つからなかった回数です。
+}
+
+// presenceTracker はメンバーごとの在室状態を管理します。
+type presenceTracker struct {
+	missThreshold  int
+	departureGrace time.Duration
+
+	mu        *sync.RWMutex
+	presences map[string]*Presence
+}
+
+// newPresenceTracker は names のメンバーの在室状態を管理する presenceTracker を作ります。
+func newPresenceTracker(missThreshold int, departureGrace time.Duration, names []string) *presenceTracker {
+	t := &presenceTracker{
+		missThreshold:  missThreshold,
+		departureGrace: departureGrace,
+		mu:             new(sync.RWMutex),
+		presences:      map[string]*Presence{},
+	}
+	for _, name := range names {
+		t.presences[name] = &Presence{Name: name}
+	}
+	return t
+}
+
+// observe は name が now に見つかったかどうかで状態を進めます。変わる前と後の状態を返します。
+func (t *presenceTracker) observe(name string, seen bool, now time.Time) (from, to PresenceState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.presences[name]
+	if !ok {
+		p = &Presence{Name: name}
+		t.presences[name] = p
+	}
+	from = p.State
+
+	if seen {
+		p.misses = 0
+		p.LastSeen = now
+		if p.State != StatePresent && p.State != StateLeaving {
+			p.Arrived = now
+		}
+		p.State = StatePresent
+		return from, p.State
+	}
+
+	p.misses++
+	switch p.State {
+	case StatePresent, StateLeaving:
+		p.State = StateLeaving
+		if p.misses >= t.missThreshold && now.Sub(p.LastSeen) >= t.departureGrace {
+			p.State = StateAbsent
+			p.Departed = p.LastSeen
+		}
+	case StateUnknown:
+		if p.misses >= t.missThreshold {
+			p.State = StateAbsent
+		}
+	}
+	return from, p.State
+}
+
+// add は name の在室状態を StateUnknown で追加します。すでにあれば何もしません。
+func (t *presenceTracker) add(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.presences[name]; !ok {
+		t.presences[name] = &Presence{Name: name}
+	}
+}
+
+// restore は在室履歴の最後の記録 s から在室状態を戻します。
+// 在室中の記録なら，見つかるまでは StateLeaving にします。
+func (t *presenceTracker) restore(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.presences[s.Member]
+	if !ok {
+		return
+	}
+	p.Arrived, p.Departed, p.LastSeen = s.Arrived, s.Departed, s.LastSeen
+	if s.Ongoing() {
+		p.State = StateLeaving
+	} else {
+		p.State = StateAbsent
+	}
+}
+
+// remove は name の在室状態を消します。
+func (t *presenceTracker) remove(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.presences, name)
+}
+
+// get は name の在室状態のコピーを返します。
+func (t *presenceTracker) get(name string) (*Presence, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	p, ok := t.presences[name]
+	if !ok {
+		return nil, false
+	}
+	cp := *p
+	return &cp, true
+}
+
+// all はすべてのメンバーの在室状態のコピーを名前順に返します。
+func (t *presenceTracker) all() []*Presence {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	res := []*Presence{}
+	for _, p := range t.presences {
+		cp := *p
+		res = append(res, &cp)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
@@ -0,0 +1,150 @@
+package libatnd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresenceTrackerObserve(t *testing.T) {
+	base := time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+
+	type step struct {
+		min   int
+		seen  bool
+		state PresenceState
+	}
+
+	tests := []struct {
+		steps    []step
+		arrived  time.Time
+		departed time.Time
+	}{
+		// 見つかったら在室になる。
+		{
+			[]step{{0, true, StatePresent}},
+			at(0), time.Time{},
+		},
+		// 起動してから見つからなければ不在になるが，退室時間はわからない。
+		{
+			[]step{{0, false, StateUnknown}, {5, false, StateUnknown}, {10, false, StateAbsent}},
+			time.Time{}, time.Time{},
+		},
+		// 一時的に見つからなくても在室し始めた時間は変わらない。
+		{
+			[]step{{0, true, StatePresent}, {5, false, StateLeaving}, {10, false, StateLeaving}, {15, true, StatePresent}},
+			at(0), time.Time{},
+		},
+		// 回数が足りても猶予時間が経っていなければ不在にならない。
+		{
+			[]step{{0, true, StatePresent}, {1, false, StateLeaving}, {2, false, StateLeaving}, {3, false, StateLeaving}},
+			at(0), time.Time{},
+		},
+		// 回数と猶予時間がどちらも足りたら最後に見つかった時間に退室したことにする。
+		{
+			[]step{{0, true, StatePresent}, {5, true, StatePresent}, {10, false, StateLeaving},
+				{15, false, StateLeaving}, {20, false, StateAbsent}},
+			at(0), at(5),
+		},
+		// 退室してからまた見つかったら在室し始めた時間を更新する。
+		{
+			[]step{{0, true, StatePresent}, {10, false, StateLeaving}, {15, false, StateLeaving},
+				{20, false, StateAbsent}, {30, true, StatePresent}},
+			at(30), at(0),
+		},
+	}
+
+	for idx, test := range tests {
+		tr := newPresenceTracker(3, 15*time.Minute, []string{"alice"})
+		for sidx, s := range test.steps {
+			if _, state := tr.observe("alice", s.seen, at(s.min)); state != s.state {
+				t.Errorf("[%d] step %d: expected %v, got %v", idx, sidx, s.state, state)
+			}
+		}
+
+		p, ok := tr.get("alice")
+		if !ok {
+			t.Fatalf("[%d] alice not found", idx)
+		}
+		if !p.Arrived.Equal(test.arrived) {
+			t.Errorf("[%d] expected arrived %v, got %v", idx, test.arrived, p.Arrived)
+		}
+		if !p.Departed.Equal(test.departed) {
+			t.Errorf("[%d] expected departed %v, got %v", idx, test.departed, p.Departed)
+		}
+	}
+}
+
+func TestAtndPresence(t *testing.T) {
+	script := "alice present\nalice absent\n"
+	detector, err := NewScriptDetector(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAtnd(t, detector, map[string]string{"alice": "01:23:45:67:89:ab"})
+
+	if _, err := a.SearchMemberContext(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Presence("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.State != StatePresent || p.Arrived.IsZero() {
+		t.Errorf("expected present with arrived time, got %+v", p)
+	}
+
+	if _, err := a.SearchMemberContext(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := a.Presence("alice"); p.State != StateLeaving {
+		t.Errorf("expected leaving, got %v", p.State)
+	}
+
+	if err := a.DeleteMember("alice"); err != nil {
+		t.Fatal(err)
+	}
+	var notExistErr MemberNotExistError
+	if _, err := a.Presence("alice"); !errors.As(err, &notExistErr) {
+		t.Errorf("expected MemberNotExistError, got %v", err)
+	}
+}
+
+func TestAttendanceSingleMiss(t *testing.T) {
+	script := "alice present\nalice absent\nalice absent\nalice absent\n"
+	detector, err := NewScriptDetector(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	now := base
+	a := newTestAtndWithOptions(t, Options{Detector: detector, Clock: func() time.Time { return now }},
+		map[string]string{"alice": "01:23:45:67:89:ab"})
+
+	tests := []struct {
+		at       time.Duration
+		attended bool
+	}{
+		{0, true},
+		// 一度見つからなかっただけでは在室のままです。
+		{5 * time.Minute, true},
+		{10 * time.Minute, true},
+		{20 * time.Minute, false},
+	}
+	for idx, test := range tests {
+		now = base.Add(test.at)
+		res, err := a.SearchMemberContext(context.Background(), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (res != nil) != test.attended {
+			t.Errorf("[%d] expected attended %v, got %+v", idx, test.attended, res)
+		}
+		if res != nil && !res.Time.Equal(base) {
+			t.Errorf("[%d] expected last seen %v, got %v", idx, base, res.Time)
+		}
+	}
+}
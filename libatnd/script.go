@@ -0,0 +1,109 @@
+package libatnd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ScriptDetector はスクリプトどおりに在室判定をする Detector です。
+// テストやデモで Bluetooth を使わずに在室判定をしたいときに使います。
+//
+// スクリプトは 1 行にひとつ「名前 結果 [理由]」を書きます。
+// 結果は present, absent, error のどれかで，error のときは理由がエラーメッセージになります。
+// 理由が "bluetooth not available" なら ErrBluetoothNotAvailable になります。
+// # で始まる行と空行は無視します。
+//
+//	alice present
+//	bob absent
+//	alice error bluetooth not available
+//
+// Detect はメンバーごとに上から順に結果を返し，最後まで来たら最後の結果を返し続けます。
+// スクリプトにないメンバーはいないと判定します。
+type ScriptDetector struct {
+	mu    *sync.Mutex
+	steps map[string][]scriptStep
+}
+
+// scriptStep はスクリプトの 1 行です。
+type scriptStep struct {
+	present bool
+	err     error
+	reason  string
+}
+
+// NewScriptDetector は r からスクリプトを読んで ScriptDetector を作ります。
+func NewScriptDetector(r io.Reader) (*ScriptDetector, error) {
+	d := &ScriptDetector{mu: new(sync.Mutex), steps: map[string][]scriptStep{}}
+
+	sc := bufio.NewScanner(r)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("parse script failed: line %d: too few fields", lineno)
+		}
+		name, reason := fields[0], strings.Join(fields[2:], " ")
+
+		step := scriptStep{reason: reason}
+		switch fields[1] {
+		case "present":
+			step.present = true
+		case "absent":
+		case "error":
+			if reason == "" {
+				reason = "scripted error"
+			}
+			if reason == ErrBluetoothNotAvailable.Error() {
+				step.err = ErrBluetoothNotAvailable
+			} else {
+				step.err = errors.New(reason)
+			}
+		default:
+			return nil, fmt.Errorf("parse script failed: line %d: unknown result %q", lineno, fields[1])
+		}
+		if step.reason == "" {
+			step.reason = "scripted " + fields[1]
+		}
+
+		d.steps[name] = append(d.steps[name], step)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("parse script failed: %w", err)
+	}
+
+	return d, nil
+}
+
+// Detect はスクリプトの target.Name の次の結果を返します。
+func (d *ScriptDetector) Detect(ctx context.Context, target Target) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	steps := d.steps[target.Name]
+	if len(steps) == 0 {
+		return Result{Present: false, Reason: "not in script"}, nil
+	}
+
+	step := steps[0]
+	if len(steps) > 1 {
+		d.steps[target.Name] = steps[1:]
+	}
+
+	if step.err != nil {
+		return Result{}, step.err
+	}
+	return Result{Present: step.present, Reason: step.reason, Source: "script"}, nil
+}
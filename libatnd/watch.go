@@ -0,0 +1,71 @@
+package libatnd
+
+import (
+	"context"
+	"sync"
+
+	"github.com/high-moctane/milbot/botcrash"
+)
+
+// Watcher は Atnd が動いている間，バックグラウンドで電波を受信し続ける Detector です。
+// Atnd はその Detector で初めて判定するときに Watch を始めて，Close で ctx を終わらせます。
+// Watch は ctx が終わったら返ってください。
+type Watcher interface {
+	Watch(ctx context.Context)
+}
+
+// watchState は Atnd が始めた Watcher たちです。
+type watchState struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+
+	mu      *sync.Mutex
+	started map[Watcher]bool
+}
+
+// newWatchState は Close まで Watcher を動かす watchState を作ります。
+func newWatchState() *watchState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &watchState{
+		ctx:     ctx,
+		cancel:  cancel,
+		wg:      new(sync.WaitGroup),
+		mu:      new(sync.Mutex),
+		started: map[Watcher]bool{},
+	}
+}
+
+// watch は d が Watcher でまだ始めていなければ Watch を始めます。AnyDetector の中も見ます。
+func (s *watchState) watch(d Detector) {
+	switch d := d.(type) {
+	case AnyDetector:
+		for _, child := range d {
+			s.watch(child)
+		}
+		return
+	case Watcher:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.started[d] || s.ctx.Err() != nil {
+			return
+		}
+		s.started[d] = true
+		s.wg.Add(1)
+		go func() {
+			defer botcrash.Recover()
+			defer s.wg.Done()
+			d.Watch(s.ctx)
+		}()
+	}
+}
+
+// stop は始めた Watcher を止めて，終わるまで待ちます。
+func (s *watchState) stop() {
+	s.mu.Lock()
+	s.cancel()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
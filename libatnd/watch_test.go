@@ -0,0 +1,57 @@
+package libatnd
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// watchDetector は Watch した回数と，Watch が終わったかどうかを覚えておく Detector です。
+type watchDetector struct {
+	recordDetector
+
+	mu      sync.Mutex
+	starts  int
+	stopped chan struct{}
+}
+
+func (d *watchDetector) Watch(ctx context.Context) {
+	d.mu.Lock()
+	d.starts++
+	d.mu.Unlock()
+
+	<-ctx.Done()
+	close(d.stopped)
+}
+
+func TestWatch(t *testing.T) {
+	d := &watchDetector{stopped: make(chan struct{})}
+	a := newTestAtndWithOptions(t, Options{Detector: AnyDetector{new(absentDetector), d}},
+		map[string]string{"alice": "01:23:45:67:89:ab"})
+
+	// 判定するまでは始めません。
+	d.mu.Lock()
+	if d.starts != 0 {
+		t.Errorf("watch started before detect: %d", d.starts)
+	}
+	d.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.SearchMemberContext(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Close で止まるまで待つので，そのあとは starts を読めます。
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-d.stopped:
+	default:
+		t.Error("watch not stopped by Close")
+	}
+	if d.starts != 1 {
+		t.Errorf("expected 1 watch, got %d", d.starts)
+	}
+}
@@ -2,34 +2,65 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/high-moctane/milbot/botcrash"
 	"github.com/high-moctane/milbot/botlog"
 	"github.com/high-moctane/milbot/botplugin"
 	"github.com/high-moctane/milbot/botplugins/atnd"
+	"github.com/high-moctane/milbot/botplugins/audit"
 	"github.com/high-moctane/milbot/botplugins/exit"
 	"github.com/high-moctane/milbot/botplugins/kitakunoki"
 	"github.com/high-moctane/milbot/botplugins/ping"
 	"github.com/high-moctane/milbot/botplugins/restart"
+	"github.com/high-moctane/milbot/libatnd"
 	_ "github.com/joho/godotenv/autoload"
 )
 
-// plugins にプラグインを入れていくぞ(｀･ω･´)！
-var plugins = []botplugin.Plugin{
-	atnd.New(),
-	exit.New(),
-	kitakunoki.New(),
-	ping.New(),
-	restart.New(),
+// newPlugins にプラグインを入れていくぞ(｀･ω･´)！
+// 在室管理を使うプラグインには a を渡します。
+func newPlugins(a *libatnd.Atnd) []botplugin.Plugin {
+	return []botplugin.Plugin{
+		atnd.New(a),
+		audit.New(),
+		exit.New(),
+		kitakunoki.New(a),
+		ping.New(),
+		restart.New(),
+	}
 }
 
 func main() {
+	defer botcrash.Recover()
+
 	if err := run(); err != nil {
-		botlog.Sendf("milbot terminated with non-zero status code: %v", err)
-		log.Fatal(err)
+		botlog.Error("milbot terminated with non-zero status code", "error", err)
+		if err := botcrash.Write(err.Error()); err != nil {
+			log.Print(err)
+		}
+		flushLog()
+		os.Exit(1)
+	}
+
+	if err := botcrash.Finish(); err != nil {
+		log.Print(err)
+	}
+}
+
+// flushLogTimeout は終了するときにログを送信し終わるのを待つ時間です。
+const flushLogTimeout = 10 * time.Second
+
+// flushLog は送信待ちのログを送信し終わるまで待ちます。
+func flushLog() {
+	ctx, cancel := context.WithTimeout(context.Background(), flushLogTimeout)
+	defer cancel()
+	if err := botlog.Flush(ctx); err != nil {
+		log.Print(err)
 	}
 }
 
@@ -40,15 +71,31 @@ func run() error {
 	defer cancel()
 
 	// ログ
-	log.Print("milbot launch (｀･ω･´)！")
-	botlog.Send("milbot launch (｀･ω･´)")
-	defer log.Print("milbot terminated (｀･ω･´)")
-	defer botlog.Send("milbot terminated (｀･ω･´)")
+	defer flushLog()
+	botlog.Info("milbot launch (｀･ω･´)")
+	if err := botcrash.Start(ctx); err != nil {
+		botlog.Warn("start crash reporter failed", "error", err)
+	}
+	defer botlog.Info("milbot terminated (｀･ω･´)")
+
+	// 在室管理
+	opts, err := libatnd.OptionsFromEnv()
+	if err != nil {
+		return fmt.Errorf("run failed: %w", err)
+	}
+	a, err := libatnd.New(opts)
+	if err != nil {
+		return fmt.Errorf("run failed: %w", err)
+	}
+	defer a.Close()
 
 	// Bot の起動
 	errCh := make(chan error)
-	bot := NewBot(plugins)
-	go func() { errCh <- bot.Serve(ctx) }()
+	bot := NewBot(newPlugins(a), a)
+	go func() {
+		defer botcrash.Recover()
+		errCh <- bot.Serve(ctx)
+	}()
 	defer bot.Stop()
 
 	// シグナルハンドリングや Bot のエラーによる終了処理
@@ -60,9 +107,9 @@ func run() error {
 	case sig := <-sigCh:
 		switch sig {
 		case syscall.SIGINT:
-			botlog.Send("receive SIGINT")
+			botlog.Info("received SIGINT")
 		case syscall.SIGTERM:
-			botlog.Send("received SITGERM")
+			botlog.Info("received SIGTERM")
 		}
 	}
 
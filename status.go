@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/high-moctane/milbot/botclient"
+	"github.com/high-moctane/milbot/botversion"
+	"github.com/high-moctane/milbot/libatnd"
+	"github.com/slack-go/slack"
+)
+
+// StatusPlugin は Bot の状態を返すプラグインです。
+type StatusPlugin struct {
+	client      *botclient.Client
+	bot         *Bot
+	atnd        *libatnd.Atnd
+	validRegexp *regexp.Regexp
+}
+
+// NewStatusPlugin でプラグインを生成します。bot と atnd に状態を調べる Bot と Atnd を与えます。
+func NewStatusPlugin(bot *Bot, atnd *libatnd.Atnd) *StatusPlugin {
+	return &StatusPlugin{
+		bot:         bot,
+		atnd:        atnd,
+		validRegexp: regexp.MustCompile(`(?i)^milbot status`),
+	}
+}
+
+// Name はプラグインの名前を返します。
+func (*StatusPlugin) Name() string {
+	return "status"
+}
+
+// Commands はプラグインが受け付けるコマンドを返します。
+func (*StatusPlugin) Commands() []string {
+	return []string{"status"}
+}
+
+// Start でプラグインを有効化します。
+func (p *StatusPlugin) Start(client *botclient.Client) error {
+	p.client = client
+	return nil
+}
+
+// Serve で Bot の状態を返します。
+func (p *StatusPlugin) Serve(ctx context.Context, event slack.RTMEvent) error {
+	if !p.isValidEvent(event) {
+		return nil
+	}
+
+	ev := event.Data.(*slack.MessageEvent)
+	_, _, _, err := p.client.SendMessageContext(
+		ctx,
+		ev.Channel,
+		slack.MsgOptionText(p.buildStatusMessage(time.Now()), true),
+	)
+	if err != nil {
+		return fmt.Errorf("status failed: %w", err)
+	}
+	return nil
+}
+
+// isValidEvent は event に反応するべきかどうか返します。
+func (p *StatusPlugin) isValidEvent(event slack.RTMEvent) bool {
+	ev, ok := event.Data.(*slack.MessageEvent)
+	if !ok {
+		return false
+	}
+	return p.validRegexp.MatchString(ev.Text)
+}
+
+// buildStatusMessage は Bot の状態のメッセージを構築します。
+func (p *StatusPlugin) buildStatusMessage(now time.Time) string {
+	msg := new(strings.Builder)
+
+	fmt.Fprintf(msg, "バージョン: %s (commit %s)\n", botversion.Version, botversion.Commit)
+	fmt.Fprintf(msg, "Go: %s\n", botversion.GoVersion())
+	fmt.Fprintf(msg, "稼働時間: %s\n", p.bot.Uptime().Truncate(time.Second))
+
+	connected, reconnects := p.bot.Connection()
+	if connected {
+		fmt.Fprintf(msg, "接続: 接続中 (再接続 %d 回)\n", reconnects)
+	} else {
+		fmt.Fprintf(msg, "接続: 切断中 (再接続 %d 回)\n", reconnects)
+	}
+
+	fmt.Fprintf(msg, "プラグイン: %s\n", strings.Join(p.bot.PluginNames(), ", "))
+	fmt.Fprintf(msg, "goroutine: %d\n", runtime.NumGoroutine())
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(msg, "メモリ: alloc %s / sys %s\n", formatBytes(mem.Alloc), formatBytes(mem.Sys))
+
+	msg.WriteString(p.scanMessage(now))
+
+	return msg.String()
+}
+
+// scanMessage は在室確認の実行状況のメッセージを構築します。
+func (p *StatusPlugin) scanMessage(now time.Time) string {
+	info := p.atnd.ScanInfo()
+
+	msg := new(strings.Builder)
+	if info.Start.IsZero() {
+		msg.WriteString("前回の在室確認: まだ実行していません\n")
+	} else {
+		fmt.Fprintf(msg, "前回の在室確認: %s (所要 %s)\n",
+			info.Start.Format("2006-01-02 15:04:05"), info.Duration.Truncate(time.Millisecond))
+		if info.Err != nil {
+			fmt.Fprintf(msg, "前回のエラー: %v\n", info.Err)
+		} else {
+			msg.WriteString("前回のエラー: なし\n")
+		}
+		if len(info.Unscanned) > 0 {
+			fmt.Fprintf(msg, "前回確認できなかったメンバー: %s\n", strings.Join(info.Unscanned, ", "))
+		}
+	}
+
+	if info.Next.IsZero() {
+		msg.WriteString("次回の在室確認: 予定なし")
+	} else {
+		fmt.Fprintf(msg, "次回の在室確認: %s (%s 後)",
+			info.Next.Format("2006-01-02 15:04:05"), info.Next.Sub(now).Truncate(time.Second))
+	}
+
+	return msg.String()
+}
+
+// formatBytes はバイト数を読みやすい形式に変換します。
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Stop でプラグインの終了処理をします。
+func (p *StatusPlugin) Stop() error {
+	return nil
+}
+
+// Help でヘルプメッセージを返します。
+func (p *StatusPlugin) Help() string {
+	return "[Status]\n" +
+		"`milbot status` で Bot のバージョンや稼働時間，在室確認の実行状況などを表示します。"
+}